@@ -0,0 +1,157 @@
+// Package acl implements prefix based access control lists for the resources of storaged.
+//
+// Resources are named like the API routes: "kv/<key>" for kv pairs, "ts/<key>" for timeseries
+// and "admin/<endpoint>" for the admin endpoints. An ACL is a list of rules like "ts/sensors/* read",
+// everything which isn't granted by one of its rules is denied.
+package acl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Permission is the kind of access to a resource
+type Permission string
+
+const (
+	// Read allows to get kv pairs, to read timeseries and to list or watch them
+	Read Permission = "read"
+	// Write allows to put kv pairs, to add values to timeseries and to change their labels
+	Write Permission = "write"
+	// Delete allows to delete kv pairs and timeranges of timeseries
+	Delete Permission = "delete"
+)
+
+// OwnID is replaced with the identity of the caller in the patterns of rules,
+// so that "kv/devices/<own-id>/* write" grants every device access to its own keys
+const OwnID = "<own-id>"
+
+// ParsePermission parses the name of a permission
+func ParsePermission(str string) (Permission, error) {
+	switch perm := Permission(str); perm {
+	case Read, Write, Delete:
+		return perm, nil
+	}
+	return "", fmt.Errorf("unknown permission '%v'", str)
+}
+
+// KV returns the resource name of a kv pair
+func KV(key string) string {
+	return "kv/" + key
+}
+
+// TS returns the resource name of a timeseries
+func TS(key string) string {
+	return "ts/" + key
+}
+
+// Admin returns the resource name of an admin endpoint like "tokens"
+func Admin(endpoint string) string {
+	return "admin/" + endpoint
+}
+
+// Rule grants permissions on the resources matching Pattern.
+// Patterns ending with '*' match all resources starting with the rest of the pattern, others only the resource itself.
+type Rule struct {
+	Pattern     string
+	Permissions []Permission
+}
+
+// ParseRule parses rules of the form "kv/devices/<own-id>/* read,write"
+func ParseRule(str string) (*Rule, error) {
+	fields := strings.Fields(str)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("malformed acl rule '%v', expected '<pattern> <permission>[,<permission>...]'", str)
+	}
+	rule := &Rule{Pattern: fields[0]}
+	for _, name := range strings.Split(fields[1], ",") {
+		perm, err := ParsePermission(name)
+		if err != nil {
+			return nil, err
+		}
+		rule.Permissions = append(rule.Permissions, perm)
+	}
+	return rule, nil
+}
+
+// MarshalText encodes the rule like ParseRule expects it, so that ACLs are stored as list of rule strings
+func (rule *Rule) MarshalText() ([]byte, error) {
+	return []byte(rule.String()), nil
+}
+
+// UnmarshalText decodes a rule encoded with MarshalText
+func (rule *Rule) UnmarshalText(bs []byte) error {
+	res, err := ParseRule(string(bs))
+	if err != nil {
+		return err
+	}
+	*rule = *res
+	return nil
+}
+
+func (rule *Rule) String() string {
+	perms := make([]string, len(rule.Permissions))
+	for i, perm := range rule.Permissions {
+		perms[i] = string(perm)
+	}
+	return fmt.Sprintf("%v %v", rule.Pattern, strings.Join(perms, ","))
+}
+
+// Grants checks if the rule grants perm on resource to the caller with the given identity
+func (rule *Rule) Grants(identity string, perm Permission, resource string) bool {
+	if !rule.has(perm) {
+		return false
+	}
+	// the wildcard is checked before the substitution, so that identities can't contain wildcards
+	if strings.HasSuffix(rule.Pattern, "*") {
+		prefix := strings.ReplaceAll(rule.Pattern[:len(rule.Pattern)-1], OwnID, identity)
+		return strings.HasPrefix(resource, prefix)
+	}
+	return resource == strings.ReplaceAll(rule.Pattern, OwnID, identity)
+}
+
+func (rule *Rule) has(perm Permission) bool {
+	for _, p := range rule.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL is a list of rules, a permission is granted if any of them grants it
+type ACL []*Rule
+
+// Parse parses an ACL with one rule per element
+func Parse(rules []string) (ACL, error) {
+	acl := make(ACL, 0, len(rules))
+	for _, str := range rules {
+		rule, err := ParseRule(str)
+		if err != nil {
+			return nil, err
+		}
+		acl = append(acl, rule)
+	}
+	return acl, nil
+}
+
+// Allows checks if the caller with the given identity has perm on resource, everything not granted is denied
+func (acl ACL) Allows(identity string, perm Permission, resource string) bool {
+	for _, rule := range acl {
+		if rule.Grants(identity, perm, resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// Effective returns the rules with OwnID replaced by identity, sorted by pattern
+func (acl ACL) Effective(identity string) ACL {
+	res := make(ACL, len(acl))
+	for i, rule := range acl {
+		res[i] = &Rule{strings.ReplaceAll(rule.Pattern, OwnID, identity), rule.Permissions}
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Pattern < res[j].Pattern })
+	return res
+}
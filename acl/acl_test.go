@@ -0,0 +1,57 @@
+package acl
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule("kv/devices/<own-id>/* read,write")
+	assert.NoError(t, err)
+	assert.Equal(t, &Rule{"kv/devices/<own-id>/*", []Permission{Read, Write}}, rule)
+	assert.Equal(t, "kv/devices/<own-id>/* read,write", rule.String())
+	for _, str := range []string{"", "kv/*", "kv/* read write", "kv/* own", "kv/* read,"} {
+		_, err := ParseRule(str)
+		assert.Error(t, err, str)
+	}
+}
+
+func TestAllows(t *testing.T) {
+	acl, err := Parse([]string{"ts/sensors/* read", "kv/devices/<own-id>/* read,write", "kv/config read"})
+	assert.NoError(t, err)
+	cases := []struct {
+		identity string
+		perm     Permission
+		resource string
+		allowed  bool
+	}{
+		{"dev1", Read, TS("sensors/a"), true},
+		{"dev1", Write, TS("sensors/a"), false},
+		{"dev1", Read, TS("other"), false},
+		{"dev1", Write, KV("devices/dev1/a"), true},
+		{"dev1", Delete, KV("devices/dev1/a"), false},
+		{"dev1", Write, KV("devices/dev2/a"), false},
+		{"dev*", Write, KV("devices/dev2/a"), false},
+		{"dev1", Read, KV("config"), true},
+		{"dev1", Read, KV("config/a"), false},
+		{"dev1", Read, Admin("tokens"), false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.allowed, acl.Allows(c.identity, c.perm, c.resource), "%v %v %v", c.identity, c.perm, c.resource)
+	}
+	assert.False(t, ACL(nil).Allows("dev1", Read, KV("config")))
+}
+
+func TestEffective(t *testing.T) {
+	acl, err := Parse([]string{"ts/sensors/* read", "kv/devices/<own-id>/* read,write"})
+	assert.NoError(t, err)
+	bs, err := json.Marshal(acl.Effective("dev1"))
+	assert.NoError(t, err)
+	assert.Equal(t, `["kv/devices/dev1/* read,write","ts/sensors/* read"]`, string(bs))
+	var decoded ACL
+	assert.NoError(t, json.Unmarshal(bs, &decoded))
+	assert.Equal(t, acl.Effective("dev1"), decoded)
+	assert.Error(t, json.Unmarshal([]byte(`["kv/* own"]`), &decoded))
+}
@@ -3,20 +3,138 @@ package main
 import (
 	"flag"
 	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/trusch/storaged/metrics"
 	"github.com/trusch/storaged/server"
 	"github.com/trusch/storaged/storage"
 )
 
+// stringList is a flag which can be given multiple times
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ", ")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
 var listenAddr = flag.String("listen", ":80", "listen address")
-var backendURI = flag.String("backend", "bolt:///usr/share/storaged.boltdb", "storage backend address (leveldb://, bolt:// and mongodb:// are supported)")
+var backendURI = flag.String("backend", "bolt:///usr/share/storaged.boltdb", "storage backend address (leveldb://, bolt://, mongodb:// and memory:// are supported)")
+var retentionInterval = flag.Duration("retention-interval", time.Hour, "how often the retention rules are applied")
+var retentionRules stringList
+var duplicateRules stringList
+var rollupResolutions = flag.String("rollups", "", "comma separated list of rollup resolutions like '1m,1h,1d'")
+var rollupInterval = flag.Duration("rollup-interval", time.Minute, "how often new values are rolled up")
+var shutdownTimeout = flag.Duration("shutdown-timeout", server.DefaultShutdownTimeout, "how long in-flight requests may take on SIGTERM/SIGINT before their connections are closed")
+var tlsCert = flag.String("tls-cert", "", "certificate file, enables https (reloaded on SIGHUP)")
+var tlsKey = flag.String("tls-key", "", "key file of the certificate")
+var clientCA = flag.String("client-ca", "", "file with the CAs of the client certificates, clients need a certificate if given (reloaded on SIGHUP)")
+var tokenFile = flag.String("token-file", "", "file with one '<secret> <name> [<pattern> <permissions>]...' token per line like 's3cret sensor-1 ts/sensors/* read', 'cert:<identity> [<pattern> <permissions>]...' lines set the ACL of client certificates, enables auth, GET /metrics then needs 'admin/metrics read'")
+
+func init() {
+	flag.Var(&retentionRules, "retention", "retention rule like 'sensors/* keep 30d' (can be given multiple times)")
+	flag.Var(&duplicateRules, "duplicates", "policy for values at already used timestamps like 'sensors/* reject' (overwrite, reject or keep, can be given multiple times)")
+}
 
 func main() {
 	flag.Parse()
-	store, err := storage.NewMetaStorage(*backendURI)
+	meta, err := storage.NewMetaStorage(*backendURI)
 	if err != nil {
 		log.Fatal(err)
 	}
+	reg := metrics.NewRegistry()
+	// the URI is valid, NewMetaStorage parsed it
+	backend, _ := url.Parse(*backendURI)
+	store := metrics.InstrumentStorage(reg, meta, backend.Scheme)
+	duplicates := make([]*storage.DuplicateRule, 0, len(duplicateRules))
+	for _, str := range duplicateRules {
+		rule, err := storage.ParseDuplicateRule(str)
+		if err != nil {
+			log.Fatal(err)
+		}
+		duplicates = append(duplicates, rule)
+	}
+	store.SetDuplicateRules(duplicates)
+	janitor := storage.NewJanitor(store, *retentionInterval)
+	rules := make([]*storage.RetentionRule, 0, len(retentionRules))
+	for _, str := range retentionRules {
+		rule, err := storage.ParseRetentionRule(str)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	janitor.SetRules(rules)
+	janitor.Start()
+	var tokens []*server.Token
+	if *tokenFile != "" {
+		if tokens, err = server.LoadTokenFile(*tokenFile); err != nil {
+			log.Fatal(err)
+		}
+	}
 	server := server.New(*listenAddr, store)
-	log.Fatal(server.ListenAndServe())
+	server.EnableMetrics(reg)
+	server.SetJanitor(janitor)
+	server.SetShutdownTimeout(*shutdownTimeout)
+	if tokens != nil {
+		server.EnableAuth(tokens)
+	}
+	if *tlsCert != "" || *tlsKey != "" || *clientCA != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatal("-tls-cert and -tls-key are needed for https")
+		}
+		if err := server.EnableTLS(*tlsCert, *tlsKey, *clientCA); err != nil {
+			log.Fatal(err)
+		}
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				if err := server.ReloadTLS(); err != nil {
+					log.Print("failed to reload the certificates: ", err)
+					continue
+				}
+				log.Print("reloaded the certificates")
+			}
+		}()
+	}
+	var roller *storage.Roller
+	if *rollupResolutions != "" {
+		resolutions, err := storage.ParseResolutions(*rollupResolutions)
+		if err != nil {
+			log.Fatal(err)
+		}
+		roller = storage.NewRoller(store, resolutions, *rollupInterval)
+		roller.Start()
+		server.SetRoller(roller)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-served:
+		log.Fatal(err)
+	case sig := <-stop:
+		log.Printf("received %v, shutting down", sig)
+	}
+	// the background jobs use the store, which is closed by Shutdown
+	janitor.Stop()
+	if roller != nil {
+		roller.Stop()
+	}
+	if err := server.Stop(); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,285 @@
+// Package metrics implements counters, gauges and histograms which are exposed in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of histogram buckets for latencies in seconds
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is a single metric family of a registry
+type metric interface {
+	write(w io.Writer) error
+}
+
+// Registry holds metrics and writes them in the Prometheus text format
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (reg *Registry) register(m metric) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	reg.metrics = append(reg.metrics, m)
+}
+
+// Write writes all metrics in the order they were registered
+func (reg *Registry) Write(w io.Writer) error {
+	reg.mutex.Lock()
+	metrics := append([]metric{}, reg.metrics...)
+	reg.mutex.Unlock()
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// family holds the name and label names of a metric and its series, which are identified by their label values
+type family struct {
+	name, help, typ string
+	labels          []string
+	mutex           sync.Mutex
+	series          map[string][]string
+}
+
+func newFamily(name, help, typ string, labels []string) family {
+	return family{name: name, help: help, typ: typ, labels: labels, series: make(map[string][]string)}
+}
+
+// id returns the id of the series with the given label values and registers it
+func (f *family) id(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %v needs %v label values, got %v", f.name, len(f.labels), len(values)))
+	}
+	id := strings.Join(values, "\xff")
+	if _, ok := f.series[id]; !ok {
+		f.series[id] = append([]string{}, values...)
+	}
+	return id
+}
+
+// ids returns the ids of all series, sorted
+func (f *family) ids() []string {
+	ids := make([]string, 0, len(f.series))
+	for id := range f.series {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (f *family) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", f.name, f.help, f.name, f.typ)
+	return err
+}
+
+// writeSample writes a sample of the series id, extra is an additional label like le="0.5"
+func (f *family) writeSample(w io.Writer, suffix, id, extra string, value float64) error {
+	pairs := make([]string, 0, len(f.labels)+1)
+	for i, name := range f.labels {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, name, labelEscaper.Replace(f.series[id][i])))
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	labels := ""
+	if len(pairs) > 0 {
+		labels = "{" + strings.Join(pairs, ",") + "}"
+	}
+	_, err := fmt.Fprintf(w, "%v%v%v %v\n", f.name, suffix, labels, formatFloat(value))
+	return err
+}
+
+// labelEscaper escapes label values like the text format expects them
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Counter is a metric which only goes up, like the number of requests
+type Counter struct {
+	family
+	values map[string]float64
+}
+
+// NewCounter registers a counter with the given label names
+func (reg *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{family: newFamily(name, help, "counter", labels), values: make(map[string]float64)}
+	reg.register(c)
+	return c
+}
+
+// Add increases the counter of the series with the given label values
+func (c *Counter) Add(delta float64, values ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[c.id(values)] += delta
+}
+
+func (c *Counter) write(w io.Writer) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.writeHeader(w); err != nil {
+		return err
+	}
+	for _, id := range c.ids() {
+		if err := c.writeSample(w, "", id, "", c.values[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gauge is a metric which goes up and down, like the number of open streams
+type Gauge struct {
+	family
+	values map[string]float64
+}
+
+// NewGauge registers a gauge with the given label names
+func (reg *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{family: newFamily(name, help, "gauge", labels), values: make(map[string]float64)}
+	reg.register(g)
+	return g
+}
+
+// Add changes the gauge of the series with the given label values by delta
+func (g *Gauge) Add(delta float64, values ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[g.id(values)] += delta
+}
+
+func (g *Gauge) write(w io.Writer) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if err := g.writeHeader(w); err != nil {
+		return err
+	}
+	for _, id := range g.ids() {
+		if err := g.writeSample(w, "", id, "", g.values[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gaugeFunc is a gauge whose value is read when the metrics are written
+type gaugeFunc struct {
+	family
+	values []string
+	fn     func() (float64, bool)
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by fn, constLabels are pairs of label names and their values.
+// The gauge is left out if fn returns false.
+func (reg *Registry) NewGaugeFunc(name, help string, fn func() (float64, bool), constLabels ...string) {
+	if len(constLabels)%2 != 0 {
+		panic(fmt.Sprintf("metric %v needs pairs of label names and values", name))
+	}
+	names, values := []string{}, []string{}
+	for i := 0; i < len(constLabels); i += 2 {
+		names = append(names, constLabels[i])
+		values = append(values, constLabels[i+1])
+	}
+	reg.register(&gaugeFunc{newFamily(name, help, "gauge", names), values, fn})
+}
+
+func (g *gaugeFunc) write(w io.Writer) error {
+	value, ok := g.fn()
+	if !ok {
+		return nil
+	}
+	if err := g.writeHeader(w); err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.writeSample(w, "", g.id(g.values), "", value)
+}
+
+// Histogram counts observations, like latencies, in buckets
+type Histogram struct {
+	family
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	// counts holds the number of observations per bucket, the last one is +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers a histogram with the given upper bounds of the buckets and label names
+func (reg *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	h := &Histogram{family: newFamily(name, help, "histogram", labels), buckets: sorted, values: make(map[string]*histogramValue)}
+	reg.register(h)
+	return h
+}
+
+// Observe adds an observation to the series with the given label values
+func (h *Histogram) Observe(value float64, values ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	id := h.id(values)
+	v, ok := h.values[id]
+	if !ok {
+		v = &histogramValue{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[id] = v
+	}
+	v.counts[sort.SearchFloat64s(h.buckets, value)]++
+	v.sum += value
+	v.count++
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := h.writeHeader(w); err != nil {
+		return err
+	}
+	for _, id := range h.ids() {
+		v := h.values[id]
+		cumulative := uint64(0)
+		for i, count := range v.counts {
+			cumulative += count
+			bound := math.Inf(1)
+			if i < len(h.buckets) {
+				bound = h.buckets[i]
+			}
+			if err := h.writeSample(w, "_bucket", id, fmt.Sprintf(`le="%v"`, formatFloat(bound)), float64(cumulative)); err != nil {
+				return err
+			}
+		}
+		if err := h.writeSample(w, "_sum", id, "", v.sum); err != nil {
+			return err
+		}
+		if err := h.writeSample(w, "_count", id, "", float64(v.count)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	requests := reg.NewCounter("requests_total", "Number of requests.", "route", "status")
+	requests.Add(1, "/v1/kv/", "200")
+	requests.Add(2, "/v1/kv/", "200")
+	requests.Add(1, `/a"b`, "404")
+	streams := reg.NewGauge("streams", "Open streams.")
+	streams.Add(2)
+	streams.Add(-1)
+	reg.NewGaugeFunc("size_bytes", "Size.", func() (float64, bool) { return 1024, true }, "backend", "bolt")
+	reg.NewGaugeFunc("missing", "Left out.", func() (float64, bool) { return 0, false })
+	latencies := reg.NewHistogram("duration_seconds", "Durations.", []float64{1, 0.1}, "method")
+	latencies.Observe(0.05, "Get")
+	latencies.Observe(0.5, "Get")
+	latencies.Observe(1, "Get")
+	latencies.Observe(3, "Get")
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, reg.Write(buf))
+	assert.Equal(t, `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{route="/a\"b",status="404"} 1
+requests_total{route="/v1/kv/",status="200"} 3
+# HELP streams Open streams.
+# TYPE streams gauge
+streams 1
+# HELP size_bytes Size.
+# TYPE size_bytes gauge
+size_bytes{backend="bolt"} 1024
+# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{method="Get",le="0.1"} 1
+duration_seconds_bucket{method="Get",le="1"} 3
+duration_seconds_bucket{method="Get",le="+Inf"} 4
+duration_seconds_sum{method="Get"} 4.55
+duration_seconds_count{method="Get"} 4
+`, buf.String())
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/trusch/storaged/storage"
+)
+
+// InstrumentStorage decorates store, so that the latencies of its operations per method and result
+// and the size of its database files are recorded in reg. All of them are labeled with backend,
+// the kind of the store like the scheme of its URI.
+func InstrumentStorage(reg *Registry, store storage.Storage, backend string) *storage.InstrumentedStorage {
+	latencies := reg.NewHistogram("storaged_storage_operation_duration_seconds",
+		"Duration of storage operations, reads of timeranges include the iteration.", DefaultBuckets, "backend", "method", "result")
+	instrumented := storage.NewInstrumentedStorage(store, func(method string, duration time.Duration, err error) {
+		latencies.Observe(duration.Seconds(), backend, method, operationResult(err))
+	})
+	reg.NewGaugeFunc("storaged_storage_size_bytes", "Size of the database files.", func() (float64, bool) {
+		size, ok, err := instrumented.Size()
+		if err != nil {
+			log.Print("failed to read the database size: ", err)
+			return 0, false
+		}
+		return float64(size), ok
+	}, "backend", backend)
+	return instrumented
+}
+
+// operationResult classifies the result of an operation, missing keys are expected and not counted as errors
+func operationResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, storage.ErrNotFound):
+		return "not_found"
+	}
+	return "error"
+}
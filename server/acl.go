@@ -0,0 +1,45 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/trusch/storaged/acl"
+)
+
+// unrestricted is the effective ACL of all requests while auth is disabled
+var unrestricted = acl.ACL{{Pattern: "*", Permissions: []acl.Permission{acl.Read, acl.Write, acl.Delete}}}
+
+// may checks if the ACL of the request token grants perm on resource, everything is allowed while auth is disabled
+func may(r *http.Request, perm acl.Permission, resource string) bool {
+	token := requestToken(r)
+	return token == nil || token.ACL.Allows(token.Name, perm, resource)
+}
+
+// allowed checks if the request may access resource and sends 403 if not
+func (srv *Server) allowed(w http.ResponseWriter, r *http.Request, perm acl.Permission, resource string) bool {
+	if !may(r, perm, resource) {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("'%v' has no %v permission on '%v'", requestToken(r).Name, perm, resource))
+		return false
+	}
+	return true
+}
+
+// jsonWhoami is the wire format of the identity of a request
+type jsonWhoami struct {
+	ID     string  `json:"id,omitempty"`
+	Name   string  `json:"name,omitempty"`
+	Static bool    `json:"static,omitempty"`
+	ACL    acl.ACL `json:"acl"`
+}
+
+// handleWhoami returns the token of the request with its effective ACL, in which <own-id> is replaced with its name
+func (srv *Server) handleWhoami(w http.ResponseWriter, r *http.Request) {
+	res := &jsonWhoami{ACL: unrestricted}
+	if token := requestToken(r); token != nil {
+		res = &jsonWhoami{token.ID, token.Name, token.Static, token.ACL.Effective(token.Name)}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trusch/storaged/acl"
+	"github.com/trusch/storaged/storage"
+)
+
+// tokenPrefix is the reserved kv namespace of the tokens created with the API.
+// Only the SHA-256 hash of a token is stored, under the first 16 hex digits of the hash which are the id of the token.
+const tokenPrefix = storage.ReservedPrefix + "tokens/"
+
+// Token describes an API token, the secret itself is only returned when it is created.
+// Requests with the token may only do what its ACL grants, the name of the token is the identity used in the ACL.
+type Token struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	ACL     acl.ACL   `json:"acl"`
+	// Static tokens are loaded from the token file and can't be revoked with the API
+	Static bool   `json:"static,omitempty"`
+	Hash   string `json:"hash,omitempty"`
+}
+
+// tokenContextKey is the key of the token of a request in its context
+type tokenContextKey struct{}
+
+// requestToken returns the token the request was authenticated with, nil if auth is disabled
+func requestToken(r *http.Request) *Token {
+	token, _ := r.Context().Value(tokenContextKey{}).(*Token)
+	return token
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func tokenID(hash string) string {
+	return hash[:16]
+}
+
+// LoadTokenFile reads static tokens from a file with one token per line in the form "<secret> <name> [<acl rule>...]",
+// like "s3cret sensor-1 ts/sensors/* read kv/devices/<own-id>/* read,write". Tokens without rules may do nothing.
+// Lines of the form "cert:<identity> [<acl rule>...]" specify the ACL of the client certificates with the identity.
+// Empty lines and lines starting with '#' are ignored.
+func LoadTokenFile(path string) ([]*Token, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tokens := make([]*Token, 0)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if strings.HasPrefix(fields[0], certTokenPrefix) {
+			// the identity is the name, so that it is used for <own-id>
+			fields = append([]string{fields[0], fields[0][len(certTokenPrefix):]}, fields[1:]...)
+		}
+		if len(fields) < 2 || len(fields)%2 != 0 || fields[1] == "" {
+			return nil, fmt.Errorf("%v:%v: expected '<secret> <name>' followed by '<pattern> <permissions>' pairs", path, line)
+		}
+		rules := make([]string, 0, len(fields)/2-1)
+		for i := 2; i < len(fields); i += 2 {
+			rules = append(rules, fields[i]+" "+fields[i+1])
+		}
+		tokenACL, err := acl.Parse(rules)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %w", path, line, err)
+		}
+		if strings.HasPrefix(fields[0], certTokenPrefix) {
+			tokens = append(tokens, &Token{ID: fields[0], Name: fields[1], ACL: tokenACL, Static: true})
+			continue
+		}
+		hash := hashToken(fields[0])
+		tokens = append(tokens, &Token{ID: tokenID(hash), Name: fields[1], ACL: tokenACL, Static: true, Hash: hash})
+	}
+	return tokens, scanner.Err()
+}
+
+// auth holds the static tokens, auth is disabled while they are nil
+type auth struct {
+	mutex        sync.RWMutex
+	staticTokens map[string]*Token
+}
+
+// EnableAuth requires a valid bearer token for all requests.
+// Tokens are either one of the static tokens or created with POST /v1/admin/tokens.
+func (srv *Server) EnableAuth(static []*Token) {
+	srv.auth.mutex.Lock()
+	defer srv.auth.mutex.Unlock()
+	srv.auth.staticTokens = make(map[string]*Token, len(static))
+	for _, token := range static {
+		srv.auth.staticTokens[token.ID] = token
+	}
+}
+
+// DisableAuth allows all requests again
+func (srv *Server) DisableAuth() {
+	srv.auth.mutex.Lock()
+	defer srv.auth.mutex.Unlock()
+	srv.auth.staticTokens = nil
+}
+
+func (srv *Server) authEnabled() (map[string]*Token, bool) {
+	srv.auth.mutex.RLock()
+	defer srv.auth.mutex.RUnlock()
+	return srv.auth.staticTokens, srv.auth.staticTokens != nil
+}
+
+// authenticate wraps handler, so that it is only called for requests with a valid bearer token
+// or a verified client certificate if auth is enabled. The bearer token takes precedence over the certificate.
+// The health endpoints are open to everybody.
+func (srv *Server) authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		static, enabled := srv.authEnabled()
+		if !enabled || isProbe(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if identity := certIdentity(r); auth == "" && identity != "" {
+			handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, certToken(static, identity))))
+			return
+		}
+		if !strings.HasPrefix(auth, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="storaged"`)
+			writeError(w, http.StatusUnauthorized, "need a bearer token")
+			return
+		}
+		token, err := srv.lookupToken(r.Context(), static, auth[len("Bearer "):])
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		if token == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="storaged", error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, token)))
+	})
+}
+
+// lookupToken returns the token with the given secret, nil if there is none
+func (srv *Server) lookupToken(ctx context.Context, static map[string]*Token, secret string) (*Token, error) {
+	hash := hashToken(secret)
+	token, ok := static[tokenID(hash)]
+	if !ok {
+		var err error
+		if token, err = srv.getToken(ctx, tokenID(hash)); errors.Is(err, storage.ErrNotFound) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) != 1 {
+		return nil, nil
+	}
+	return token, nil
+}
+
+func (srv *Server) getToken(ctx context.Context, id string) (*Token, error) {
+	bs, err := srv.store.GetContext(ctx, tokenPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	token := &Token{}
+	if err := json.Unmarshal(bs, token); err != nil {
+		return nil, fmt.Errorf("corrupted token '%v': %w", id, err)
+	}
+	return token, nil
+}
+
+// publicToken returns a copy of token without its hash
+func publicToken(token *Token) *Token {
+	res := *token
+	res.Hash = ""
+	return &res
+}
+
+// handleCreateToken creates a token with the 'name' given in the form and returns it together with its secret.
+// Every 'acl' value is a rule of the ACL of the token, like "ts/sensors/* read". The secret can't be retrieved later on.
+// Everybody who may create tokens can grant any permission, so write access to the tokens is effectively full access.
+func (srv *Server) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	if !srv.allowed(w, r, acl.Write, acl.Admin("tokens")) {
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		writeError(w, http.StatusBadRequest, "need a 'name' without whitespace")
+		return
+	}
+	tokenACL, err := acl.Parse(r.Form["acl"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	bs := make([]byte, 32)
+	if _, err := rand.Read(bs); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to generate a token")
+		return
+	}
+	secret := hex.EncodeToString(bs)
+	hash := hashToken(secret)
+	token := &Token{ID: tokenID(hash), Name: name, Created: time.Now().UTC(), ACL: tokenACL, Hash: hash}
+	stored, _ := json.Marshal(token)
+	if err := srv.store.PutContext(r.Context(), tokenPrefix+token.ID, stored); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&struct {
+		*Token
+		Secret string `json:"token"`
+	}{publicToken(token), secret})
+}
+
+// handleListTokens returns all tokens without their secrets
+func (srv *Server) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	if !srv.allowed(w, r, acl.Read, acl.Admin("tokens")) {
+		return
+	}
+	static, _ := srv.authEnabled()
+	tokens := make([]*Token, 0, len(static))
+	for _, token := range static {
+		tokens = append(tokens, publicToken(token))
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	keys, err := srv.store.ListContext(r.Context(), tokenPrefix)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	for _, key := range keys {
+		token, err := srv.getToken(r.Context(), key[len(tokenPrefix):])
+		if errors.Is(err, storage.ErrNotFound) {
+			// revoked in the meantime
+			continue
+		}
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		tokens = append(tokens, publicToken(token))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// handleRevokeToken deletes the token with the id in the path
+func (srv *Server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if !srv.allowed(w, r, acl.Delete, acl.Admin("tokens")) {
+		return
+	}
+	id := r.URL.Path[len("/v1/admin/tokens/"):]
+	static, _ := srv.authEnabled()
+	if _, ok := static[id]; ok {
+		writeError(w, http.StatusBadRequest, "tokens of the token file can't be revoked")
+		return
+	}
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, "unknown token")
+		return
+	}
+	if err := srv.store.DeleteContext(r.Context(), tokenPrefix+id); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/trusch/storaged/acl"
+	"github.com/trusch/storaged/storage"
+)
+
+// jsonSeriesInfo is the wire format of a catalog entry, the last entry has the format of GetRange entries
+type jsonSeriesInfo struct {
+	Key       string                 `json:"key"`
+	First     int64                  `json:"first"`
+	Last      int64                  `json:"last"`
+	Count     int64                  `json:"count"`
+	LastEntry map[string]interface{} `json:"last_entry"`
+}
+
+func toJSONSeriesInfo(info *storage.SeriesInfo) *jsonSeriesInfo {
+	lastEntry, _ := selectFields(info.LastEntry, nil)
+	return &jsonSeriesInfo{
+		Key:       info.Key,
+		First:     info.First.UnixNano(),
+		Last:      info.Last.UnixNano(),
+		Count:     info.Count,
+		LastEntry: lastEntry,
+	}
+}
+
+// catalog returns the series catalog of the storage or sends 501 if it has none
+func (srv *Server) catalog(w http.ResponseWriter) (storage.SeriesCatalog, bool) {
+	catalog, ok := srv.store.(storage.SeriesCatalog)
+	if !ok || !storage.Supports[storage.SeriesCatalog](srv.store) {
+		writeError(w, http.StatusNotImplemented, "the storage doesn't keep a series catalog")
+		return nil, false
+	}
+	return catalog, true
+}
+
+// handleListSeries returns the catalog entries of all timeseries starting with prefix which the request may read
+func (srv *Server) handleListSeries(w http.ResponseWriter, r *http.Request, prefix string) {
+	catalog, ok := srv.catalog(w)
+	if !ok {
+		return
+	}
+	infos, err := catalog.ListSeriesInfo(r.Context(), prefix)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	res := make([]*jsonSeriesInfo, 0, len(infos))
+	for _, info := range infos {
+		if may(r, acl.Read, acl.TS(info.Key)) {
+			res = append(res, toJSONSeriesInfo(info))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// handleSeriesInfo returns the catalog entry of a timeseries, or only its last entry if last is set
+func (srv *Server) handleSeriesInfo(w http.ResponseWriter, r *http.Request, key string, last bool) {
+	catalog, ok := srv.catalog(w)
+	if !ok || !srv.allowed(w, r, acl.Read, acl.TS(key)) {
+		return
+	}
+	info, err := catalog.SeriesInfo(r.Context(), key)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	res := toJSONSeriesInfo(info)
+	w.Header().Set("Content-Type", "application/json")
+	if last {
+		json.NewEncoder(w).Encode(res.LastEntry)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/trusch/storaged/storage"
+)
+
+// jsonError is the body of all error responses
+type jsonError struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// writeError sends an error response, the code is the snake cased status text like "bad_request"
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeErrorWithCode(w, status, strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_"), msg)
+}
+
+func writeErrorWithCode(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&jsonError{msg, code})
+}
+
+// writeStorageError translates an error of the store into the matching status and sends it
+func writeStorageError(w http.ResponseWriter, err error) {
+	status, code := errorStatus(err)
+	if status >= http.StatusInternalServerError {
+		log.Print("storage error: ", err)
+	}
+	writeErrorWithCode(w, status, code, err.Error())
+}
+
+// errorStatus returns the status and error code for an error of the store
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound, "not_found"
+	case errors.Is(err, storage.ErrVersionMismatch):
+		return http.StatusPreconditionFailed, "version_mismatch"
+	case errors.Is(err, storage.ErrDuplicateTimestamp):
+		return http.StatusConflict, "duplicate_timestamp"
+	case errors.Is(err, storage.ErrConflict):
+		return http.StatusConflict, "conflict"
+	case errors.Is(err, storage.ErrInvalidKey):
+		return http.StatusBadRequest, "invalid_key"
+	case errors.Is(err, storage.ErrInvalidArgument):
+		return http.StatusBadRequest, "invalid_argument"
+	case errors.Is(err, storage.ErrBackendUnavailable):
+		return http.StatusServiceUnavailable, "backend_unavailable"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "timeout"
+	case errors.Is(err, context.Canceled):
+		// nobody is listening anymore, the status follows the nginx convention
+		return 499, "canceled"
+	}
+	return http.StatusInternalServerError, "internal"
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/trusch/storaged/storage"
+)
+
+// readyTimeout limits how long the readiness check waits for the storage
+const readyTimeout = 2 * time.Second
+
+// isProbe checks if the request goes to one of the health endpoints, they don't need authentication
+func isProbe(r *http.Request) bool {
+	return r.Method == "GET" && (r.URL.Path == "/healthz" || r.URL.Path == "/readyz")
+}
+
+// handleHealthz reports that the process is alive
+func (srv *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports if the server can serve requests, which needs a working storage.
+// It fails with 503 once the server is shutting down, so that load balancers stop sending requests.
+func (srv *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-srv.stopping:
+		writeError(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	default:
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	if err := storage.Ping(ctx, srv.store); err != nil {
+		log.Print("readiness check failed: ", err)
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
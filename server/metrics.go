@@ -0,0 +1,140 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/trusch/storaged/acl"
+	"github.com/trusch/storaged/metrics"
+)
+
+// httpMetrics are the metrics of the requests to the server
+type httpMetrics struct {
+	reg       *metrics.Registry
+	requests  *metrics.Counter
+	durations *metrics.Histogram
+	bytesIn   *metrics.Counter
+	bytesOut  *metrics.Counter
+	streams   *metrics.Gauge
+}
+
+// EnableMetrics records the metrics of all requests in reg and serves reg at GET /metrics.
+// Use metrics.InstrumentStorage to include the metrics of the storage. It needs to be called before ListenAndServe.
+// If auth is enabled, reading the metrics needs the read permission on admin/metrics.
+func (srv *Server) EnableMetrics(reg *metrics.Registry) {
+	srv.metrics = &httpMetrics{
+		reg:       reg,
+		requests:  reg.NewCounter("storaged_http_requests_total", "Number of requests per route and status.", "method", "route", "status"),
+		durations: reg.NewHistogram("storaged_http_request_duration_seconds", "Duration of requests per route and status, streams last until the client disconnects.", metrics.DefaultBuckets, "method", "route", "status"),
+		bytesIn:   reg.NewCounter("storaged_http_request_bytes_total", "Size of the request bodies per route.", "method", "route"),
+		bytesOut:  reg.NewCounter("storaged_http_response_bytes_total", "Size of the response bodies per route.", "method", "route"),
+		streams:   reg.NewGauge("storaged_getrange_streams_in_flight", "Number of GetRange responses which are currently streamed."),
+	}
+}
+
+// instrument wraps handler, so that the metrics of all requests are recorded if they are enabled.
+// Requests are grouped by the path template of the matching route of router, like "/v1/kv/".
+func (srv *Server) instrument(router *mux.Router, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := srv.metrics
+		if m == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		route := "other"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		cw := &countingWriter{ResponseWriter: w}
+		handler.ServeHTTP(cw, r)
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		status := strconv.Itoa(cw.status)
+		method := methodLabel(r.Method)
+		m.requests.Add(1, method, route, status)
+		m.durations.Observe(time.Since(start).Seconds(), method, route, status)
+		m.bytesIn.Add(float64(body.bytes), method, route)
+		m.bytesOut.Add(float64(cw.bytes), method, route)
+	})
+}
+
+// methodLabel limits the methods used as label to the ones of the API, clients can send any method
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete, http.MethodHead:
+		return method
+	}
+	return "other"
+}
+
+// trackStream counts a GetRange response as in flight until the returned function is called
+func (srv *Server) trackStream() func() {
+	if srv.metrics == nil {
+		return func() {}
+	}
+	srv.metrics.streams.Add(1)
+	return func() { srv.metrics.streams.Add(-1) }
+}
+
+// handleMetrics writes the metrics in the Prometheus text format
+func (srv *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !srv.allowed(w, r, acl.Read, acl.Admin("metrics")) {
+		return
+	}
+	if srv.metrics == nil {
+		writeError(w, http.StatusNotFound, "metrics are not enabled")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	srv.metrics.reg.Write(w)
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (r *countingReader) Read(bs []byte) (int, error) {
+	n, err := r.ReadCloser.Read(bs)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// countingWriter records the status and counts the bytes of a response
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(bs []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(bs)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap gives http.ResponseController access to the flushing and deadlines of the wrapped writer
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trusch/storaged/acl"
+	"github.com/trusch/storaged/storage"
+)
+
+// jsonSeries is the wire format of a timeseries matched by labels or of a group of them
+type jsonSeries struct {
+	Key    string         `json:"key,omitempty"`
+	Keys   []string       `json:"keys,omitempty"`
+	Labels storage.Labels `json:"labels"`
+}
+
+// labeler returns the label index of the storage or sends 501 if it has none
+func (srv *Server) labeler(w http.ResponseWriter) (storage.Labeler, bool) {
+	labeler, ok := srv.store.(storage.Labeler)
+	if !ok || !storage.Supports[storage.Labeler](srv.store) {
+		writeError(w, http.StatusNotImplemented, "the storage doesn't support labels")
+		return nil, false
+	}
+	return labeler, true
+}
+
+// handleGetLabels returns the labels of a timeseries as JSON object
+func (srv *Server) handleGetLabels(w http.ResponseWriter, r *http.Request) {
+	labeler, ok := srv.labeler(w)
+	if !ok || !srv.allowed(w, r, acl.Read, acl.TS(r.URL.Path[11:])) {
+		return
+	}
+	labels, err := labeler.Labels(r.Context(), r.URL.Path[11:])
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(labels)
+}
+
+// handleSetLabels replaces the labels of a timeseries with the labels in the body,
+// which is either a JSON object or of the form "host=a,region=eu"
+func (srv *Server) handleSetLabels(w http.ResponseWriter, r *http.Request) {
+	labeler, ok := srv.labeler(w)
+	if !ok || !srv.allowed(w, r, acl.Write, acl.TS(r.URL.Path[11:])) {
+		return
+	}
+	bs, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read the body")
+		return
+	}
+	var labels storage.Labels
+	if mediaType(r) == "application/json" {
+		if err := json.Unmarshal(bs, &labels); err != nil {
+			writeError(w, http.StatusBadRequest, "the body needs to be a JSON object of strings")
+			return
+		}
+	} else if labels, err = storage.ParseLabels(string(bs)); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if err := labeler.SetLabels(r.Context(), r.URL.Path[11:], labels); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+}
+
+// handleDeleteLabels removes all labels of a timeseries
+func (srv *Server) handleDeleteLabels(w http.ResponseWriter, r *http.Request) {
+	labeler, ok := srv.labeler(w)
+	if !ok || !srv.allowed(w, r, acl.Write, acl.TS(r.URL.Path[11:])) {
+		return
+	}
+	if err := labeler.SetLabels(r.Context(), r.URL.Path[11:], nil); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+}
+
+// handleSeries returns the timeseries matching the label matchers in 'match' (like region=eu,host!=a) with their labels.
+// Timeseries the request may not read are left out.
+// If 'from', 'to' or 'step' is given, the entries of the timerange are included in "values", aggregated per 'step' with 'agg'.
+// 'group_by' is a comma separated list of label names, the matching timeseries are grouped by the values of these labels
+// and the values of every group are aggregated like a single timeseries, so 'step' is needed.
+func (srv *Server) handleSeries(w http.ResponseWriter, r *http.Request) {
+	labeler, ok := srv.labeler(w)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	matchers, err := storage.ParseLabelMatchers(query.Get("match"))
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	var (
+		step    time.Duration
+		agg     storage.Aggregation
+		groupBy []string
+	)
+	if str := query.Get("step"); str != "" {
+		if step, err = time.ParseDuration(str); err != nil || step <= 0 {
+			writeError(w, http.StatusBadRequest, "'step' needs to be a positive duration")
+			return
+		}
+		aggStr := query.Get("agg")
+		if aggStr == "" {
+			aggStr = string(storage.AggAvg)
+		}
+		if agg, err = storage.ParseAggregation(aggStr); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if str := query.Get("group_by"); str != "" {
+		if step == 0 {
+			writeError(w, http.StatusBadRequest, "'group_by' needs 'step'")
+			return
+		}
+		groupBy = strings.Split(str, ",")
+	}
+	ctx := r.Context()
+	all, err := labeler.MatchSeries(ctx, matchers)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	matched := make([]*storage.LabeledSeries, 0, len(all))
+	for _, s := range all {
+		if may(r, acl.Read, acl.TS(s.Key)) {
+			matched = append(matched, s)
+		}
+	}
+	series := make([]*jsonSeries, len(matched))
+	for i, s := range matched {
+		series[i] = &jsonSeries{Key: s.Key, Labels: s.Labels}
+	}
+	if groupBy != nil {
+		series = groupSeries(matched, groupBy)
+	}
+	if step == 0 && query.Get("from") == "" && query.Get("to") == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(series)
+		return
+	}
+	f, _ := strconv.ParseInt(query.Get("from"), 10, 64)
+	t, _ := strconv.ParseInt(query.Get("to"), 10, 64)
+	if t == 0 {
+		t = time.Now().UnixNano()
+	}
+	from, to := time.Unix(0, f), time.Unix(0, t)
+	writeSeries(w, series, func(s *jsonSeries) (storage.Iterator, error) {
+		switch {
+		case s.Keys != nil:
+			return storage.AggregateSeries(ctx, srv.store, s.Keys, from, to, step, agg)
+		case step != 0:
+			return srv.store.AggregateContext(ctx, s.Key, from, to, step, agg)
+		}
+		return srv.store.GetRangeContext(ctx, s.Key, from, to)
+	})
+}
+
+// groupSeries groups the timeseries by the values of the labels in groupBy, the groups are sorted by their labels.
+// Labels missing in a timeseries are missing in the labels of its group.
+func groupSeries(matched []*storage.LabeledSeries, groupBy []string) []*jsonSeries {
+	groups := make(map[string]*jsonSeries)
+	for _, s := range matched {
+		labels := make(storage.Labels)
+		for _, name := range groupBy {
+			if value, ok := s.Labels[name]; ok {
+				labels[name] = value
+			}
+		}
+		id := labels.String()
+		if groups[id] == nil {
+			groups[id] = &jsonSeries{Keys: []string{}, Labels: labels}
+		}
+		groups[id].Keys = append(groups[id].Keys, s.Key)
+	}
+	ids := make([]string, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	res := make([]*jsonSeries, len(ids))
+	for i, id := range ids {
+		res[i] = groups[id]
+	}
+	return res
+}
+
+// writeSeries streams the timeseries with their entries in "values" as JSON array.
+// The entries of every timeseries are read with open, one timeseries after the other.
+// If the first timeseries can't be opened the error is sent as response, later errors are handled
+// like in writeEntries: they are sent in the X-Error trailer and the array is left unterminated.
+func writeSeries(w http.ResponseWriter, series []*jsonSeries, open func(s *jsonSeries) (storage.Iterator, error)) {
+	for i, s := range series {
+		it, err := open(s)
+		if err != nil {
+			if i == 0 {
+				writeStorageError(w, err)
+				return
+			}
+			w.Header().Set("X-Error", err.Error())
+			return
+		}
+		if i == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Trailer", "X-Error")
+			w.Write([]byte("["))
+		} else {
+			w.Write([]byte{','})
+		}
+		ok := writeSeriesValues(w, s, it)
+		it.Close()
+		if !ok {
+			return
+		}
+	}
+	if len(series) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("["))
+	}
+	w.Write([]byte("]"))
+}
+
+// writeSeriesValues writes a timeseries with the entries of it as JSON object, it reports if the response can be continued
+func writeSeriesValues(w http.ResponseWriter, s *jsonSeries, it storage.Iterator) bool {
+	bs, err := json.Marshal(s)
+	if err != nil {
+		log.Print(err)
+		w.Header().Set("X-Error", err.Error())
+		return false
+	}
+	// reopen the object to append the values
+	w.Write(bs[:len(bs)-1])
+	w.Write([]byte(`,"values":[`))
+	written := 0
+	for it.Next() {
+		out, _ := selectFields(it.Entry(), nil)
+		if bs, err = json.Marshal(out); err != nil {
+			log.Print(err)
+			continue
+		}
+		if written > 0 {
+			w.Write([]byte{','})
+		}
+		written++
+		if _, err := w.Write(bs); err != nil {
+			// the client is gone
+			return false
+		}
+	}
+	if err := it.Err(); err != nil {
+		if !errors.Is(err, context.Canceled) {
+			log.Print("failed to stream series: ", err)
+		}
+		w.Header().Set("X-Error", err.Error())
+		return false
+	}
+	w.Write([]byte("]}"))
+	return true
+}
@@ -1,23 +1,101 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/trusch/storaged/acl"
 	"github.com/trusch/storaged/storage"
 )
 
 // Server represents the storaged webserver
 type Server struct {
-	store  storage.Storage
-	ln     net.Listener
-	server *http.Server
+	store   storage.Storage
+	ln      net.Listener
+	server  *http.Server
+	janitor *storage.Janitor
+	roller  *storage.Roller
+	auth    auth
+	tls     *tlsFiles
+	metrics *httpMetrics
+	// stopping is closed when the server shuts down, it ends the event streams
+	stopping chan struct{}
+	stopOnce sync.Once
+	// shutdownTimeout is how long Stop waits for in-flight requests
+	shutdownTimeout time.Duration
+}
+
+// DefaultShutdownTimeout is how long Stop waits for in-flight requests unless SetShutdownTimeout is called
+const DefaultShutdownTimeout = 30 * time.Second
+
+const defaultListLimit = 1000
+
+type listResponse struct {
+	Keys   []string `json:"keys"`
+	Cursor string   `json:"cursor,omitempty"`
+}
+
+// jsonEntry is the wire format of a timeseries entry, the fields besides the default field "value" are in "fields"
+type jsonEntry struct {
+	Timestamp *int64             `json:"timestamp"`
+	Value     float64            `json:"value"`
+	Fields    map[string]float64 `json:"fields,omitempty"`
+}
+
+func (e *jsonEntry) toEntry() *storage.TimeSeriesEntry {
+	stamp := time.Now()
+	if e.Timestamp != nil {
+		stamp = time.Unix(0, *e.Timestamp)
+	}
+	return &storage.TimeSeriesEntry{Value: e.Value, Timestamp: stamp, Fields: e.Fields}
+}
+
+// jsonTxnOp is the wire format of a transaction operation.
+// The value of put operations is either a JSON string which is stored as is or any other JSON document which is stored encoded,
+// the value of add operations is a number.
+type jsonTxnOp struct {
+	Op        storage.TxnOpType  `json:"op"`
+	Key       string             `json:"key"`
+	Value     json.RawMessage    `json:"value"`
+	Fields    map[string]float64 `json:"fields"`
+	Timestamp int64              `json:"timestamp"`
+	Version   uint64             `json:"version"`
+}
+
+func (op *jsonTxnOp) toTxnOp() (*storage.TxnOp, error) {
+	res := &storage.TxnOp{Type: op.Op, Key: op.Key, Version: op.Version}
+	switch op.Op {
+	case storage.TxnPut:
+		var str string
+		if err := json.Unmarshal(op.Value, &str); err == nil {
+			res.Value = []byte(str)
+		} else {
+			res.Value = []byte(op.Value)
+		}
+	case storage.TxnAddValue:
+		var val float64
+		if err := json.Unmarshal(op.Value, &val); err != nil {
+			return nil, errors.New("'value' of add operations needs to be a number")
+		}
+		res.Entry = &storage.TimeSeriesEntry{Value: val, Fields: op.Fields}
+		if op.Timestamp != 0 {
+			res.Entry.Timestamp = time.Unix(0, op.Timestamp)
+		}
+	}
+	return res, nil
 }
 
 // New creates a new webserver
@@ -29,28 +107,61 @@ func New(addr string, store storage.Storage) *Server {
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
-	server := &Server{store, nil, srv}
+	server := &Server{store: store, server: srv, stopping: make(chan struct{}), shutdownTimeout: DefaultShutdownTimeout}
 	server.constructRouter()
 	return server
 }
 
-// ListenAndServe starts the webserver
+// ListenAndServe starts the webserver, it serves HTTPS if TLS is enabled.
+// It returns http.ErrServerClosed once the server is shut down.
 func (srv *Server) ListenAndServe() error {
 	ln, err := net.Listen("tcp", srv.server.Addr)
 	if err != nil {
 		return err
 	}
+	if config := srv.tlsConfig(); config != nil {
+		ln = tls.NewListener(ln, config)
+	}
 	srv.ln = ln
 	return srv.server.Serve(ln)
 }
 
-// Stop stops the webserver
-func (srv *Server) Stop() error {
-	err := srv.ln.Close()
+// SetJanitor enables the retention admin endpoints for the given janitor
+func (srv *Server) SetJanitor(janitor *storage.Janitor) {
+	srv.janitor = janitor
+}
+
+// SetRoller makes GetRange requests with 'n' use the rollups maintained by roller
+func (srv *Server) SetRoller(roller *storage.Roller) {
+	srv.roller = roller
+}
+
+// SetShutdownTimeout sets how long Stop waits for the in-flight requests before their connections are closed
+func (srv *Server) SetShutdownTimeout(timeout time.Duration) {
+	srv.shutdownTimeout = timeout
+}
+
+// Shutdown stops the webserver gracefully. It stops accepting connections, ends the event streams and waits until
+// the in-flight requests are done or ctx is done, in which case the remaining connections are closed.
+// The store is closed afterwards, so that no request uses it anymore.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.stopOnce.Do(func() { close(srv.stopping) })
+	err := srv.server.Shutdown(ctx)
 	if err != nil {
-		return err
+		log.Print("failed to drain the connections: ", err)
+		srv.server.Close()
+	}
+	if closeErr := srv.store.Close(); closeErr != nil {
+		return closeErr
 	}
-	return srv.store.Close()
+	return err
+}
+
+// Stop stops the webserver like Shutdown, waiting up to the shutdown timeout for the in-flight requests
+func (srv *Server) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), srv.shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
 }
 
 func (srv *Server) constructRouter() {
@@ -65,84 +176,325 @@ func (srv *Server) constructRouter() {
 		srv.handleDelete(w, r)
 	})
 	router.PathPrefix("/v1/ts/").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		srv.handleAddValue(w, r)
+		if !isReserved(w, r.URL.Path[7:]) {
+			srv.handleAddValue(w, r)
+		}
+	})
+	// keys of timeseries can't end with storage.LastSuffix, so the route doesn't hide a timeseries
+	router.Path("/v1/ts/{key:.+}/last").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := strings.TrimSuffix(r.URL.Path[7:], storage.LastSuffix); !isReserved(w, key) {
+			srv.handleSeriesInfo(w, r, key, true)
+		}
 	})
 	router.PathPrefix("/v1/ts/").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		srv.handleGetRange(w, r)
+		if !isReserved(w, r.URL.Path[7:]) {
+			srv.handleGetRange(w, r)
+		}
 	})
 	router.PathPrefix("/v1/ts/").Methods("DELETE").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		srv.handleDeleteRange(w, r)
+		if !isReserved(w, r.URL.Path[7:]) {
+			srv.handleDeleteRange(w, r)
+		}
+	})
+	router.PathPrefix("/v1/watch/").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleWatch(w, r)
+	})
+	router.PathPrefix("/v1/labels/").Methods("PUT").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReserved(w, r.URL.Path[11:]) {
+			srv.handleSetLabels(w, r)
+		}
+	})
+	router.PathPrefix("/v1/labels/").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReserved(w, r.URL.Path[11:]) {
+			srv.handleGetLabels(w, r)
+		}
+	})
+	router.PathPrefix("/v1/labels/").Methods("DELETE").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReserved(w, r.URL.Path[11:]) {
+			srv.handleDeleteLabels(w, r)
+		}
+	})
+	router.Path("/v1/series").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleSeries(w, r)
+	})
+	router.Path("/v1/txn").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleTxn(w, r)
+	})
+	router.Path("/v1/admin/retention").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleGetRetention(w, r)
+	})
+	router.Path("/v1/admin/retention").Methods("PUT").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleSetRetention(w, r)
+	})
+	router.Path("/v1/admin/retention/run").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleRunRetention(w, r)
 	})
-	srv.server.Handler = router
+	router.Path("/v1/admin/duplicates").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleGetDuplicates(w, r)
+	})
+	router.Path("/v1/admin/duplicates").Methods("PUT").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleSetDuplicates(w, r)
+	})
+	router.Path("/v1/admin/tokens").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleListTokens(w, r)
+	})
+	router.Path("/v1/admin/tokens").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleCreateToken(w, r)
+	})
+	router.PathPrefix("/v1/admin/tokens/").Methods("DELETE").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleRevokeToken(w, r)
+	})
+	router.Path("/v1/whoami").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleWhoami(w, r)
+	})
+	router.Path("/metrics").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleMetrics(w, r)
+	})
+	router.Path("/healthz").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleHealthz(w, r)
+	})
+	router.Path("/readyz").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleReadyz(w, r)
+	})
+	srv.server.Handler = srv.instrument(router, srv.authenticate(router))
 }
 
 func (srv *Server) handlePut(w http.ResponseWriter, r *http.Request) {
 	bs, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Print("failed put: ", r.URL.Path)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "failed to read the body")
 		return
 	}
 	key := r.URL.Path[7:]
-	err = srv.store.Put(key, bs)
+	if isReserved(w, key) || !srv.allowed(w, r, acl.Write, acl.KV(key)) {
+		return
+	}
+	ttl, err := parseTTL(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	expectedVersion, conditional, err := parsePrecondition(r)
 	if err != nil {
-		log.Print("failed put: ", r.URL.Path)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch {
+	case conditional && ttl > 0:
+		writeError(w, http.StatusBadRequest, "conditional puts can't have a ttl")
+		return
+	case conditional:
+		var version uint64
+		version, err = srv.store.CompareAndSwap(key, expectedVersion, bs)
+		if err == nil {
+			w.Header().Set("ETag", formatETag(version))
+		}
+	case ttl > 0:
+		err = srv.store.PutWithTTL(key, bs, ttl)
+	default:
+		err = srv.store.Put(key, bs)
+	}
+	if err != nil {
+		writeStorageError(w, err)
 		return
 	}
 }
 
 func (srv *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("list") == "true" {
+		srv.handleList(w, r)
+		return
+	}
 	key := r.URL.Path[7:]
-	bs, err := srv.store.Get(key)
+	if isReserved(w, key) || !srv.allowed(w, r, acl.Read, acl.KV(key)) {
+		return
+	}
+	bs, version, err := srv.store.GetVersioned(key)
 	if err != nil {
-		log.Print("failed get: ", r.URL.Path)
-		w.WriteHeader(http.StatusNotFound)
+		writeStorageError(w, err)
 		return
 	}
+	if version != 0 {
+		w.Header().Set("ETag", formatETag(version))
+	}
 	w.Write(bs)
 }
 
+// handleList returns the keys starting with the requested prefix which the request may read.
+// Results are paginated: if there are more than 'limit' keys, the response contains a cursor
+// which can be passed as 'cursor' option to fetch the next page.
+func (srv *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Path[7:]
+	limit := defaultListLimit
+	if l := r.FormValue("limit"); l != "" {
+		val, err := strconv.Atoi(l)
+		if err != nil || val <= 0 {
+			writeError(w, http.StatusBadRequest, "'limit' needs to be a positive integer")
+			return
+		}
+		limit = val
+	}
+	start := prefix
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		if !strings.HasPrefix(cursor, prefix) {
+			writeError(w, http.StatusBadRequest, "'cursor' doesn't match the prefix")
+			return
+		}
+		start = cursor + "\x00"
+	}
+	keys, err := srv.store.Scan(start, storage.PrefixEnd(prefix), limit+1)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	res := &listResponse{Keys: keys}
+	if len(keys) > limit {
+		res.Keys = keys[:limit]
+		res.Cursor = keys[limit-1]
+	}
+	visible := make([]string, 0, len(res.Keys))
+	for _, key := range res.Keys {
+		if !storage.IsReserved(key) && may(r, acl.Read, acl.KV(key)) {
+			visible = append(visible, key)
+		}
+	}
+	res.Keys = visible
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
 func (srv *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Path[7:]
-	err := srv.store.Delete(key)
+	if isReserved(w, key) || !srv.allowed(w, r, acl.Delete, acl.KV(key)) {
+		return
+	}
+	expectedVersion, conditional, err := parsePrecondition(r)
+	if err != nil || conditional && expectedVersion == 0 {
+		writeError(w, http.StatusBadRequest, "conditional deletes need an If-Match header")
+		return
+	}
+	if conditional {
+		err = srv.store.CompareAndDelete(key, expectedVersion)
+	} else {
+		err = srv.store.Delete(key)
+	}
 	if err != nil {
-		log.Print("failed delete: ", r.URL.Path)
-		w.WriteHeader(http.StatusNotFound)
+		writeStorageError(w, err)
 		return
 	}
 }
 
 func (srv *Server) handleAddValue(w http.ResponseWriter, r *http.Request) {
-	floatStr := r.FormValue("value")
+	key := r.URL.Path[7:]
+	if !srv.allowed(w, r, acl.Write, acl.TS(key)) {
+		return
+	}
+	switch mediaType(r) {
+	case "application/json", "application/x-ndjson":
+		srv.handleAddValues(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "failed to parse the form")
+		return
+	}
+	// 'value' may also be given in the query, like before fields existed
+	floatStr := r.FormValue(storage.DefaultField)
 	if floatStr == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("need 'value'"))
+		writeError(w, http.StatusBadRequest, "need 'value'")
 		return
 	}
 	val, err := strconv.ParseFloat(floatStr, 64)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("'value' needs to be a float"))
+		writeError(w, http.StatusBadRequest, "'value' needs to be a float")
+		return
+	}
+	// every other value of the posted form is an additional field of the new point
+	entry := &storage.TimeSeriesEntry{Value: val, Timestamp: time.Now()}
+	for name, values := range r.PostForm {
+		if name == storage.DefaultField {
+			continue
+		}
+		val, err := strconv.ParseFloat(values[0], 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("'%v' needs to be a float", name))
+			return
+		}
+		if entry.Fields == nil {
+			entry.Fields = make(map[string]float64)
+		}
+		entry.Fields[name] = val
+	}
+	err = srv.store.AddValues(key, []*storage.TimeSeriesEntry{entry})
+	if err != nil {
+		writeStorageError(w, err)
 		return
 	}
+	srv.writeDuplicatePolicy(w, key)
+}
+
+// handleAddValues saves a batch of entries with explicit timestamps.
+// The body is either a JSON array or newline delimited JSON objects of the form {"timestamp": <nanos>, "value": <float>, "fields": {<name>: <float>}}
+func (srv *Server) handleAddValues(w http.ResponseWriter, r *http.Request) {
+	entries := make([]*storage.TimeSeriesEntry, 0)
+	decoder := json.NewDecoder(r.Body)
+	if mediaType(r) == "application/json" {
+		points := make([]*jsonEntry, 0)
+		if err := decoder.Decode(&points); err != nil {
+			writeError(w, http.StatusBadRequest, "body needs to be a JSON array of entries")
+			return
+		}
+		for _, p := range points {
+			entries = append(entries, p.toEntry())
+		}
+	} else {
+		for decoder.More() {
+			p := &jsonEntry{}
+			if err := decoder.Decode(p); err != nil {
+				writeError(w, http.StatusBadRequest, "body needs to be newline delimited JSON entries")
+				return
+			}
+			entries = append(entries, p.toEntry())
+		}
+	}
 	key := r.URL.Path[7:]
-	err = srv.store.AddValue(key, val)
+	err := srv.store.AddValues(key, entries)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeStorageError(w, err)
 		return
 	}
+	srv.writeDuplicatePolicy(w, key)
+}
+
+// writeDuplicatePolicy tells the client in the X-Duplicate-Policy header how values at already used timestamps of key were handled
+func (srv *Server) writeDuplicatePolicy(w http.ResponseWriter, key string) {
+	policy := storage.DuplicatePolicyFor(srv.store.DuplicateRules(), key)
+	w.Header().Set("X-Duplicate-Policy", string(policy))
 }
 
 func (srv *Server) handleGetRange(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("follow") == "true" {
+		srv.handleFollow(w, r)
+		return
+	}
 	key := r.URL.Path[7:]
+	switch {
+	case r.FormValue("list") == "true":
+		srv.handleListSeries(w, r, key)
+		return
+	case r.FormValue("meta") == "true":
+		srv.handleSeriesInfo(w, r, key, false)
+		return
+	}
+	if !srv.allowed(w, r, acl.Read, acl.TS(key)) {
+		return
+	}
 	n := r.FormValue("n")
 	var desiredPoints int64
 	if n != "" {
 		dp, e := strconv.ParseInt(n, 10, 64)
 		if e != nil {
-			log.Print("malformed N option")
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "'n' needs to be an integer")
 			return
 		}
 		desiredPoints = dp
@@ -154,38 +506,108 @@ func (srv *Server) handleGetRange(w http.ResponseWriter, r *http.Request) {
 	}
 	from := time.Unix(0, f)
 	to := time.Unix(0, t)
-	ch, err := srv.store.GetRange(key, from, to)
-	if err != nil || ch == nil {
-		log.Print("fail...")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	var fields []string
+	if str := r.FormValue("fields"); str != "" {
+		fields = strings.Split(str, ",")
 	}
-	if desiredPoints > 0 {
-		ch = reduceStream(ch, from, to, desiredPoints)
+	aggStr := r.FormValue("agg")
+	if aggStr == "" {
+		aggStr = string(storage.AggAvg)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte("["))
-	first := true
-	for pair := range ch {
-		if bs, err := json.Marshal(map[string]interface{}{
-			"timestamp": pair.Timestamp.UnixNano(),
-			"value":     pair.Value,
-		}); err == nil {
-			if first {
-				first = false
-			} else {
-				w.Write([]byte{','})
-			}
-			w.Write(bs)
+	agg, e := storage.ParseAggregation(aggStr)
+	if e != nil {
+		writeError(w, http.StatusBadRequest, e.Error())
+		return
+	}
+	ctx := r.Context()
+	var it storage.Iterator
+	var err error
+	if stepStr := r.FormValue("step"); stepStr != "" {
+		if fields != nil {
+			writeError(w, http.StatusBadRequest, "'fields' can't be combined with 'step', only 'value' is aggregated")
+			return
+		}
+		step, e := time.ParseDuration(stepStr)
+		if e != nil || step <= 0 {
+			writeError(w, http.StatusBadRequest, "'step' needs to be a positive duration")
+			return
+		}
+		it, err = srv.store.AggregateContext(ctx, key, from, to, step, agg)
+	} else {
+		// the rollups only contain the default field, 'agg' selects which of them is read
+		if desiredPoints > 0 && srv.roller != nil && fields == nil {
+			it, err = srv.roller.GetRangeContext(ctx, key, from, to, desiredPoints, agg)
 		} else {
+			it, err = srv.store.GetRangeContext(ctx, key, from, to)
+		}
+		if err == nil && desiredPoints > 0 {
+			it = reduceIterator(it, from, to, desiredPoints)
+		}
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	defer it.Close()
+	done := srv.trackStream()
+	defer done()
+	writeEntries(w, it, fields)
+}
+
+// writeEntries streams the entries of it as JSON array.
+// If fields are given, only these fields are written and entries without any of them are skipped.
+// An error before the first entry is sent as error response. Later errors can't change the status anymore,
+// so they are sent in the X-Error trailer and the array is left unterminated.
+func writeEntries(w http.ResponseWriter, it storage.Iterator, fields []string) {
+	started := false
+	start := func() {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Trailer", "X-Error")
+		w.Write([]byte("["))
+		started = true
+	}
+	for it.Next() {
+		out, ok := selectFields(it.Entry(), fields)
+		if !ok {
+			continue
+		}
+		bs, err := json.Marshal(out)
+		if err != nil {
 			log.Print(err)
+			continue
+		}
+		if !started {
+			start()
+		} else {
+			w.Write([]byte{','})
+		}
+		if _, err := w.Write(bs); err != nil {
+			// the client is gone
+			return
+		}
+	}
+	if err := it.Err(); err != nil {
+		if !started {
+			writeStorageError(w, err)
+			return
 		}
+		if !errors.Is(err, context.Canceled) {
+			log.Print("failed to stream entries: ", err)
+		}
+		w.Header().Set("X-Error", err.Error())
+		return
+	}
+	if !started {
+		start()
 	}
 	w.Write([]byte("]"))
 }
 
 func (srv *Server) handleDeleteRange(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Path[7:]
+	if !srv.allowed(w, r, acl.Delete, acl.TS(key)) {
+		return
+	}
 	f, _ := strconv.ParseInt(r.FormValue("from"), 10, 64)
 	t, _ := strconv.ParseInt(r.FormValue("to"), 10, 64)
 	if t == 0 {
@@ -195,24 +617,258 @@ func (srv *Server) handleDeleteRange(w http.ResponseWriter, r *http.Request) {
 	to := time.Unix(0, t)
 	err := srv.store.DeleteRange(key, from, to)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
+		writeStorageError(w, err)
 		return
 	}
 }
 
-func reduceStream(input chan *storage.TimeSeriesEntry, from, to time.Time, desiredPoints int64) chan *storage.TimeSeriesEntry {
-	output := make(chan *storage.TimeSeriesEntry, 64)
-	timeSpan := to.Sub(from)
-	interval := int64(timeSpan.Nanoseconds()) / desiredPoints
-	lastPoint := time.Time{}
-	go func() {
-		for pair := range input {
-			if int64(pair.Timestamp.Sub(lastPoint).Nanoseconds()) >= interval {
-				lastPoint = pair.Timestamp
-				output <- pair
-			}
+// handleTxn commits a JSON list of operations atomically.
+// The request needs the permission of every operation, guards need read permission on their key.
+func (srv *Server) handleTxn(w http.ResponseWriter, r *http.Request) {
+	ops := make([]*jsonTxnOp, 0)
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		writeError(w, http.StatusBadRequest, "body needs to be a JSON array of operations")
+		return
+	}
+	txn := storage.NewTxn()
+	for _, op := range ops {
+		txnOp, err := op.toTxnOp()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if isReserved(w, txnOp.Key) {
+			return
+		}
+		if perm, resource := txnPermission(txnOp); !srv.allowed(w, r, perm, resource) {
+			return
+		}
+		txn.Ops = append(txn.Ops, txnOp)
+	}
+	if err := srv.store.Commit(txn); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+}
+
+// handleGetRetention returns the retention rules, one per line
+func (srv *Server) handleGetRetention(w http.ResponseWriter, r *http.Request) {
+	if !srv.allowed(w, r, acl.Read, acl.Admin("retention")) {
+		return
+	}
+	if srv.janitor == nil {
+		writeError(w, http.StatusNotFound, "retention is not enabled")
+		return
+	}
+	for _, rule := range srv.janitor.Rules() {
+		w.Write([]byte(rule.String() + "\n"))
+	}
+}
+
+// handleSetRetention replaces the retention rules with the rules in the body, one per line
+func (srv *Server) handleSetRetention(w http.ResponseWriter, r *http.Request) {
+	if !srv.allowed(w, r, acl.Write, acl.Admin("retention")) {
+		return
+	}
+	if srv.janitor == nil {
+		writeError(w, http.StatusNotFound, "retention is not enabled")
+		return
+	}
+	bs, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read the body")
+		return
+	}
+	rules := make([]*storage.RetentionRule, 0)
+	for _, line := range strings.Split(string(bs), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rule, err := storage.ParseRetentionRule(line)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
 		}
-		close(output)
-	}()
-	return output
+		rules = append(rules, rule)
+	}
+	srv.janitor.SetRules(rules)
+}
+
+// handleRunRetention applies the retention rules immediately and returns the number of removed values per key.
+// With dry-run=true nothing is deleted.
+func (srv *Server) handleRunRetention(w http.ResponseWriter, r *http.Request) {
+	if !srv.allowed(w, r, acl.Write, acl.Admin("retention")) {
+		return
+	}
+	if srv.janitor == nil {
+		writeError(w, http.StatusNotFound, "retention is not enabled")
+		return
+	}
+	removed, err := srv.janitor.Run(r.FormValue("dry-run") == "true")
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(removed)
+}
+
+// handleGetDuplicates returns the duplicate rules, one per line
+func (srv *Server) handleGetDuplicates(w http.ResponseWriter, r *http.Request) {
+	if !srv.allowed(w, r, acl.Read, acl.Admin("duplicates")) {
+		return
+	}
+	for _, rule := range srv.store.DuplicateRules() {
+		w.Write([]byte(rule.String() + "\n"))
+	}
+}
+
+// handleSetDuplicates replaces the duplicate rules with the rules in the body, one per line
+func (srv *Server) handleSetDuplicates(w http.ResponseWriter, r *http.Request) {
+	if !srv.allowed(w, r, acl.Write, acl.Admin("duplicates")) {
+		return
+	}
+	bs, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read the body")
+		return
+	}
+	rules := make([]*storage.DuplicateRule, 0)
+	for _, line := range strings.Split(string(bs), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rule, err := storage.ParseDuplicateRule(line)
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		rules = append(rules, rule)
+	}
+	srv.store.SetDuplicateRules(rules)
+}
+
+// parseTTL reads the time-to-live of a put request from the X-TTL header or the ttl option.
+// The ttl is either a number of seconds or a duration like 1h30m, zero means no ttl.
+func parseTTL(r *http.Request) (time.Duration, error) {
+	str := r.Header.Get("X-TTL")
+	if str == "" {
+		str = r.URL.Query().Get("ttl")
+	}
+	if str == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.ParseInt(str, 10, 64); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second, nil
+	}
+	if ttl, err := time.ParseDuration(str); err == nil && ttl > 0 {
+		return ttl, nil
+	}
+	return 0, errors.New("ttl needs to be a positive number of seconds or a duration")
+}
+
+// formatETag formats a version as strong entity tag
+func formatETag(version uint64) string {
+	return fmt.Sprintf(`"%v"`, version)
+}
+
+// parsePrecondition reads the expected version of a conditional request.
+// If-Match needs the entity tag of the current version, If-None-Match: * requires that the key doesn't exist (version 0).
+func parsePrecondition(r *http.Request) (expectedVersion uint64, conditional bool, err error) {
+	if tag := r.Header.Get("If-Match"); tag != "" {
+		version, err := strconv.ParseUint(strings.Trim(tag, `"`), 10, 64)
+		if err != nil || version == 0 {
+			return 0, false, errors.New("If-Match needs an entity tag returned by this server")
+		}
+		return version, true, nil
+	}
+	if tag := r.Header.Get("If-None-Match"); tag != "" {
+		if tag != "*" {
+			return 0, false, errors.New("If-None-Match only supports *")
+		}
+		return 0, true, nil
+	}
+	return 0, false, nil
+}
+
+// txnPermission returns the permission and resource a transaction operation needs
+func txnPermission(op *storage.TxnOp) (acl.Permission, string) {
+	switch {
+	case op.Type == storage.TxnAddValue:
+		return acl.Write, acl.TS(op.Key)
+	case op.Type == storage.TxnDelete:
+		return acl.Delete, acl.KV(op.Key)
+	case op.IsGuard():
+		return acl.Read, acl.KV(op.Key)
+	}
+	return acl.Write, acl.KV(op.Key)
+}
+
+// isReserved rejects requests to keys in the namespace storaged uses for its own state
+func isReserved(w http.ResponseWriter, key string) bool {
+	if storage.IsReserved(key) {
+		writeError(w, http.StatusForbidden, "keys starting with "+storage.ReservedPrefix+" are reserved")
+		return true
+	}
+	return false
+}
+
+// mediaType returns the media type of the request body without parameters like charset
+func mediaType(r *http.Request) string {
+	typ, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return typ
+}
+
+// selectFields returns the wire format of entry with the given fields, all fields if there are none.
+// The default field is written as "value", the others in "fields". ok is false if entry has none of the fields.
+func selectFields(entry *storage.TimeSeriesEntry, fields []string) (out map[string]interface{}, ok bool) {
+	out = map[string]interface{}{"timestamp": entry.Timestamp.UnixNano()}
+	if fields == nil {
+		out["value"] = entry.Value
+		if len(entry.Fields) > 0 {
+			out["fields"] = entry.Fields
+		}
+		return out, true
+	}
+	selected := make(map[string]float64)
+	for _, name := range fields {
+		value, found := entry.Field(name)
+		switch {
+		case !found:
+			continue
+		case name == storage.DefaultField:
+			out["value"] = value
+		default:
+			selected[name] = value
+		}
+		ok = true
+	}
+	if len(selected) > 0 {
+		out["fields"] = selected
+	}
+	return out, ok
+}
+
+// reducedIterator skips all entries which are closer than interval to the previous entry
+type reducedIterator struct {
+	storage.Iterator
+	interval  time.Duration
+	lastPoint time.Time
+}
+
+func reduceIterator(input storage.Iterator, from, to time.Time, desiredPoints int64) storage.Iterator {
+	return &reducedIterator{Iterator: input, interval: to.Sub(from) / time.Duration(desiredPoints)}
+}
+
+func (it *reducedIterator) Next() bool {
+	for it.Iterator.Next() {
+		if stamp := it.Entry().Timestamp; stamp.Sub(it.lastPoint) >= it.interval {
+			it.lastPoint = stamp
+			return true
+		}
+	}
+	return false
 }
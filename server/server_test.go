@@ -1,17 +1,31 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"math"
+	"math/big"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storaged/metrics"
 	"github.com/trusch/storaged/storage"
 )
 
@@ -21,7 +35,7 @@ type ServerSuite struct {
 }
 
 func (suite *ServerSuite) SetupSuite() {
-	store, err := storage.NewLevelDBStorage("./test-store")
+	store, err := storage.NewMetaStorage("leveldb://test-store")
 	suite.NoError(err)
 	suite.NotEmpty(store)
 	suite.srv = New(":8080", store)
@@ -34,7 +48,7 @@ func (suite *ServerSuite) TearDownTest() {
 	suite.NoError(err)
 	err = os.RemoveAll("./test-store")
 	suite.NoError(err)
-	store, err := storage.NewLevelDBStorage("./test-store")
+	store, err := storage.NewMetaStorage("leveldb://test-store")
 	suite.NoError(err)
 	suite.NotEmpty(store)
 	suite.srv.store = store
@@ -71,7 +85,139 @@ func (suite *ServerSuite) TestDelete() {
 	suite.Empty(res)
 	res, err = suite.request("GET", "/kv/foo", "")
 	suite.Equal("404", err.Error())
-	suite.Empty(res)
+	suite.Contains(res, `"code":"not_found"`)
+}
+
+func (suite *ServerSuite) TestList() {
+	for _, key := range []string{"foo/a", "foo/b", "foo/c", "bar"} {
+		_, err := suite.request("PUT", "/kv/"+key, key)
+		suite.NoError(err)
+	}
+	res, err := suite.request("GET", "/kv/foo/?list=true&limit=2", "")
+	suite.NoError(err)
+	page := make(map[string]interface{})
+	suite.NoError(json.Unmarshal([]byte(res), &page))
+	suite.Equal([]interface{}{"foo/a", "foo/b"}, page["keys"])
+	suite.Equal("foo/b", page["cursor"])
+	res, err = suite.request("GET", "/kv/foo/?list=true&limit=2&cursor=foo/b", "")
+	suite.NoError(err)
+	page = make(map[string]interface{})
+	suite.NoError(json.Unmarshal([]byte(res), &page))
+	suite.Equal([]interface{}{"foo/c"}, page["keys"])
+	suite.Nil(page["cursor"])
+}
+
+func (suite *ServerSuite) TestPutWithTTL() {
+	_, err := suite.request("PUT", "/kv/foo?ttl=100ms", "hello world")
+	suite.NoError(err)
+	res, err := suite.request("GET", "/kv/foo", "")
+	suite.NoError(err)
+	suite.Equal("hello world", res)
+	time.Sleep(150 * time.Millisecond)
+	_, err = suite.request("GET", "/kv/foo", "")
+	suite.Equal("404", err.Error())
+	_, err = suite.request("PUT", "/kv/foo?ttl=-1", "hello world")
+	suite.Equal("400", err.Error())
+}
+
+func (suite *ServerSuite) TestConditionalPut() {
+	_, header, err := suite.requestWithHeaders("PUT", "/kv/foo", "a", http.Header{"If-None-Match": {"*"}})
+	suite.NoError(err)
+	etag := header.Get("ETag")
+	suite.NotEmpty(etag)
+	_, _, err = suite.requestWithHeaders("PUT", "/kv/foo", "b", http.Header{"If-None-Match": {"*"}})
+	suite.Equal("412", err.Error())
+	res, header, err := suite.requestWithHeaders("GET", "/kv/foo", "", http.Header{})
+	suite.NoError(err)
+	suite.Equal("a", res)
+	suite.Equal(etag, header.Get("ETag"))
+	_, header, err = suite.requestWithHeaders("PUT", "/kv/foo", "b", http.Header{"If-Match": {etag}})
+	suite.NoError(err)
+	suite.NotEqual(etag, header.Get("ETag"))
+	_, _, err = suite.requestWithHeaders("PUT", "/kv/foo", "c", http.Header{"If-Match": {etag}})
+	suite.Equal("412", err.Error())
+	_, _, err = suite.requestWithHeaders("DELETE", "/kv/foo", "", http.Header{"If-Match": {etag}})
+	suite.Equal("412", err.Error())
+	_, _, err = suite.requestWithHeaders("DELETE", "/kv/foo", "", http.Header{"If-Match": {header.Get("ETag")}})
+	suite.NoError(err)
+	_, _, err = suite.requestWithHeaders("PUT", "/kv/foo", "c", http.Header{"If-Match": {"foo"}})
+	suite.Equal("400", err.Error())
+}
+
+func (suite *ServerSuite) TestTxn() {
+	txn := `[
+		{"op":"not-exists","key":"config"},
+		{"op":"put","key":"config","value":{"foo":"bar"}},
+		{"op":"put","key":"index","value":"config"},
+		{"op":"add","key":"changes","value":1,"timestamp":1500000000000000000}
+	]`
+	_, err := suite.requestWithType("POST", "/txn", "application/json", txn)
+	suite.NoError(err)
+	res, err := suite.request("GET", "/kv/config", "")
+	suite.NoError(err)
+	suite.Equal(`{"foo":"bar"}`, res)
+	res, err = suite.request("GET", "/kv/index", "")
+	suite.NoError(err)
+	suite.Equal("config", res)
+	res, err = suite.request("GET", "/ts/changes?from=1500000000000000000", "")
+	suite.NoError(err)
+	suite.Equal(`[{"timestamp":1500000000000000000,"value":1}]`, res)
+	_, err = suite.requestWithType("POST", "/txn", "application/json", txn)
+	suite.Equal("409", err.Error())
+	_, err = suite.requestWithType("POST", "/txn", "application/json", `[{"op":"foo","key":"bar"}]`)
+	suite.Equal("400", err.Error())
+	_, err = suite.requestWithType("POST", "/txn", "application/json", `[{"op":"add","key":"bar","value":"x"}]`)
+	suite.Equal("400", err.Error())
+}
+
+func (suite *ServerSuite) TestWatch() {
+	resp, err := http.Get("http://localhost:8080/v1/watch/foo/")
+	suite.NoError(err)
+	defer resp.Body.Close()
+	suite.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+	_, err = suite.request("PUT", "/kv/foo/a", "a")
+	suite.NoError(err)
+	_, err = suite.request("PUT", "/kv/bar", "b")
+	suite.NoError(err)
+	_, err = suite.request("DELETE", "/kv/foo/a", "")
+	suite.NoError(err)
+	reader := bufio.NewReader(resp.Body)
+	for _, expected := range []string{
+		"event: put", `data: {"type":"put","key":"foo/a","value":"a","version":1}`, "",
+		"event: delete", `data: {"type":"delete","key":"foo/a"}`, "",
+	} {
+		line, err := reader.ReadString('\n')
+		suite.NoError(err)
+		suite.Equal(expected, strings.TrimSuffix(line, "\n"))
+	}
+}
+
+func (suite *ServerSuite) TestFollow() {
+	_, err := suite.requestWithType("POST", "/ts/sensors/a", "application/json", `[{"timestamp":1500000000000000000,"value":1}]`)
+	suite.NoError(err)
+	resp, err := http.Get("http://localhost:8080/v1/ts/sensors/*?follow=true")
+	suite.NoError(err)
+	defer resp.Body.Close()
+	_, err = suite.request("POST", "/ts/sensors/b?value=2", "")
+	suite.NoError(err)
+	_, err = suite.request("POST", "/ts/other?value=3", "")
+	suite.NoError(err)
+	// values added before the newest sent one are sent too
+	_, err = suite.requestWithType("POST", "/ts/sensors/a", "application/json", `[{"timestamp":1400000000000000000,"value":4}]`)
+	suite.NoError(err)
+	reader := bufio.NewReader(resp.Body)
+	lines := []string{}
+	for i := 0; i < 9; i++ {
+		line, err := reader.ReadString('\n')
+		suite.NoError(err)
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	suite.Equal("event: value", lines[0])
+	suite.Equal(`data: {"key":"sensors/a","timestamp":1500000000000000000,"value":1}`, lines[1])
+	suite.Equal("event: value", lines[3])
+	suite.True(strings.HasPrefix(lines[4], `data: {"key":"sensors/b","timestamp":`))
+	suite.True(strings.HasSuffix(lines[4], `,"value":2}`))
+	suite.Equal(`data: {"key":"sensors/a","timestamp":1400000000000000000,"value":4}`, lines[7])
 }
 
 func (suite *ServerSuite) TestAddValue() {
@@ -80,6 +226,59 @@ func (suite *ServerSuite) TestAddValue() {
 	suite.Empty(res)
 }
 
+func (suite *ServerSuite) TestAddValuesJSON() {
+	_, err := suite.requestWithType("POST", "/ts/foo", "application/json", `[{"timestamp":1500000000000000000,"value":1},{"timestamp":1500000001000000000,"value":2}]`)
+	suite.NoError(err)
+	res, err := suite.request("GET", "/ts/foo", "")
+	suite.NoError(err)
+	suite.Equal(`[{"timestamp":1500000000000000000,"value":1},{"timestamp":1500000001000000000,"value":2}]`, res)
+}
+
+func (suite *ServerSuite) TestAddValuesNDJSON() {
+	_, err := suite.requestWithType("POST", "/ts/foo", "application/x-ndjson", "{\"timestamp\":1500000000000000000,\"value\":1}\n{\"timestamp\":1500000001000000000,\"value\":2}\n")
+	suite.NoError(err)
+	res, err := suite.request("GET", "/ts/foo", "")
+	suite.NoError(err)
+	suite.Equal(`[{"timestamp":1500000000000000000,"value":1},{"timestamp":1500000001000000000,"value":2}]`, res)
+	_, err = suite.requestWithType("POST", "/ts/foo", "application/x-ndjson", "{\"timestamp\":1500000000000000000,\"value\":1}\nfoo")
+	suite.Equal("400", err.Error())
+}
+
+func (suite *ServerSuite) TestAddValueFields() {
+	_, err := suite.request("POST", "/ts/sensor", "value=21.5&humidity=40")
+	suite.NoError(err)
+	res, err := suite.request("GET", "/ts/sensor", "")
+	suite.NoError(err)
+	suite.Regexp(`^\[\{"fields":\{"humidity":40\},"timestamp":\d+,"value":21.5\}\]$`, res)
+	// parameters of the query are not fields, only the posted form is
+	_, err = suite.request("POST", "/ts/query?n=10&value=1", "humidity=40")
+	suite.NoError(err)
+	res, err = suite.request("GET", "/ts/query", "")
+	suite.NoError(err)
+	suite.Regexp(`^\[\{"fields":\{"humidity":40\},"timestamp":\d+,"value":1\}\]$`, res)
+	_, err = suite.request("POST", "/ts/query?foo=bar", "value=2")
+	suite.NoError(err)
+	_, err = suite.request("POST", "/ts/query", "humidity=40")
+	suite.Equal("400", err.Error())
+
+	body := `[{"timestamp":1500000000000000000,"value":1,"fields":{"humidity":40,"pressure":1000}},{"timestamp":1500000001000000000,"value":2}]`
+	_, err = suite.requestWithType("POST", "/ts/foo", "application/json", body)
+	suite.NoError(err)
+	res, err = suite.request("GET", "/ts/foo", "")
+	suite.NoError(err)
+	suite.Equal(`[{"fields":{"humidity":40,"pressure":1000},"timestamp":1500000000000000000,"value":1},{"timestamp":1500000001000000000,"value":2}]`, res)
+	res, err = suite.request("GET", "/ts/foo?fields=humidity", "")
+	suite.NoError(err)
+	suite.Equal(`[{"fields":{"humidity":40},"timestamp":1500000000000000000}]`, res)
+	res, err = suite.request("GET", "/ts/foo?fields=value,pressure", "")
+	suite.NoError(err)
+	suite.Equal(`[{"fields":{"pressure":1000},"timestamp":1500000000000000000,"value":1},{"timestamp":1500000001000000000,"value":2}]`, res)
+	_, err = suite.request("GET", "/ts/foo?fields=humidity&step=1m", "")
+	suite.Equal("400", err.Error())
+	_, err = suite.requestWithType("POST", "/ts/foo", "application/json", `[{"value":1,"fields":{"value":2}}]`)
+	suite.Equal("400", err.Error())
+}
+
 func (suite *ServerSuite) TestBadAddValue() {
 	_, err := suite.request("POST", "/ts/test", "")
 	suite.Equal("400", err.Error())
@@ -165,27 +364,563 @@ func (suite *ServerSuite) TestGetRangeWithN() {
 	suite.True(diff < 0.15, fmt.Sprintf("%v", diff))
 }
 
+func (suite *ServerSuite) TestGetRangeWithStep() {
+	_, err := suite.requestWithType("POST", "/ts/foo", "application/json", `[
+		{"timestamp":1500000000000000000,"value":1},
+		{"timestamp":1500000030000000000,"value":5},
+		{"timestamp":1500000060000000000,"value":2}
+	]`)
+	suite.NoError(err)
+	res, err := suite.request("GET", "/ts/foo?step=1m&agg=max&from=1500000000000000000", "")
+	suite.NoError(err)
+	suite.Equal(`[{"timestamp":1500000000000000000,"value":5},{"timestamp":1500000060000000000,"value":2}]`, res)
+	_, err = suite.request("GET", "/ts/foo?step=1m&agg=median", "")
+	suite.Equal("400", err.Error())
+	_, err = suite.request("GET", "/ts/foo?step=foo", "")
+	suite.Equal("400", err.Error())
+}
+
+func (suite *ServerSuite) TestRetention() {
+	_, err := suite.request("GET", "/admin/retention", "")
+	suite.Equal("404", err.Error())
+	suite.srv.SetJanitor(storage.NewJanitor(suite.srv.store, time.Hour))
+	defer suite.srv.SetJanitor(nil)
+	_, err = suite.request("PUT", "/admin/retention", "foo keep 1h\nbar keep")
+	suite.Equal("400", err.Error())
+	_, err = suite.request("PUT", "/admin/retention", "foo keep 1h\nbar/* keep 30d\n")
+	suite.NoError(err)
+	res, err := suite.request("GET", "/admin/retention", "")
+	suite.NoError(err)
+	suite.Equal("foo keep 1h0m0s\nbar/* keep 30d\n", res)
+	_, err = suite.request("POST", "/ts/foo?value=1", "")
+	suite.NoError(err)
+	t := time.Now().Add(-2 * time.Hour).UnixNano()
+	_, err = suite.requestWithType("POST", "/ts/foo", "application/json", fmt.Sprintf(`[{"timestamp":%v,"value":1}]`, t))
+	suite.NoError(err)
+	res, err = suite.request("POST", "/admin/retention/run?dry-run=true", "")
+	suite.NoError(err)
+	suite.Equal(`{"foo":1}`+"\n", res)
+	res, err = suite.request("POST", "/admin/retention/run", "")
+	suite.NoError(err)
+	suite.Equal(`{"foo":1}`+"\n", res)
+	res, err = suite.request("GET", "/ts/foo", "")
+	suite.NoError(err)
+	slice := make([]map[string]interface{}, 0)
+	suite.NoError(json.Unmarshal([]byte(res), &slice))
+	suite.Equal(1, len(slice))
+}
+
+func (suite *ServerSuite) TestSeries() {
+	for key, labels := range map[string]string{"temp/a": "host=a,region=eu", "temp/b": "host=b,region=eu", "temp/c": "host=c,region=us"} {
+		_, err := suite.request("PUT", "/labels/"+key, labels)
+		suite.NoError(err)
+	}
+	_, err := suite.requestWithType("PUT", "/labels/temp/d", "application/json", `{"host":"d","region":"us"}`)
+	suite.NoError(err)
+	res, err := suite.request("GET", "/labels/temp/d", "")
+	suite.NoError(err)
+	suite.Equal(`{"host":"d","region":"us"}`+"\n", res)
+	_, err = suite.request("DELETE", "/labels/temp/d", "")
+	suite.NoError(err)
+	res, err = suite.request("GET", "/labels/temp/d", "")
+	suite.NoError(err)
+	suite.Equal("{}\n", res)
+	_, err = suite.request("PUT", "/labels/temp/d", "host")
+	suite.Equal("400", err.Error())
+
+	for i, key := range []string{"temp/a", "temp/b", "temp/c"} {
+		body := fmt.Sprintf(`[{"timestamp":1500000000000000000,"value":%v},{"timestamp":1500000060000000000,"value":%v}]`, i+1, 10*(i+1))
+		_, err := suite.requestWithType("POST", "/ts/"+key, "application/json", body)
+		suite.NoError(err)
+	}
+	res, err = suite.request("GET", "/series?match=region=eu", "")
+	suite.NoError(err)
+	suite.Equal(`[{"key":"temp/a","labels":{"host":"a","region":"eu"}},{"key":"temp/b","labels":{"host":"b","region":"eu"}}]`+"\n", res)
+	res, err = suite.request("GET", "/series?match=region=eu,host!=a&from=1500000060000000000", "")
+	suite.NoError(err)
+	suite.Equal(`[{"key":"temp/b","labels":{"host":"b","region":"eu"},"values":[{"timestamp":1500000060000000000,"value":20}]}]`, res)
+	res, err = suite.request("GET", "/series?match=host!=x&from=1500000000000000000&step=1h&agg=sum&group_by=region", "")
+	suite.NoError(err)
+	suite.Equal(`[{"keys":["temp/a","temp/b"],"labels":{"region":"eu"},"values":[{"timestamp":1500000000000000000,"value":33}]},`+
+		`{"keys":["temp/c"],"labels":{"region":"us"},"values":[{"timestamp":1500000000000000000,"value":33}]}]`, res)
+	_, err = suite.request("GET", "/series?match=region=eu&group_by=host", "")
+	suite.Equal("400", err.Error())
+	_, err = suite.request("GET", "/series", "")
+	suite.Equal("400", err.Error())
+}
+
+func (suite *ServerSuite) TestSeriesCatalog() {
+	body := `[{"timestamp":1500000000000000000,"value":1},{"timestamp":1500000060000000000,"value":2,"fields":{"humidity":40}}]`
+	_, err := suite.requestWithType("POST", "/ts/cat/a", "application/json", body)
+	suite.NoError(err)
+	_, err = suite.requestWithType("POST", "/ts/cat/b", "application/json", `[{"timestamp":1500000000000000000,"value":3}]`)
+	suite.NoError(err)
+	res, err := suite.request("GET", "/ts/cat/a?meta=true", "")
+	suite.NoError(err)
+	suite.Equal(`{"key":"cat/a","first":1500000000000000000,"last":1500000060000000000,"count":2,`+
+		`"last_entry":{"fields":{"humidity":40},"timestamp":1500000060000000000,"value":2}}`+"\n", res)
+	res, err = suite.request("GET", "/ts/cat/a/last", "")
+	suite.NoError(err)
+	suite.Equal(`{"fields":{"humidity":40},"timestamp":1500000060000000000,"value":2}`+"\n", res)
+	res, err = suite.request("GET", "/ts/?list=true", "")
+	suite.NoError(err)
+	var infos []*jsonSeriesInfo
+	suite.NoError(json.Unmarshal([]byte(res), &infos))
+	if suite.Len(infos, 2) {
+		suite.Equal("cat/a", infos[0].Key)
+		suite.Equal("cat/b", infos[1].Key)
+		suite.Equal(int64(1), infos[1].Count)
+	}
+	res, err = suite.request("GET", "/ts/cat/b?list=true", "")
+	suite.NoError(err)
+	suite.Contains(res, `"key":"cat/b"`)
+	suite.NotContains(res, `"key":"cat/a"`)
+	_, err = suite.request("GET", "/ts/cat/none/last", "")
+	suite.Equal("404", err.Error())
+	// keys ending with /last are reserved for the last entry
+	res, err = suite.request("POST", "/ts/cat/last", "value=5")
+	suite.Equal("400", err.Error())
+	suite.Contains(res, `"code":"invalid_key"`)
+	_, err = suite.request("GET", "/ts/cat/none?meta=true", "")
+	suite.Equal("404", err.Error())
+}
+
+func (suite *ServerSuite) TestAuth() {
+	f, err := ioutil.TempFile("", "tokens")
+	suite.NoError(err)
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "# static tokens\nsecret admin * read,write,delete")
+	f.Close()
+	tokens, err := LoadTokenFile(f.Name())
+	suite.NoError(err)
+	suite.srv.EnableAuth(tokens)
+	defer suite.srv.DisableAuth()
+	withToken := func(secret string) http.Header {
+		return http.Header{"Content-Type": {"application/x-www-form-urlencoded"}, "Authorization": {"Bearer " + secret}}
+	}
+
+	res, header, err := suite.requestWithHeaders("GET", "/kv/foo", "", http.Header{})
+	suite.Equal("401", err.Error())
+	suite.Contains(res, `"code":"unauthorized"`)
+	suite.Equal(`Bearer realm="storaged"`, header.Get("WWW-Authenticate"))
+	_, _, err = suite.requestWithHeaders("GET", "/kv/foo", "", withToken("wrong"))
+	suite.Equal("401", err.Error())
+	_, _, err = suite.requestWithHeaders("GET", "/kv/foo", "", withToken("secret"))
+	suite.Equal("404", err.Error())
+
+	res, _, err = suite.requestWithHeaders("POST", "/admin/tokens", "name=ci&acl=*+read,write,delete", withToken("secret"))
+	suite.Equal("201", err.Error())
+	created := map[string]interface{}{}
+	suite.NoError(json.Unmarshal([]byte(res), &created))
+	suite.Equal("ci", created["name"])
+	secret, _ := created["token"].(string)
+	suite.NotEmpty(secret)
+	_, _, err = suite.requestWithHeaders("PUT", "/kv/foo", "bar", withToken(secret))
+	suite.NoError(err)
+	_, _, err = suite.requestWithHeaders("GET", "/kv/"+tokenPrefix+created["id"].(string), "", withToken(secret))
+	suite.Equal("403", err.Error())
+
+	res, _, err = suite.requestWithHeaders("GET", "/admin/tokens", "", withToken(secret))
+	suite.NoError(err)
+	suite.Contains(res, `"name":"admin"`)
+	suite.Contains(res, `"name":"ci"`)
+	suite.NotContains(res, secret)
+	suite.NotContains(res, "hash")
+	_, _, err = suite.requestWithHeaders("DELETE", "/admin/tokens/"+tokens[0].ID, "", withToken(secret))
+	suite.Equal("400", err.Error())
+	_, _, err = suite.requestWithHeaders("DELETE", "/admin/tokens/"+created["id"].(string), "", withToken("secret"))
+	suite.NoError(err)
+	_, _, err = suite.requestWithHeaders("GET", "/kv/foo", "", withToken(secret))
+	suite.Equal("401", err.Error())
+	_, _, err = suite.requestWithHeaders("POST", "/admin/tokens", "name=a b", withToken("secret"))
+	suite.Equal("400", err.Error())
+	_, _, err = suite.requestWithHeaders("POST", "/admin/tokens", "name=ci&acl=kv/*+own", withToken("secret"))
+	suite.Equal("400", err.Error())
+}
+
+func (suite *ServerSuite) TestACL() {
+	res, err := suite.request("GET", "/whoami", "")
+	suite.NoError(err)
+	suite.Equal(`{"acl":["* read,write,delete"]}`+"\n", res)
+	f, err := ioutil.TempFile("", "tokens")
+	suite.NoError(err)
+	defer os.Remove(f.Name())
+	fmt.Fprintln(f, "admin-secret admin * read,write,delete")
+	fmt.Fprintln(f, "device-secret dev1 ts/sensors/* read kv/devices/<own-id>/* read,write")
+	fmt.Fprintln(f, "nothing-secret nobody")
+	f.Close()
+	tokens, err := LoadTokenFile(f.Name())
+	suite.NoError(err)
+	suite.srv.EnableAuth(tokens)
+	defer suite.srv.DisableAuth()
+	as := func(secret string) http.Header {
+		return http.Header{"Content-Type": {"application/x-www-form-urlencoded"}, "Authorization": {"Bearer " + secret}}
+	}
+
+	for _, key := range []string{"devices/dev1/a", "devices/dev2/a"} {
+		_, _, err = suite.requestWithHeaders("PUT", "/kv/"+key, "x", as("admin-secret"))
+		suite.NoError(err)
+	}
+	for _, key := range []string{"sensors/a", "other/a"} {
+		_, _, err = suite.requestWithHeaders("POST", "/ts/"+key, "value=1", as("admin-secret"))
+		suite.NoError(err)
+	}
+
+	_, _, err = suite.requestWithHeaders("PUT", "/kv/devices/dev1/b", "x", as("device-secret"))
+	suite.NoError(err)
+	res, _, err = suite.requestWithHeaders("PUT", "/kv/devices/dev2/b", "x", as("device-secret"))
+	suite.Equal("403", err.Error())
+	suite.Contains(res, `"code":"forbidden"`)
+	_, _, err = suite.requestWithHeaders("DELETE", "/kv/devices/dev1/a", "", as("device-secret"))
+	suite.Equal("403", err.Error())
+	res, _, err = suite.requestWithHeaders("GET", "/kv/devices/?list=true", "", as("device-secret"))
+	suite.NoError(err)
+	suite.Equal(`{"keys":["devices/dev1/a","devices/dev1/b"]}`+"\n", res)
+
+	_, _, err = suite.requestWithHeaders("GET", "/ts/sensors/a", "", as("device-secret"))
+	suite.NoError(err)
+	_, _, err = suite.requestWithHeaders("GET", "/ts/other/a", "", as("device-secret"))
+	suite.Equal("403", err.Error())
+	_, _, err = suite.requestWithHeaders("POST", "/ts/sensors/a", "value=2", as("device-secret"))
+	suite.Equal("403", err.Error())
+	_, _, err = suite.requestWithHeaders("DELETE", "/ts/sensors/a", "", as("device-secret"))
+	suite.Equal("403", err.Error())
+	res, _, err = suite.requestWithHeaders("GET", "/ts/?list=true", "", as("device-secret"))
+	suite.NoError(err)
+	suite.Contains(res, `"key":"sensors/a"`)
+	suite.NotContains(res, "other/a")
+
+	txn := `[{"op":"put","key":"devices/dev1/c","value":"x"},{"op":"add","key":"sensors/a","value":3}]`
+	txnHeader := as("device-secret")
+	txnHeader.Set("Content-Type", "application/json")
+	_, _, err = suite.requestWithHeaders("POST", "/txn", txn, txnHeader)
+	suite.Equal("403", err.Error())
+	_, _, err = suite.requestWithHeaders("GET", "/kv/devices/dev1/c", "", as("device-secret"))
+	suite.Equal("404", err.Error())
+	_, _, err = suite.requestWithHeaders("GET", "/admin/tokens", "", as("device-secret"))
+	suite.Equal("403", err.Error())
+
+	_, _, err = suite.requestWithHeaders("GET", "/kv/devices/dev1/a", "", as("nothing-secret"))
+	suite.Equal("403", err.Error())
+	res, _, err = suite.requestWithHeaders("GET", "/whoami", "", as("nothing-secret"))
+	suite.NoError(err)
+	suite.Contains(res, `"name":"nobody"`)
+	suite.Contains(res, `"acl":[]`)
+	res, _, err = suite.requestWithHeaders("GET", "/whoami", "", as("device-secret"))
+	suite.NoError(err)
+	suite.Contains(res, `"acl":["kv/devices/dev1/* read,write","ts/sensors/* read"]`)
+}
+
+func (suite *ServerSuite) TestDuplicates() {
+	defer suite.srv.store.SetDuplicateRules(nil)
+	_, err := suite.request("PUT", "/admin/duplicates", "foo/* reject\nbar drop")
+	suite.Equal("400", err.Error())
+	_, err = suite.request("PUT", "/admin/duplicates", "foo/* reject\nfoo/keep keep\n")
+	suite.NoError(err)
+	res, err := suite.request("GET", "/admin/duplicates", "")
+	suite.NoError(err)
+	suite.Equal("foo/* reject\nfoo/keep keep\n", res)
+
+	body := `[{"timestamp":1500000000000000000,"value":1}]`
+	header := http.Header{"Content-Type": {"application/json"}}
+	_, h, err := suite.requestWithHeaders("POST", "/ts/foo/reject", body, header)
+	suite.NoError(err)
+	suite.Equal("reject", h.Get("X-Duplicate-Policy"))
+	res, _, err = suite.requestWithHeaders("POST", "/ts/foo/reject", body, header)
+	suite.Equal("409", err.Error())
+	suite.Contains(res, `"code":"duplicate_timestamp"`)
+
+	for i := 0; i < 2; i++ {
+		_, h, err = suite.requestWithHeaders("POST", "/ts/foo/keep", body, header)
+		suite.NoError(err)
+		suite.Equal("keep", h.Get("X-Duplicate-Policy"))
+	}
+	res, err = suite.request("GET", "/ts/foo/keep?from=1500000000000000000&to=1500000000000000000", "")
+	suite.NoError(err)
+	suite.Equal(`[{"timestamp":1500000000000000000,"value":1},{"timestamp":1500000000000000000,"value":1}]`, res)
+}
+
+func (suite *ServerSuite) TestGetRangeWithRollups() {
+	roller := storage.NewRoller(suite.srv.store, []time.Duration{time.Minute}, time.Minute)
+	suite.srv.SetRoller(roller)
+	defer suite.srv.SetRoller(nil)
+	from := time.Now().Truncate(time.Minute).Add(-10 * time.Minute)
+	points := []string{}
+	for i := 0; i < 600; i++ {
+		points = append(points, fmt.Sprintf(`{"timestamp":%v,"value":%v}`, from.Add(time.Duration(i)*time.Second).UnixNano(), i%60))
+	}
+	_, err := suite.requestWithType("POST", "/ts/foo", "application/json", "["+strings.Join(points, ",")+"]")
+	suite.NoError(err)
+	suite.NoError(roller.Run())
+	res, err := suite.request("GET", fmt.Sprintf("/ts/foo?n=5&from=%v", from.UnixNano()), "")
+	suite.NoError(err)
+	slice := make([]map[string]interface{}, 0)
+	suite.NoError(json.Unmarshal([]byte(res), &slice))
+	suite.NotEmpty(slice)
+	for _, entry := range slice {
+		suite.Equal(29.5, entry["value"])
+	}
+	res, err = suite.request("GET", fmt.Sprintf("/ts/foo?n=5&agg=max&from=%v", from.UnixNano()), "")
+	suite.NoError(err)
+	slice = make([]map[string]interface{}, 0)
+	suite.NoError(json.Unmarshal([]byte(res), &slice))
+	suite.NotEmpty(slice)
+	for _, entry := range slice {
+		suite.Equal(59., entry["value"])
+	}
+	_, err = suite.request("GET", "/kv/"+storage.ReservedPrefix+"rollup/foo@1m", "")
+	suite.Equal("403", err.Error())
+	_, err = suite.request("GET", "/ts/"+storage.RollupKey("foo", time.Minute, storage.AggAvg), "")
+	suite.Equal("403", err.Error())
+	res, err = suite.request("GET", "/ts/?list=true", "")
+	suite.NoError(err)
+	suite.NotContains(res, storage.ReservedPrefix)
+	res, err = suite.request("GET", "/kv/?list=true", "")
+	suite.NoError(err)
+	suite.Equal(`{"keys":[]}`+"\n", res)
+}
+
+func (suite *ServerSuite) TestErrors() {
+	res, err := suite.request("GET", "/kv/foo", "")
+	suite.Equal("404", err.Error())
+	suite.JSONEq(`{"error":"not found: 'foo'","code":"not_found"}`, res)
+	res, err = suite.request("DELETE", "/kv/foo", "")
+	suite.Equal("404", err.Error())
+	suite.JSONEq(`{"error":"not found: 'foo'","code":"not_found"}`, res)
+	res, err = suite.request("PUT", "/kv/foo/", "hello world")
+	suite.Equal("400", err.Error())
+	suite.JSONEq(`{"error":"invalid key: 'foo/'","code":"invalid_key"}`, res)
+	res, err = suite.request("POST", "/ts/foo", "")
+	suite.Equal("400", err.Error())
+	suite.JSONEq(`{"error":"need 'value'","code":"bad_request"}`, res)
+
+	// a closed store behaves like an unreachable backend
+	store, err := storage.NewMetaStorage("leveldb://test-store-closed")
+	suite.NoError(err)
+	defer os.RemoveAll("./test-store-closed")
+	suite.NoError(store.Close())
+	open := suite.srv.store
+	suite.srv.store = store
+	defer func() { suite.srv.store = open }()
+	res, err = suite.request("GET", "/kv/foo", "")
+	suite.Equal("503", err.Error())
+	suite.Contains(res, `"code":"backend_unavailable"`)
+}
+
 func (suite *ServerSuite) request(method, path string, data string) (string, error) {
+	return suite.requestWithType(method, path, "application/x-www-form-urlencoded", data)
+}
+
+func (suite *ServerSuite) requestWithType(method, path, contentType, data string) (string, error) {
+	res, _, err := suite.requestWithHeaders(method, path, data, http.Header{"Content-Type": {contentType}})
+	return res, err
+}
+
+func (suite *ServerSuite) requestWithHeaders(method, path, data string, header http.Header) (string, http.Header, error) {
 	client := &http.Client{}
 	req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:8080/v1%v", path), strings.NewReader(data))
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header = header
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return string(body), fmt.Errorf("%v", resp.StatusCode)
+		return string(body), resp.Header, fmt.Errorf("%v", resp.StatusCode)
 	}
-	return string(body), nil
+	return string(body), resp.Header, nil
 }
 
 func TestServer(t *testing.T) {
 	suite.Run(t, new(ServerSuite))
 }
+
+func (suite *ServerSuite) TestHealth() {
+	resp, err := http.Get("http://localhost:8080/healthz")
+	suite.NoError(err)
+	bs, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	suite.Equal("ok\n", string(bs))
+	suite.srv.EnableAuth(nil)
+	defer suite.srv.DisableAuth()
+	for _, path := range []string{"/healthz", "/readyz"} {
+		resp, err := http.Get("http://localhost:8080" + path)
+		suite.NoError(err)
+		resp.Body.Close()
+		suite.Equal(http.StatusOK, resp.StatusCode, "%v needs no token", path)
+	}
+	_, _, err = suite.requestWithHeaders("GET", "/whoami", "", http.Header{})
+	suite.Equal("401", err.Error())
+}
+
+func TestShutdown(t *testing.T) {
+	defer os.Remove("./test-shutdown.db")
+	store, err := storage.NewMetaStorage("bolt://test-shutdown.db")
+	require.NoError(t, err)
+	srv := New("localhost:8083", store)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	resp, err := http.Get("http://localhost:8083/readyz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	stream, err := http.Get("http://localhost:8083/v1/watch/foo/")
+	require.NoError(t, err)
+	defer stream.Body.Close()
+
+	start := time.Now()
+	assert.NoError(t, srv.Shutdown(context.Background()), "the event stream ends on shutdown")
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, http.ErrServerClosed, <-served)
+	_, err = ioutil.ReadAll(stream.Body)
+	assert.NoError(t, err)
+	assert.Error(t, storage.Ping(context.Background(), store), "the store is closed")
+	_, err = http.Get("http://localhost:8083/healthz")
+	assert.Error(t, err)
+}
+
+func TestMetrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	meta, err := storage.NewMetaStorage("memory://")
+	require.NoError(t, err)
+	srv := New("localhost:8082", metrics.InstrumentStorage(reg, meta, "memory"))
+	srv.EnableMetrics(reg)
+	go srv.ListenAndServe()
+	defer srv.Stop()
+	time.Sleep(200 * time.Millisecond)
+	do := func(method, path, body string) string {
+		req, err := http.NewRequest(method, "http://localhost:8082"+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		bs, _ := ioutil.ReadAll(res.Body)
+		return string(bs)
+	}
+
+	do("PUT", "/v1/kv/foo", "hello")
+	do("GET", "/v1/kv/foo", "")
+	do("GET", "/v1/kv/missing", "")
+	do("POST", "/v1/ts/series", "value=1")
+	do("GET", "/v1/ts/series", "")
+	do("FOOBAR", "/v1/kv/foo", "")
+	res := do("GET", "/metrics", "")
+	for _, line := range []string{
+		`storaged_http_requests_total{method="GET",route="/v1/kv/",status="200"} 1`,
+		`storaged_http_requests_total{method="GET",route="/v1/kv/",status="404"} 1`,
+		`storaged_http_requests_total{method="POST",route="/v1/ts/",status="200"} 1`,
+		`storaged_http_request_duration_seconds_count{method="PUT",route="/v1/kv/",status="200"} 1`,
+		`storaged_http_request_bytes_total{method="PUT",route="/v1/kv/"} 5`,
+		`storaged_http_response_bytes_total{method="PUT",route="/v1/kv/"} 0`,
+		`storaged_getrange_streams_in_flight 0`,
+		`storaged_storage_operation_duration_seconds_count{backend="memory",method="GetVersioned",result="not_found"} 1`,
+		`storaged_storage_operation_duration_seconds_count{backend="memory",method="GetRange",result="ok"} 1`,
+	} {
+		assert.Contains(t, res, line+"\n")
+	}
+	assert.NotContains(t, res, "storaged_storage_size_bytes", "memory storages have no files")
+	assert.Contains(t, res, `storaged_http_requests_total{method="other",`)
+	assert.NotContains(t, res, "FOOBAR", "unknown methods don't become labels")
+}
+
+// testCert creates a certificate signed by parent, a self signed CA if parent is nil.
+// The certificate and its key are written as PEM files to dir.
+func testCert(t *testing.T, dir, name string, serial int64, parent *tls.Certificate) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600))
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	cert.Leaf, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &cert
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := testCert(t, dir, "ca", 1, nil)
+	testCert(t, dir, "server", 2, ca)
+	client := testCert(t, dir, "dev1", 3, ca)
+	store, err := storage.NewMetaStorage("memory://")
+	require.NoError(t, err)
+	srv := New("localhost:8443", store)
+	require.NoError(t, srv.EnableTLS(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt")))
+	tokenFile := filepath.Join(dir, "tokens")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("cert:dev1 kv/devices/<own-id>/* read,write\n"), 0600))
+	tokens, err := LoadTokenFile(tokenFile)
+	require.NoError(t, err)
+	srv.EnableAuth(tokens)
+	go srv.ListenAndServe()
+	defer srv.Stop()
+	time.Sleep(200 * time.Millisecond)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	get := func(path string, certs ...tls.Certificate) (*http.Response, error) {
+		transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}
+		defer transport.CloseIdleConnections()
+		return (&http.Client{Transport: transport}).Get("https://localhost:8443/v1" + path)
+	}
+
+	_, err = get("/whoami")
+	assert.Error(t, err, "client certificates are required")
+	res, err := get("/whoami", *client)
+	require.NoError(t, err)
+	bs, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, `{"id":"cert:dev1","name":"dev1","static":true,"acl":["kv/devices/dev1/* read,write"]}`+"\n", string(bs))
+	assert.Equal(t, big.NewInt(2), res.TLS.PeerCertificates[0].SerialNumber)
+	res, err = get("/kv/devices/dev2/a", *client)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	testCert(t, dir, "server", 4, ca)
+	require.NoError(t, srv.ReloadTLS())
+	res, err = get("/whoami", *client)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, big.NewInt(4), res.TLS.PeerCertificates[0].SerialNumber)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "server.crt"), []byte("broken"), 0600))
+	assert.Error(t, srv.ReloadTLS())
+	res, err = get("/whoami", *client)
+	require.NoError(t, err, "the previous certificate stays in use")
+	res.Body.Close()
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// certTokenPrefix is the prefix of the ids of the tokens of client certificates, it can't collide with the hex ids of bearer tokens
+const certTokenPrefix = "cert:"
+
+// tlsFiles holds the certificate files of the server and the certificates loaded from them.
+// The files are read again by reload, the handshakes of new connections use the certificates loaded last.
+type tlsFiles struct {
+	certFile, keyFile, clientCAFile string
+
+	mutex     sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func (files *tlsFiles) reload() error {
+	cert, err := tls.LoadX509KeyPair(files.certFile, files.keyFile)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if files.clientCAFile != "" {
+		bs, err := ioutil.ReadFile(files.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(bs) {
+			return fmt.Errorf("no certificates found in '%v'", files.clientCAFile)
+		}
+	}
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	files.cert, files.clientCAs = &cert, clientCAs
+	return nil
+}
+
+// config returns the TLS config of new connections
+func (files *tlsFiles) config(*tls.ClientHelloInfo) (*tls.Config, error) {
+	files.mutex.RLock()
+	defer files.mutex.RUnlock()
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*files.cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"http/1.1"},
+	}
+	if files.clientCAs != nil {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = files.clientCAs
+	}
+	return config, nil
+}
+
+// EnableTLS makes ListenAndServe serve HTTPS with the certificate in certFile and its key in keyFile.
+// If clientCAFile is given, clients need a certificate signed by one of the CAs in it. Their identity is the
+// common name of the certificate, or its first DNS name, email address or URI if it has none.
+// It needs to be called before ListenAndServe.
+func (srv *Server) EnableTLS(certFile, keyFile, clientCAFile string) error {
+	files := &tlsFiles{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := files.reload(); err != nil {
+		return err
+	}
+	srv.tls = files
+	return nil
+}
+
+// ReloadTLS reads the certificate files again. New connections use the new certificates, established ones are kept.
+// If the files can't be loaded, the previous certificates stay in use.
+func (srv *Server) ReloadTLS() error {
+	if srv.tls == nil {
+		return errors.New("tls is not enabled")
+	}
+	return srv.tls.reload()
+}
+
+// tlsConfig returns the config of the TLS listener, nil if TLS is disabled
+func (srv *Server) tlsConfig() *tls.Config {
+	if srv.tls == nil {
+		return nil
+	}
+	return &tls.Config{GetConfigForClient: srv.tls.config}
+}
+
+// certIdentity returns the identity of the verified client certificate of the request, "" if there is none
+func certIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// certToken returns the token of a client certificate identity, the ACL is taken from the token file.
+// Identities which aren't in the token file may do nothing.
+func certToken(static map[string]*Token, identity string) *Token {
+	if token, ok := static[certTokenPrefix+identity]; ok {
+		return token
+	}
+	return &Token{ID: certTokenPrefix + identity, Name: identity}
+}
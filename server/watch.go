@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trusch/storaged/acl"
+	"github.com/trusch/storaged/storage"
+)
+
+// jsonEvent is the wire format of a change event
+type jsonEvent struct {
+	Type    storage.EventType `json:"type"`
+	Key     string            `json:"key"`
+	Value   string            `json:"value,omitempty"`
+	Version uint64            `json:"version,omitempty"`
+}
+
+// handleWatch streams all changes of keys starting with the requested prefix which the request may read as server-sent events
+func (srv *Server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	watcher, ok := srv.store.(storage.Watcher)
+	if !ok || !storage.Supports[storage.Watcher](srv.store) {
+		writeError(w, http.StatusNotImplemented, "the storage doesn't support watching")
+		return
+	}
+	prefix := r.URL.Path[10:]
+	events, cancel := watcher.Watch(prefix)
+	defer cancel()
+	if !startEventStream(w) {
+		return
+	}
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if storage.IsReserved(event.Key) || !may(r, acl.Read, acl.KV(event.Key)) {
+				continue
+			}
+			err := writeEvent(w, string(event.Type), &jsonEvent{event.Type, event.Key, string(event.Value), event.Version})
+			if err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-srv.stopping:
+			return
+		}
+	}
+}
+
+// jsonSeriesEvent is the wire format of a new timeseries entry
+type jsonSeriesEvent struct {
+	Key       string             `json:"key"`
+	Timestamp int64              `json:"timestamp"`
+	Value     float64            `json:"value"`
+	Fields    map[string]float64 `json:"fields,omitempty"`
+}
+
+// sentEntry identifies an entry which was sent as part of the history of a followed timeseries
+type sentEntry struct {
+	key       string
+	timestamp int64
+	value     float64
+}
+
+// handleFollow streams the entries of a timeseries as server-sent events.
+// It starts with the historical entries since 'from' and then sends every new entry.
+// A key ending with '*' follows all timeseries with the given prefix which the request may read.
+func (srv *Server) handleFollow(w http.ResponseWriter, r *http.Request) {
+	follower, ok := srv.store.(storage.SeriesWatcher)
+	if !ok || !storage.Supports[storage.SeriesWatcher](srv.store) {
+		writeError(w, http.StatusNotImplemented, "the storage doesn't support following timeseries")
+		return
+	}
+	key := r.URL.Path[7:]
+	if !strings.HasSuffix(key, "*") && !srv.allowed(w, r, acl.Read, acl.TS(key)) {
+		return
+	}
+	f, _ := strconv.ParseInt(r.FormValue("from"), 10, 64)
+	from := time.Unix(0, f)
+	// subscribe before reading the history, so that no entry gets lost in between
+	events, cancel := follower.Follow(key)
+	defer cancel()
+	keys := []string{key}
+	if strings.HasSuffix(key, "*") {
+		var err error
+		keys, err = srv.store.ListSeries(key[:len(key)-1])
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+	}
+	if !startEventStream(w) {
+		return
+	}
+	now := time.Now()
+	// entries added while the history is read may be sent as part of it and again as an event
+	sent := make(map[sentEntry]bool)
+	for _, k := range keys {
+		if !may(r, acl.Read, acl.TS(k)) {
+			continue
+		}
+		it, err := srv.store.GetRangeContext(r.Context(), k, from, now)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			_, code := errorStatus(err)
+			writeEvent(w, "error", &jsonError{err.Error(), code})
+			return
+		}
+		for it.Next() {
+			entry := it.Entry()
+			if err := writeEvent(w, "value", &jsonSeriesEvent{k, entry.Timestamp.UnixNano(), entry.Value, entry.Fields}); err != nil {
+				it.Close()
+				return
+			}
+			sent[sentEntry{k, entry.Timestamp.UnixNano(), entry.Value}] = true
+		}
+		err = it.Err()
+		it.Close()
+		if err != nil {
+			writeEvent(w, "error", &jsonError{err.Error(), "stream_failed"})
+			return
+		}
+	}
+	// only the events which were published until now can repeat an entry of the history
+	pending := len(events)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if pending > 0 {
+				pending--
+				if sent[sentEntry{event.Key, event.Entry.Timestamp.UnixNano(), event.Entry.Value}] {
+					continue
+				}
+			} else {
+				sent = nil
+			}
+			if storage.IsReserved(event.Key) || !may(r, acl.Read, acl.TS(event.Key)) {
+				continue
+			}
+			if err := writeEvent(w, "value", &jsonSeriesEvent{event.Key, event.Entry.Timestamp.UnixNano(), event.Entry.Value, event.Entry.Fields}); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-srv.stopping:
+			return
+		}
+	}
+}
+
+// startEventStream prepares a long running server-sent events response
+func startEventStream(w http.ResponseWriter) bool {
+	rc := http.NewResponseController(w)
+	// the server wide write timeout would end the stream
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Print("failed to start event stream: ", err)
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	return rc.Flush() == nil
+}
+
+// writeEvent writes a single server-sent event with JSON data and flushes it to the client
+func writeEvent(w http.ResponseWriter, name string, data interface{}) error {
+	bs, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %v\ndata: %s\n\n", name, bs); err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
@@ -2,9 +2,8 @@ package storage
 
 import (
 	"bytes"
-	"errors"
-	"fmt"
-	"strconv"
+	"context"
+	"sort"
 	"strings"
 	"time"
 
@@ -13,134 +12,456 @@ import (
 
 //BoltStorage is an implementation for KeyValueStorage and TimeSeriesStorage
 type BoltStorage struct {
-	db *bolt.DB
+	noContext
+	duplicateRules
+	db        *bolt.DB
+	stop      chan struct{}
+	closeOnce closeOnce
 }
 
 // NewBoltStorage creates a new storage instance
 func NewBoltStorage(path string) (Storage, error) {
 	db, err := bolt.Open(path, 0600, nil)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(ErrBackendUnavailable, err)
+	}
+	if err := migrateBolt(db); err != nil {
+		db.Close()
+		return nil, boltError(err)
 	}
-	store := &BoltStorage{db}
+	store := &BoltStorage{db: db, stop: make(chan struct{})}
+	store.noContext = noContext{store}
+	go runSweeper(store.sweepExpired, store.stop)
 	return store, nil
 }
 
-// Put saves a value to the db
-func (store *BoltStorage) Put(key string, value []byte) error {
-	return store.db.Update(func(tx *bolt.Tx) error {
-		b, k, err := store.getOrCreateBucketForKey(tx, "kv/"+key)
-		if err != nil {
-			return err
-		}
-		if err := b.Put([]byte(k), value); err != nil {
-			return err
+// PutContext saves a value to the db
+func (store *BoltStorage) PutContext(ctx context.Context, key string, value []byte) error {
+	_, err := store.putVersioned(ctx, key, value, time.Time{})
+	return err
+}
+
+// PutWithTTLContext saves a value to the db which expires after ttl
+// The expiry times are kept in the flat "ttl" bucket
+func (store *BoltStorage) PutWithTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := store.putVersioned(ctx, key, value, time.Now().Add(ttl))
+	return err
+}
+
+// putVersioned saves a value which expires at expires unless it is zero and returns its new version
+func (store *BoltStorage) putVersioned(ctx context.Context, key string, value []byte, expires time.Time) (uint64, error) {
+	var expiry []byte
+	if !expires.IsZero() {
+		expiry = encodeExpiry(expires)
+	}
+	var version uint64
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		version, err = store.put(tx, key, value, expiry)
+		return err
+	})
+	return version, boltError(err)
+}
+
+// CompareAndSwapContext saves a value if the current version of key is expectedVersion
+// An expectedVersion of 0 means that the key must not exist.
+func (store *BoltStorage) CompareAndSwapContext(ctx context.Context, key string, expectedVersion uint64, value []byte) (uint64, error) {
+	var version uint64
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		_, current, err := store.get(tx, key)
+		if !versionMatches(err == nil, current, expectedVersion) {
+			return ErrVersionMismatch
 		}
-		return nil
+		version, err = store.put(tx, key, value, nil)
+		return err
 	})
+	return version, boltError(err)
+}
+
+// put saves a value and returns its new version
+// The versions are kept in the flat "ver" bucket, they are taken from the sequence of that bucket.
+func (store *BoltStorage) put(tx *bolt.Tx, key string, value []byte, expiry []byte) (uint64, error) {
+	b, k, err := store.getOrCreateBucketForKey(tx, "kv/"+key)
+	if err != nil {
+		return 0, err
+	}
+	if err := b.Put([]byte(k), value); err != nil {
+		return 0, err
+	}
+	ttlBucket, err := tx.CreateBucketIfNotExists([]byte("ttl"))
+	if err != nil {
+		return 0, err
+	}
+	if expiry == nil {
+		err = ttlBucket.Delete([]byte(key))
+	} else {
+		err = ttlBucket.Put([]byte(key), expiry)
+	}
+	if err != nil {
+		return 0, err
+	}
+	verBucket, err := tx.CreateBucketIfNotExists([]byte("ver"))
+	if err != nil {
+		return 0, err
+	}
+	version, err := verBucket.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	return version, verBucket.Put([]byte(key), encodeVersion(version))
 }
 
-// Get retrieves a value from db
-func (store *BoltStorage) Get(key string) ([]byte, error) {
-	var value []byte
+// GetContext retrieves a value from db
+func (store *BoltStorage) GetContext(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := store.GetVersionedContext(ctx, key)
+	return value, err
+}
+
+// GetVersionedContext retrieves a value and its version from db
+func (store *BoltStorage) GetVersionedContext(ctx context.Context, key string) ([]byte, uint64, error) {
+	var (
+		value   []byte
+		version uint64
+	)
 	err := store.db.View(func(tx *bolt.Tx) error {
-		b, k, err := store.getBucketForKey(tx, "kv/"+key)
+		v, ver, err := store.get(tx, key)
 		if err != nil {
 			return err
 		}
-		value = b.Get([]byte(k))
-		if value == nil {
-			return errors.New("no such value")
-		}
+		value = append([]byte{}, v...)
+		version = ver
 		return nil
 	})
-	return value, err
+	return value, version, boltError(err)
 }
 
-// Delete drops an entry from db
-func (store *BoltStorage) Delete(key string) error {
-	return store.db.Update(func(tx *bolt.Tx) error {
-		b, k, err := store.getBucketForKey(tx, "kv/"+key)
-		if err != nil {
+// get returns the value and version of key, the value is only valid during tx
+func (store *BoltStorage) get(tx *bolt.Tx, key string) ([]byte, uint64, error) {
+	b, k, err := store.getBucketForKey(tx, "kv/"+key)
+	if err != nil {
+		return nil, 0, notFound(key)
+	}
+	value := b.Get([]byte(k))
+	if value == nil || store.isExpired(tx, key, time.Now()) {
+		return nil, 0, notFound(key)
+	}
+	var version uint64
+	if verBucket := tx.Bucket([]byte("ver")); verBucket != nil {
+		version = decodeVersion(verBucket.Get([]byte(key)))
+	}
+	return value, version, nil
+}
+
+// DeleteContext drops an entry from db
+func (store *BoltStorage) DeleteContext(ctx context.Context, key string) error {
+	return boltError(store.db.Update(func(tx *bolt.Tx) error {
+		if _, _, err := store.get(tx, key); err != nil {
 			return err
 		}
-		if err := b.Delete([]byte(k)); err != nil {
-			return err
+		return store.delete(tx, key)
+	}))
+}
+
+// CompareAndDeleteContext drops an entry from db if its current version is expectedVersion
+func (store *BoltStorage) CompareAndDeleteContext(ctx context.Context, key string, expectedVersion uint64) error {
+	return boltError(store.db.Update(func(tx *bolt.Tx) error {
+		_, current, err := store.get(tx, key)
+		if err != nil || !versionMatches(true, current, expectedVersion) {
+			return ErrVersionMismatch
 		}
-		return nil
-	})
+		return store.delete(tx, key)
+	}))
 }
 
-// AddValue saves a value to the given timeseries
-func (store *BoltStorage) AddValue(key string, value float64) error {
+func (store *BoltStorage) delete(tx *bolt.Tx, key string) error {
+	b, k, err := store.getBucketForKey(tx, "kv/"+key)
+	if err != nil {
+		return err
+	}
+	if err := b.Delete([]byte(k)); err != nil {
+		return err
+	}
+	for _, name := range []string{"ttl", "ver"} {
+		if metaBucket := tx.Bucket([]byte(name)); metaBucket != nil {
+			if err := metaBucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isExpired checks if key has a ttl which is over
+func (store *BoltStorage) isExpired(tx *bolt.Tx, key string, now time.Time) bool {
+	ttlBucket := tx.Bucket([]byte("ttl"))
+	if ttlBucket == nil {
+		return false
+	}
+	return isExpired(ttlBucket.Get([]byte(key)), now)
+}
+
+// sweepExpired removes all expired entries
+func (store *BoltStorage) sweepExpired() error {
 	return store.db.Update(func(tx *bolt.Tx) error {
-		b, _, err := store.getOrCreateBucketForKey(tx, "ts/"+key+"/")
-		if err != nil {
-			return err
+		ttlBucket := tx.Bucket([]byte("ttl"))
+		if ttlBucket == nil {
+			return nil
 		}
-		key = fmt.Sprintf("%v", time.Now().UnixNano())
-		valBs := FloatToBytes(value)
-		if err := b.Put([]byte(key), valBs); err != nil {
-			return err
+		now := time.Now()
+		expired := []string{}
+		ttlBucket.ForEach(func(k, v []byte) error {
+			if isExpired(v, now) {
+				expired = append(expired, string(k))
+			}
+			return nil
+		})
+		for _, key := range expired {
+			if err := store.delete(tx, key); err != nil {
+				ttlBucket.Delete([]byte(key))
+			}
 		}
 		return nil
 	})
 }
 
-// GetRange returns a channel which will give all values in a timerange
-func (store *BoltStorage) GetRange(key string, from time.Time, to time.Time) (chan *TimeSeriesEntry, error) {
-	ch := make(chan *TimeSeriesEntry, 64)
-	go store.db.View(func(tx *bolt.Tx) error {
-		b, _, err := store.getBucketForKey(tx, "ts/"+key+"/")
-		if err != nil {
-			close(ch)
+// ListContext returns all keys starting with prefix
+func (store *BoltStorage) ListContext(ctx context.Context, prefix string) ([]string, error) {
+	return store.ScanContext(ctx, prefix, PrefixEnd(prefix), 0)
+}
+
+// ScanContext returns at most limit keys in the range [start, end)
+// The buckets are walked in key order, so that only the returned keys and their parent buckets are read.
+func (store *BoltStorage) ScanContext(ctx context.Context, start, end string, limit int) ([]string, error) {
+	keys := []string{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("kv"))
+		if b == nil {
+			return nil
+		}
+		now := time.Now()
+		store.scanBucket(b, "", start, end, func(key string) bool {
+			if !store.isExpired(tx, key, now) {
+				keys = append(keys, key)
+			}
+			return limit <= 0 || len(keys) < limit
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, boltError(err)
+	}
+	return keys, nil
+}
+
+// scanBucket calls fn in lexical order for every key in the range [start, end) stored in b or one of its sub-buckets,
+// until fn returns false. It returns false if fn did.
+// The keys of a sub-bucket k sort behind k+"/", which is not the cursor order if other keys start with k followed
+// by a byte smaller than '/', like "k-1". Such sub-buckets are visited once the cursor passes their position.
+func (store *BoltStorage) scanBucket(b *bolt.Bucket, prefix, start, end string, fn func(key string) bool) bool {
+	// pending holds the prefixes of the sub-buckets which are not yet visited, sorted
+	pending := []string{}
+	visitPending := func(before string) bool {
+		for len(pending) > 0 && (before == "" || pending[0] < before) {
+			sub := pending[0]
+			pending = pending[1:]
+			if !store.scanBucket(b.Bucket([]byte(sub[len(prefix):len(sub)-1])), sub, start, end, fn) {
+				return false
+			}
+		}
+		return true
+	}
+	c := b.Cursor()
+	k, v := c.First()
+	if strings.HasPrefix(start, prefix) {
+		k, v = c.Seek([]byte(seekName(start[len(prefix):])))
+	}
+	for ; k != nil; k, v = c.Next() {
+		key := prefix + string(k)
+		if end != "" && key >= end {
+			break
+		}
+		// all following keys and sub-buckets sort behind key
+		if !visitPending(key) {
+			return false
+		}
+		if v != nil {
+			if key >= start && !fn(key) {
+				return false
+			}
+			continue
+		}
+		if sub := key + "/"; prefixInRange(sub, start, end) {
+			i := sort.SearchStrings(pending, sub)
+			pending = append(pending[:i], append([]string{sub}, pending[i:]...)...)
+		}
+	}
+	return visitPending("")
+}
+
+// seekName returns the name to seek to in a bucket for the first entry which can be in a range starting at start,
+// where start is relative to the bucket. The name is cut before the first slash and the first byte sorting before it,
+// so that sub-buckets whose keys sort behind start are not skipped.
+func seekName(start string) string {
+	for i := 0; i < len(start); i++ {
+		if start[i] <= '/' {
+			return start[:i]
+		}
+	}
+	return start
+}
+
+// AddValueContext saves a value to the given timeseries
+func (store *BoltStorage) AddValueContext(ctx context.Context, key string, value float64) error {
+	return store.AddValuesContext(ctx, key, []*TimeSeriesEntry{{Value: value, Timestamp: time.Now()}})
+}
+
+// AddValuesContext saves multiple values to the given timeseries in a single transaction
+func (store *BoltStorage) AddValuesContext(ctx context.Context, key string, entries []*TimeSeriesEntry) error {
+	return boltError(store.db.Update(func(tx *bolt.Tx) error {
+		return store.addValues(tx, key, entries)
+	}))
+}
+
+// addValues saves entries, already used timestamps are handled by the duplicate policy of key
+func (store *BoltStorage) addValues(tx *bolt.Tx, key string, entries []*TimeSeriesEntry) error {
+	b, _, err := store.getOrCreateBucketForKey(tx, "ts/"+key+"/")
+	if err != nil {
+		return err
+	}
+	policy := store.policyFor(key)
+	for _, entry := range entries {
+		k := encodeTimestamp(entry.Timestamp)
+		if policy != DuplicateOverwrite {
+			seq := boltNextSequence(b, k)
+			if seq > 0 && policy == DuplicateReject {
+				return duplicateTimestamp(key, entry.Timestamp)
+			}
+			k = appendSequence(k, seq)
+		}
+		if err := b.Put(k, encodeEntryValue(entry)); err != nil {
 			return err
 		}
-		c := b.Cursor()
-		startKey := []byte(fmt.Sprintf("%v", from.UnixNano()))
-		endKey := []byte(fmt.Sprintf("%v", to.UnixNano()))
-		for k, v := c.Seek(startKey); k != nil && bytes.Compare(k, endKey) <= 0; k, v = c.Next() {
-			nanos, err := strconv.ParseInt(string(k), 10, 64)
+	}
+	return nil
+}
+
+// boltNextSequence returns the sequence number of the next value at the encoded timestamp stamp in b, it is 0 if stamp is unused
+func boltNextSequence(b *bolt.Bucket, stamp []byte) uint32 {
+	c := b.Cursor()
+	var next uint32
+	for k, v := c.Seek(stamp); k != nil && bytes.HasPrefix(k, stamp); k, v = c.Next() {
+		if isBoltSeriesEntry(k, v) {
+			next = decodeSequence(k[len(stamp):]) + 1
+		}
+	}
+	return next
+}
+
+// boltRangeChunk is the number of entries GetRangeContext reads in one read transaction
+var boltRangeChunk = 1000
+
+// GetRangeContext returns an iterator over all values in a timerange
+// The entries are read in chunks of boltRangeChunk entries, each in its own read transaction, so that a slow reader
+// doesn't block writes which need to grow the database. Values written while iterating are included if they are behind the last read one.
+func (store *BoltStorage) GetRangeContext(ctx context.Context, key string, from time.Time, to time.Time) (Iterator, error) {
+	endKey := encodeTimestamp(to)
+	var (
+		chunk []*TimeSeriesEntry
+		last  []byte
+		done  bool
+	)
+	// readChunk reads the next chunk, continuing behind the last read entry
+	readChunk := func() error {
+		chunk = nil
+		return boltError(store.db.View(func(tx *bolt.Tx) error {
+			b, _, err := store.getBucketForKey(tx, "ts/"+key+"/")
 			if err != nil {
-				continue
+				done = true
+				return nil
+			}
+			c := b.Cursor()
+			var k, v []byte
+			if last == nil {
+				k, v = c.Seek(encodeTimestamp(from))
+			} else if k, v = c.Seek(last); bytes.Equal(k, last) {
+				k, v = c.Next()
+			}
+			for ; k != nil && !afterTimestamp(k, endKey); k, v = c.Next() {
+				if len(chunk) == boltRangeChunk {
+					return nil
+				}
+				if !isBoltSeriesEntry(k, v) {
+					continue
+				}
+				value, fields := decodeEntryValue(v)
+				chunk = append(chunk, &TimeSeriesEntry{Value: value, Timestamp: decodeTimestamp(k[:8]), Fields: fields})
+				last = append(last[:0], k...)
+			}
+			done = true
+			return nil
+		}))
+	}
+	if err := readChunk(); err != nil {
+		return nil, err
+	}
+	return newFuncIterator(ctx, func() (*TimeSeriesEntry, error) {
+		if len(chunk) == 0 && !done {
+			if err := readChunk(); err != nil {
+				return nil, err
 			}
-			stamp := time.Unix(0, nanos)
-			ch <- &TimeSeriesEntry{BytesToFloat(v), stamp}
 		}
-		close(ch)
-		return nil
-	})
-	return ch, nil
+		if len(chunk) == 0 {
+			return nil, nil
+		}
+		entry := chunk[0]
+		chunk = chunk[1:]
+		return entry, nil
+	}, func() error { return nil }), nil
 }
 
-// DeleteRange deletes a range from a timeseries
-func (store *BoltStorage) DeleteRange(key string, from time.Time, to time.Time) error {
-	return store.db.Update(func(tx *bolt.Tx) error {
+// DeleteRangeContext deletes a range from a timeseries
+func (store *BoltStorage) DeleteRangeContext(ctx context.Context, key string, from time.Time, to time.Time) error {
+	return boltError(store.db.Update(func(tx *bolt.Tx) error {
 		b, _, err := store.getBucketForKey(tx, "ts/"+key+"/")
 		if err != nil {
-			return err
+			return notFound(key)
 		}
 		c := b.Cursor()
-		startKey := []byte(fmt.Sprintf("%v", from.UnixNano()))
-		endKey := []byte(fmt.Sprintf("%v", to.UnixNano()))
-		for k, _ := c.Seek(startKey); k != nil && bytes.Compare(k, endKey) <= 0; k, _ = c.Next() {
-			b.Delete(k)
+		endKey := encodeTimestamp(to)
+		for k, v := c.Seek(encodeTimestamp(from)); k != nil && !afterTimestamp(k, endKey); k, v = c.Next() {
+			if isBoltSeriesEntry(k, v) {
+				b.Delete(k)
+			}
 		}
 		return nil
-	})
+	}))
+}
+
+// isBoltSeriesEntry checks if k and v are an entry of a timeseries bucket and not one of the nested timeseries.
+// Entries are keyed by their encoded timestamp, kept duplicates additionally by a sequence number.
+func isBoltSeriesEntry(k, v []byte) bool {
+	return v != nil && (len(k) == 8 || len(k) == 12)
+}
+
+// afterTimestamp checks if the entry key k sorts behind all entries at the encoded timestamp stamp
+func afterTimestamp(k, stamp []byte) bool {
+	if len(k) > len(stamp) {
+		k = k[:len(stamp)]
+	}
+	return bytes.Compare(k, stamp) > 0
 }
 
 func (store *BoltStorage) getBucketForKey(tx *bolt.Tx, key string) (*bolt.Bucket, string, error) {
 	parts := strings.Split(key, "/")
 	bucket := tx.Bucket([]byte(parts[0]))
 	if bucket == nil {
-		return nil, "", errors.New("bucket not found")
+		return nil, "", ErrNotFound
 	}
 	parts = parts[1:]
 	for len(parts) > 1 {
 		bucket = bucket.Bucket([]byte(parts[0]))
 		if bucket == nil {
-			return nil, "", errors.New("bucket not found")
+			return nil, "", ErrNotFound
 		}
 		parts = parts[1:]
 	}
@@ -164,7 +485,123 @@ func (store *BoltStorage) getOrCreateBucketForKey(tx *bolt.Tx, key string) (*bol
 	return bucket, parts[0], nil
 }
 
-// Close closes the db, flushing it eventually
+// ListSeriesContext returns the keys of all timeseries starting with prefix
+// Every bucket below "ts" which directly contains values is a timeseries
+func (store *BoltStorage) ListSeriesContext(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("ts"))
+		if b == nil {
+			return nil
+		}
+		return store.walkSeriesBuckets(b, "", prefix, func(key string) {
+			keys = append(keys, key)
+		})
+	})
+	if err != nil {
+		return nil, boltError(err)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// walkSeriesBuckets calls fn for the path of every bucket below b which contains values and starts with prefix
+func (store *BoltStorage) walkSeriesBuckets(b *bolt.Bucket, path, prefix string, fn func(key string)) error {
+	hasValues := false
+	err := b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			hasValues = true
+			return nil
+		}
+		sub := string(k)
+		if path != "" {
+			sub = path + "/" + sub
+		}
+		if !strings.HasPrefix(sub, prefix) && !strings.HasPrefix(prefix, sub) {
+			return nil
+		}
+		return store.walkSeriesBuckets(b.Bucket(k), sub, prefix, fn)
+	})
+	if err != nil {
+		return err
+	}
+	if hasValues && path != "" && strings.HasPrefix(path, prefix) {
+		fn(path)
+	}
+	return nil
+}
+
+// AggregateContext returns one aggregated value per step in a timerange
+func (store *BoltStorage) AggregateContext(ctx context.Context, key string, from time.Time, to time.Time, step time.Duration, agg Aggregation) (Iterator, error) {
+	return aggregateRange(ctx, store, key, from, to, step, agg)
+}
+
+// CommitContext applies all operations of txn in a single bolt transaction
+func (store *BoltStorage) CommitContext(ctx context.Context, txn *Txn) error {
+	_, err := store.commitVersioned(ctx, txn)
+	return err
+}
+
+// commitVersioned commits txn and returns the new versions of the keys written by its put operations
+func (store *BoltStorage) commitVersioned(ctx context.Context, txn *Txn) ([]uint64, error) {
+	if err := txn.Validate(); err != nil {
+		return nil, err
+	}
+	versions := make([]uint64, len(txn.Ops))
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		for _, op := range txn.Ops {
+			if op.IsGuard() {
+				_, version, err := store.get(tx, op.Key)
+				if !checkGuard(op, err == nil, version) {
+					return ErrGuardFailed
+				}
+			}
+		}
+		now := time.Now()
+		for i, op := range txn.Ops {
+			var err error
+			switch op.Type {
+			case TxnPut:
+				versions[i], err = store.put(tx, op.Key, op.Value, nil)
+			case TxnDelete:
+				if _, _, e := store.get(tx, op.Key); e == nil {
+					err = store.delete(tx, op.Key)
+				}
+			case TxnAddValue:
+				err = store.addValues(tx, op.Key, []*TimeSeriesEntry{entryWithStamp(op, now)})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, boltError(err)
+	}
+	return versions, nil
+}
+
+// Close closes the db, flushing it eventually. Closing it again returns the result of the first call.
 func (store *BoltStorage) Close() error {
-	return store.db.Close()
+	return store.closeOnce.do(func() error {
+		close(store.stop)
+		return store.db.Close()
+	})
+}
+
+// boltError wraps the errors of bolt into the errors of this package
+func boltError(err error) error {
+	switch err {
+	case bolt.ErrDatabaseNotOpen, bolt.ErrTimeout:
+		return wrapError(ErrBackendUnavailable, err)
+	case bolt.ErrIncompatibleValue:
+		// the key is used as a value and as a path to other keys
+		return wrapError(ErrConflict, err)
+	case bolt.ErrBucketNameRequired, bolt.ErrKeyRequired, bolt.ErrKeyTooLarge:
+		return wrapError(ErrInvalidKey, err)
+	case bolt.ErrValueTooLarge:
+		return wrapError(ErrInvalidArgument, err)
+	}
+	return err
 }
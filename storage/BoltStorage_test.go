@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltRangeChunks(t *testing.T) {
+	path := "./test-bolt-chunks.db"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	defer func(size int) { boltRangeChunk = size }(boltRangeChunk)
+	boltRangeChunk = 2
+	store, err := NewBoltStorage(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	store.SetDuplicateRules([]*DuplicateRule{{"*", DuplicateKeep}})
+	base := time.Unix(1500000000, 0)
+	// the kept duplicates at base+1s end up in different chunks
+	assert.NoError(t, store.AddValues("foo", []*TimeSeriesEntry{
+		{Value: 0, Timestamp: base},
+		{Value: 1, Timestamp: base.Add(time.Second)},
+		{Value: 2, Timestamp: base.Add(time.Second)},
+		{Value: 3, Timestamp: base.Add(2 * time.Second)},
+	}))
+	it, err := store.GetRangeContext(context.Background(), "foo", base, base.Add(time.Minute))
+	assert.NoError(t, err)
+	defer it.Close()
+	values := []float64{}
+	for it.Next() {
+		values = append(values, it.Entry().Value)
+		if len(values) == 1 {
+			// writes don't wait for the iterator
+			assert.NoError(t, store.AddValue("foo", 4))
+			assert.NoError(t, store.AddValues("foo", []*TimeSeriesEntry{{Value: 5, Timestamp: base.Add(3 * time.Second)}}))
+		}
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, []float64{0, 1, 2, 3, 5}, values)
+}
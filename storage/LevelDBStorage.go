@@ -1,11 +1,15 @@
 package storage
 
 import (
-	"fmt"
-	"strconv"
+	"context"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/filter"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
@@ -13,7 +17,15 @@ import (
 
 //LevelDBStorage is an implementation for KeyValueStorage and TimeSeriesStorage
 type LevelDBStorage struct {
-	db *leveldb.DB
+	noContext
+	duplicateRules
+	db        *leveldb.DB
+	path      string
+	stop      chan struct{}
+	closeOnce closeOnce
+	// mutex serializes all writes, so that conditional writes and duplicate checks can check and write atomically
+	mutex    sync.Mutex
+	revision uint64
 }
 
 // NewLevelDBStorage creates a new storage instance
@@ -23,82 +35,422 @@ func NewLevelDBStorage(path string) (*LevelDBStorage, error) {
 	}
 	db, err := leveldb.OpenFile(path, o)
 	if err != nil {
+		return nil, wrapError(ErrBackendUnavailable, err)
+	}
+	if err := migrateLevelDB(db); err != nil {
+		db.Close()
 		return nil, err
 	}
-	store := &LevelDBStorage{db}
+	store := &LevelDBStorage{db: db, path: path, stop: make(chan struct{})}
+	store.noContext = noContext{store}
+	if bs, err := db.Get([]byte("meta/revision"), nil); err == nil {
+		store.revision = decodeVersion(bs)
+	}
+	go runSweeper(store.sweepExpired, store.stop)
 	return store, nil
 }
 
-// Put saves a value to the db
-func (store *LevelDBStorage) Put(key string, value []byte) error {
-	return store.db.Put([]byte("kv/"+key), value, nil)
+// PutContext saves a value to the db
+func (store *LevelDBStorage) PutContext(ctx context.Context, key string, value []byte) error {
+	_, err := store.putVersioned(ctx, key, value, time.Time{})
+	return err
+}
+
+// PutWithTTLContext saves a value to the db which expires after ttl
+// The expiry time is kept in a separate "ttl/<key>" entry
+func (store *LevelDBStorage) PutWithTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := store.putVersioned(ctx, key, value, time.Now().Add(ttl))
+	return err
+}
+
+// putVersioned saves a value which expires at expires unless it is zero and returns its new version
+func (store *LevelDBStorage) putVersioned(ctx context.Context, key string, value []byte, expires time.Time) (uint64, error) {
+	var expiry []byte
+	if !expires.IsZero() {
+		expiry = encodeExpiry(expires)
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	batch := new(leveldb.Batch)
+	version := store.put(batch, key, value, expiry)
+	if err := store.db.Write(batch, nil); err != nil {
+		return 0, levelDBError(err)
+	}
+	return version, nil
+}
+
+// CompareAndSwapContext saves a value if the current version of key is expectedVersion
+// An expectedVersion of 0 means that the key must not exist.
+func (store *LevelDBStorage) CompareAndSwapContext(ctx context.Context, key string, expectedVersion uint64, value []byte) (uint64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	_, current, err := store.get(store.db, key)
+	if !versionMatches(err == nil, current, expectedVersion) {
+		return 0, ErrVersionMismatch
+	}
+	batch := new(leveldb.Batch)
+	version := store.put(batch, key, value, nil)
+	return version, levelDBError(store.db.Write(batch, nil))
+}
+
+// put adds a write of key to batch and returns the new version of key
+// The version is the new store revision which is kept in "meta/revision", the version of a key in "ver/<key>".
+// The caller must hold the mutex.
+func (store *LevelDBStorage) put(batch *leveldb.Batch, key string, value []byte, expiry []byte) uint64 {
+	store.revision++
+	batch.Put([]byte("kv/"+key), value)
+	if expiry == nil {
+		batch.Delete([]byte("ttl/" + key))
+	} else {
+		batch.Put([]byte("ttl/"+key), expiry)
+	}
+	batch.Put([]byte("ver/"+key), encodeVersion(store.revision))
+	batch.Put([]byte("meta/revision"), encodeVersion(store.revision))
+	return store.revision
+}
+
+// GetContext retrieves a value from db
+func (store *LevelDBStorage) GetContext(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := store.GetVersionedContext(ctx, key)
+	return value, err
 }
 
-// Get retrieves a value from db
-func (store *LevelDBStorage) Get(key string) ([]byte, error) {
-	bs, err := store.db.Get([]byte("kv/"+key), nil)
+// GetVersionedContext retrieves a value and its version from db
+func (store *LevelDBStorage) GetVersionedContext(ctx context.Context, key string) ([]byte, uint64, error) {
+	snapshot, err := store.db.GetSnapshot()
 	if err != nil {
-		return nil, err
+		return nil, 0, levelDBError(err)
+	}
+	defer snapshot.Release()
+	return store.get(snapshot, key)
+}
+
+func (store *LevelDBStorage) get(reader leveldb.Reader, key string) ([]byte, uint64, error) {
+	if store.isExpired(reader, key, time.Now()) {
+		return nil, 0, notFound(key)
+	}
+	bs, err := reader.Get([]byte("kv/"+key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, 0, notFound(key)
 	}
-	return bs, nil
+	if err != nil {
+		return nil, 0, levelDBError(err)
+	}
+	version, _ := reader.Get([]byte("ver/"+key), nil)
+	return bs, decodeVersion(version), nil
 }
 
-// Delete drops an entry from db
-func (store *LevelDBStorage) Delete(key string) error {
-	return store.db.Delete([]byte("kv/"+key), nil)
+// DeleteContext drops an entry from db
+func (store *LevelDBStorage) DeleteContext(ctx context.Context, key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, _, err := store.get(store.db, key); err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	store.delete(batch, key)
+	return levelDBError(store.db.Write(batch, nil))
+}
+
+// CompareAndDeleteContext drops an entry from db if its current version is expectedVersion
+func (store *LevelDBStorage) CompareAndDeleteContext(ctx context.Context, key string, expectedVersion uint64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	_, current, err := store.get(store.db, key)
+	if err != nil || !versionMatches(true, current, expectedVersion) {
+		return ErrVersionMismatch
+	}
+	batch := new(leveldb.Batch)
+	store.delete(batch, key)
+	return levelDBError(store.db.Write(batch, nil))
 }
 
-// AddValue saves a value to the given timeseries
-func (store *LevelDBStorage) AddValue(key string, value float64) error {
-	keyBs := []byte(fmt.Sprintf("ts/%v%v", key, time.Now().UnixNano()))
-	valBs := FloatToBytes(value)
-	return store.db.Put(keyBs, valBs, nil)
+// delete adds the removal of key to batch
+func (store *LevelDBStorage) delete(batch *leveldb.Batch, key string) {
+	batch.Delete([]byte("kv/" + key))
+	batch.Delete([]byte("ttl/" + key))
+	batch.Delete([]byte("ver/" + key))
 }
 
-// GetRange returns a channel which will give all values in a timerange
-func (store *LevelDBStorage) GetRange(key string, from time.Time, to time.Time) (chan *TimeSeriesEntry, error) {
-	ch := make(chan *TimeSeriesEntry, 64)
-	startKey := []byte(fmt.Sprintf("ts/%v%v", key, from.UnixNano()))
-	endKey := []byte(fmt.Sprintf("ts/%v%v", key, to.UnixNano()))
-	iter := store.db.NewIterator(&util.Range{Start: startKey, Limit: endKey}, nil)
+// isExpired checks if key has a ttl which is over
+func (store *LevelDBStorage) isExpired(reader leveldb.Reader, key string, now time.Time) bool {
+	expiry, err := reader.Get([]byte("ttl/"+key), nil)
+	if err != nil {
+		return false
+	}
+	return isExpired(expiry, now)
+}
+
+// sweepExpired removes all expired entries
+func (store *LevelDBStorage) sweepExpired() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	iter := store.db.NewIterator(util.BytesPrefix([]byte("ttl/")), nil)
+	defer iter.Release()
+	now := time.Now()
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		if isExpired(iter.Value(), now) {
+			store.delete(batch, string(iter.Key()[4:]))
+		}
+	}
 	if err := iter.Error(); err != nil {
-		return nil, err
+		return levelDBError(err)
 	}
-	go func() {
-		for iter.Next() {
-			keyBs := iter.Key()
-			valBs := iter.Value()
-			nanos, err := strconv.ParseInt(string(keyBs[len(key)+3:]), 10, 64)
-			if err != nil {
-				continue
+	return levelDBError(store.db.Write(batch, nil))
+}
+
+// ListContext returns all keys starting with prefix
+func (store *LevelDBStorage) ListContext(ctx context.Context, prefix string) ([]string, error) {
+	return store.ScanContext(ctx, prefix, PrefixEnd(prefix), 0)
+}
+
+// ScanContext returns at most limit keys in the range [start, end)
+func (store *LevelDBStorage) ScanContext(ctx context.Context, start, end string, limit int) ([]string, error) {
+	rng := util.BytesPrefix([]byte("kv/"))
+	rng.Start = []byte("kv/" + start)
+	if end != "" {
+		rng.Limit = []byte("kv/" + end)
+	}
+	snapshot, err := store.db.GetSnapshot()
+	if err != nil {
+		return nil, levelDBError(err)
+	}
+	defer snapshot.Release()
+	iter := snapshot.NewIterator(rng, nil)
+	defer iter.Release()
+	now := time.Now()
+	keys := []string{}
+	for (limit <= 0 || len(keys) < limit) && iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		key := string(iter.Key()[3:])
+		if !store.isExpired(snapshot, key, now) {
+			keys = append(keys, key)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, levelDBError(err)
+	}
+	return keys, nil
+}
+
+// AddValueContext saves a value to the given timeseries
+func (store *LevelDBStorage) AddValueContext(ctx context.Context, key string, value float64) error {
+	return store.AddValuesContext(ctx, key, []*TimeSeriesEntry{{Value: value, Timestamp: time.Now()}})
+}
+
+// AddValuesContext saves multiple values to the given timeseries in a single batch
+func (store *LevelDBStorage) AddValuesContext(ctx context.Context, key string, entries []*TimeSeriesEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	batch := new(leveldb.Batch)
+	if err := store.addValues(batch, key, entries, make(map[string]uint32)); err != nil {
+		return err
+	}
+	return levelDBError(store.db.Write(batch, nil))
+}
+
+// addValues adds the writes of entries to batch, already used timestamps are handled by the duplicate policy of key.
+// pending holds the next sequence number of the timestamps written to batch before. The caller must hold the mutex.
+func (store *LevelDBStorage) addValues(batch *leveldb.Batch, key string, entries []*TimeSeriesEntry, pending map[string]uint32) error {
+	policy := store.policyFor(key)
+	for _, entry := range entries {
+		k := levelDBSeriesKey(key, entry.Timestamp)
+		if policy == DuplicateOverwrite {
+			batch.Put(k, encodeEntryValue(entry))
+			continue
+		}
+		seq, ok := pending[string(k)]
+		if !ok {
+			var err error
+			if seq, err = store.nextSequence(k); err != nil {
+				return err
 			}
-			stamp := time.Unix(0, nanos)
-			ch <- &TimeSeriesEntry{BytesToFloat(valBs), stamp}
 		}
-		iter.Release()
-		close(ch)
-	}()
-	return ch, nil
+		if seq > 0 && policy == DuplicateReject {
+			return duplicateTimestamp(key, entry.Timestamp)
+		}
+		batch.Put(appendSequence(k, seq), encodeEntryValue(entry))
+		pending[string(k)] = seq + 1
+	}
+	return nil
+}
+
+// nextSequence returns the sequence number of the next value at the entry key k, it is 0 if k is unused
+func (store *LevelDBStorage) nextSequence(k []byte) (uint32, error) {
+	iter := store.db.NewIterator(util.BytesPrefix(k), nil)
+	defer iter.Release()
+	if !iter.Last() {
+		return 0, levelDBError(iter.Error())
+	}
+	return decodeSequence(iter.Key()[len(k):]) + 1, nil
+}
+
+// levelDBSeriesPrefix returns the prefix of all entries of a timeseries.
+// It is "ts/" followed by the length of key as uvarint and key itself,
+// so that the entries of a timeseries never overlap with the ones of a timeseries with a longer key.
+func levelDBSeriesPrefix(key string) []byte {
+	prefix := append([]byte("ts/"), binary.AppendUvarint(nil, uint64(len(key)))...)
+	return append(prefix, key...)
 }
 
-func (store *LevelDBStorage) DeleteRange(key string, from time.Time, to time.Time) error {
-	startKey := []byte(fmt.Sprintf("ts/%v%v", key, from.UnixNano()))
-	endKey := []byte(fmt.Sprintf("ts/%v%v", key, to.UnixNano()))
-	iter := store.db.NewIterator(&util.Range{Start: startKey, Limit: endKey}, nil)
+// levelDBSeriesKey returns the key of the entry of a timeseries at stamp.
+// Kept duplicates have a sequence number behind it.
+func levelDBSeriesKey(key string, stamp time.Time) []byte {
+	return append(levelDBSeriesPrefix(key), encodeTimestamp(stamp)...)
+}
+
+// levelDBSeriesRange returns the range of the entries of a timeseries between from and to (inclusive)
+func levelDBSeriesRange(key string, from, to time.Time) *util.Range {
+	// the limit includes the duplicates at to
+	return &util.Range{Start: levelDBSeriesKey(key, from), Limit: []byte(PrefixEnd(string(levelDBSeriesKey(key, to))))}
+}
+
+// levelDBSeriesOf returns the timeseries key of an entry key
+func levelDBSeriesOf(bs []byte) (string, bool) {
+	bs = bs[3:]
+	length, n := binary.Uvarint(bs)
+	if n <= 0 || uint64(len(bs)-n) != length+8 && uint64(len(bs)-n) != length+12 {
+		return "", false
+	}
+	return string(bs[n : n+int(length)]), true
+}
+
+// GetRangeContext returns an iterator over all values in a timerange
+func (store *LevelDBStorage) GetRangeContext(ctx context.Context, key string, from time.Time, to time.Time) (Iterator, error) {
+	iter := store.db.NewIterator(levelDBSeriesRange(key, from, to), nil)
 	if err := iter.Error(); err != nil {
-		return err
+		iter.Release()
+		return nil, levelDBError(err)
 	}
+	offset := len(levelDBSeriesPrefix(key))
+	return newFuncIterator(ctx, func() (*TimeSeriesEntry, error) {
+		if iter.Next() {
+			stamp := decodeTimestamp(iter.Key()[offset : offset+8])
+			value, fields := decodeEntryValue(iter.Value())
+			return &TimeSeriesEntry{Value: value, Timestamp: stamp, Fields: fields}, nil
+		}
+		return nil, levelDBError(iter.Error())
+	}, func() error {
+		iter.Release()
+		return nil
+	}), nil
+}
+
+// DeleteRangeContext deletes a range from a timeseries in a single batch
+func (store *LevelDBStorage) DeleteRangeContext(ctx context.Context, key string, from time.Time, to time.Time) error {
+	iter := store.db.NewIterator(levelDBSeriesRange(key, from, to), nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
 	for iter.Next() {
-		err := store.db.Delete(iter.Key(), nil)
-		if err != nil {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
+		batch.Delete(iter.Key())
 	}
-	iter.Release()
-	return nil
+	if err := iter.Error(); err != nil {
+		return levelDBError(err)
+	}
+	return levelDBError(store.db.Write(batch, nil))
 }
 
-// Close closes the db, flushing it eventually
+// ListSeriesContext returns the keys of all timeseries starting with prefix
+// The keys are ordered by length in the db, so all timeseries have to be visited.
+// The iterator skips to the next timeseries after reading the first entry of each.
+func (store *LevelDBStorage) ListSeriesContext(ctx context.Context, prefix string) ([]string, error) {
+	iter := store.db.NewIterator(util.BytesPrefix([]byte("ts/")), nil)
+	defer iter.Release()
+	keys := []string{}
+	for ok := iter.First(); ok; {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		key, valid := levelDBSeriesOf(iter.Key())
+		if !valid {
+			ok = iter.Next()
+			continue
+		}
+		keys = append(keys, key)
+		ok = iter.Seek([]byte(PrefixEnd(string(levelDBSeriesPrefix(key)))))
+	}
+	if err := iter.Error(); err != nil {
+		return nil, levelDBError(err)
+	}
+	result := []string{}
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// AggregateContext returns one aggregated value per step in a timerange
+func (store *LevelDBStorage) AggregateContext(ctx context.Context, key string, from time.Time, to time.Time, step time.Duration, agg Aggregation) (Iterator, error) {
+	return aggregateRange(ctx, store, key, from, to, step, agg)
+}
+
+// CommitContext applies all operations of txn in a single batch
+func (store *LevelDBStorage) CommitContext(ctx context.Context, txn *Txn) error {
+	_, err := store.commitVersioned(ctx, txn)
+	return err
+}
+
+// commitVersioned commits txn and returns the new versions of the keys written by its put operations
+func (store *LevelDBStorage) commitVersioned(ctx context.Context, txn *Txn) ([]uint64, error) {
+	if err := txn.Validate(); err != nil {
+		return nil, err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, op := range txn.Ops {
+		if op.IsGuard() {
+			_, version, err := store.get(store.db, op.Key)
+			if !checkGuard(op, err == nil, version) {
+				return nil, ErrGuardFailed
+			}
+		}
+	}
+	now := time.Now()
+	batch := new(leveldb.Batch)
+	pending := make(map[string]uint32)
+	versions := make([]uint64, len(txn.Ops))
+	for i, op := range txn.Ops {
+		switch op.Type {
+		case TxnPut:
+			versions[i] = store.put(batch, op.Key, op.Value, nil)
+		case TxnDelete:
+			store.delete(batch, op.Key)
+		case TxnAddValue:
+			if err := store.addValues(batch, op.Key, []*TimeSeriesEntry{entryWithStamp(op, now)}, pending); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := store.db.Write(batch, nil); err != nil {
+		return nil, levelDBError(err)
+	}
+	return versions, nil
+}
+
+// Close closes the db, flushing it eventually. Closing it again returns the result of the first call.
 func (store *LevelDBStorage) Close() error {
-	return store.db.Close()
+	return store.closeOnce.do(func() error {
+		close(store.stop)
+		return store.db.Close()
+	})
+}
+
+// levelDBError wraps the errors of leveldb into the errors of this package
+func levelDBError(err error) error {
+	switch {
+	case err == leveldb.ErrNotFound:
+		return wrapError(ErrNotFound, err)
+	case err == leveldb.ErrClosed, errors.IsCorrupted(err):
+		return wrapError(ErrBackendUnavailable, err)
+	}
+	return err
 }
@@ -0,0 +1,477 @@
+package storage
+
+import (
+	"context"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage is an in-memory implementation for KeyValueStorage and TimeSeriesStorage
+// If a snapshot path is given, the content is loaded from it on creation and written to it on Close.
+type MemoryStorage struct {
+	noContext
+	duplicateRules
+	mutex     sync.RWMutex
+	kv        *memoryNode
+	series    map[string][]*TimeSeriesEntry
+	revision  uint64
+	snapshot  string
+	stop      chan struct{}
+	closeOnce closeOnce
+}
+
+// memoryNode holds the kv entries of one level of the key hierarchy, keys are split at slashes
+type memoryNode struct {
+	Children map[string]*memoryNode
+	Entries  map[string]*memoryEntry
+}
+
+type memoryEntry struct {
+	Value   []byte
+	Version uint64
+	Expires time.Time
+}
+
+// memorySnapshot is the on-disk format of a MemoryStorage
+type memorySnapshot struct {
+	KV       *memoryNode
+	Series   map[string][]*TimeSeriesEntry
+	Revision uint64
+}
+
+func newMemoryNode() *memoryNode {
+	return &memoryNode{make(map[string]*memoryNode), make(map[string]*memoryEntry)}
+}
+
+func (entry *memoryEntry) isExpired(now time.Time) bool {
+	return !entry.Expires.IsZero() && !entry.Expires.After(now)
+}
+
+// NewMemoryStorage creates a new storage instance, snapshot is the optional path of a snapshot file
+func NewMemoryStorage(snapshot string) (*MemoryStorage, error) {
+	store := &MemoryStorage{
+		kv:       newMemoryNode(),
+		series:   make(map[string][]*TimeSeriesEntry),
+		snapshot: snapshot,
+		stop:     make(chan struct{}),
+	}
+	store.noContext = noContext{store}
+	if snapshot != "" {
+		if err := store.load(); err != nil {
+			return nil, err
+		}
+	}
+	go runSweeper(store.sweepExpired, store.stop)
+	return store, nil
+}
+
+func (store *MemoryStorage) load() error {
+	f, err := os.Open(store.snapshot)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	snapshot := &memorySnapshot{}
+	if err := gob.NewDecoder(f).Decode(snapshot); err != nil {
+		return err
+	}
+	if snapshot.KV != nil {
+		store.kv = snapshot.KV
+	}
+	if snapshot.Series != nil {
+		store.series = snapshot.Series
+	}
+	store.revision = snapshot.Revision
+	return nil
+}
+
+// save writes the snapshot to a temporary file in the same directory and renames it over the old snapshot,
+// so that the old snapshot stays intact if writing fails
+func (store *MemoryStorage) save() error {
+	f, err := os.CreateTemp(filepath.Dir(store.snapshot), filepath.Base(store.snapshot)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&memorySnapshot{store.kv, store.series, store.revision})
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), store.snapshot)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// getNode returns the node and the last key part for key, missing nodes are created if create is set
+func (store *MemoryStorage) getNode(key string, create bool) (*memoryNode, string) {
+	parts := strings.Split(key, "/")
+	node := store.kv
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := node.Children[part]
+		if !ok {
+			if !create {
+				return nil, ""
+			}
+			child = newMemoryNode()
+			node.Children[part] = child
+		}
+		node = child
+	}
+	return node, parts[len(parts)-1]
+}
+
+// get returns the entry for key if it exists and is not expired, the caller must hold the mutex
+func (store *MemoryStorage) get(key string) *memoryEntry {
+	node, k := store.getNode(key, false)
+	if node == nil {
+		return nil
+	}
+	entry, ok := node.Entries[k]
+	if !ok || entry.isExpired(time.Now()) {
+		return nil
+	}
+	return entry
+}
+
+// put saves a value and returns its new version, the caller must hold the write lock
+func (store *MemoryStorage) put(key string, value []byte, expires time.Time) uint64 {
+	node, k := store.getNode(key, true)
+	store.revision++
+	node.Entries[k] = &memoryEntry{append([]byte{}, value...), store.revision, expires}
+	return store.revision
+}
+
+// delete removes key and returns if it existed, the caller must hold the write lock
+func (store *MemoryStorage) delete(key string) bool {
+	node, k := store.getNode(key, false)
+	if node == nil {
+		return false
+	}
+	_, ok := node.Entries[k]
+	delete(node.Entries, k)
+	return ok
+}
+
+// PutContext saves a value to the store
+func (store *MemoryStorage) PutContext(ctx context.Context, key string, value []byte) error {
+	_, err := store.putVersioned(ctx, key, value, time.Time{})
+	return err
+}
+
+// PutWithTTLContext saves a value to the store which expires after ttl
+func (store *MemoryStorage) PutWithTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := store.putVersioned(ctx, key, value, time.Now().Add(ttl))
+	return err
+}
+
+// putVersioned saves a value which expires at expires unless it is zero and returns its new version
+func (store *MemoryStorage) putVersioned(ctx context.Context, key string, value []byte, expires time.Time) (uint64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.put(key, value, expires), nil
+}
+
+// CompareAndSwapContext saves a value if the current version of key is expectedVersion
+func (store *MemoryStorage) CompareAndSwapContext(ctx context.Context, key string, expectedVersion uint64, value []byte) (uint64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	entry := store.get(key)
+	if entry == nil && !versionMatches(false, 0, expectedVersion) || entry != nil && !versionMatches(true, entry.Version, expectedVersion) {
+		return 0, ErrVersionMismatch
+	}
+	return store.put(key, value, time.Time{}), nil
+}
+
+// GetContext retrieves a value from the store
+func (store *MemoryStorage) GetContext(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := store.GetVersionedContext(ctx, key)
+	return value, err
+}
+
+// GetVersionedContext retrieves a value and its version from the store
+func (store *MemoryStorage) GetVersionedContext(ctx context.Context, key string) ([]byte, uint64, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	entry := store.get(key)
+	if entry == nil {
+		return nil, 0, notFound(key)
+	}
+	return append([]byte{}, entry.Value...), entry.Version, nil
+}
+
+// DeleteContext drops an entry from the store
+func (store *MemoryStorage) DeleteContext(ctx context.Context, key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	// expired entries are left to the sweeper
+	if store.get(key) == nil {
+		return notFound(key)
+	}
+	store.delete(key)
+	return nil
+}
+
+// CompareAndDeleteContext drops an entry from the store if its current version is expectedVersion
+func (store *MemoryStorage) CompareAndDeleteContext(ctx context.Context, key string, expectedVersion uint64) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	entry := store.get(key)
+	if entry == nil || !versionMatches(true, entry.Version, expectedVersion) {
+		return ErrVersionMismatch
+	}
+	store.delete(key)
+	return nil
+}
+
+// ListContext returns all keys starting with prefix
+func (store *MemoryStorage) ListContext(ctx context.Context, prefix string) ([]string, error) {
+	return store.ScanContext(ctx, prefix, PrefixEnd(prefix), 0)
+}
+
+// ScanContext returns at most limit keys in the range [start, end)
+func (store *MemoryStorage) ScanContext(ctx context.Context, start, end string, limit int) ([]string, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	keys := []string{}
+	store.walkNode(store.kv, "", start, end, time.Now(), func(key string) {
+		keys = append(keys, key)
+	})
+	sort.Strings(keys)
+	return limitKeys(keys, limit), nil
+}
+
+// walkNode calls fn for every unexpired key in the range [start, end) stored in node or one of its children
+func (store *MemoryStorage) walkNode(node *memoryNode, prefix, start, end string, now time.Time, fn func(key string)) {
+	for k, entry := range node.Entries {
+		if key := prefix + k; keyInRange(key, start, end) && !entry.isExpired(now) {
+			fn(key)
+		}
+	}
+	for k, child := range node.Children {
+		if sub := prefix + k + "/"; prefixInRange(sub, start, end) {
+			store.walkNode(child, sub, start, end, now, fn)
+		}
+	}
+}
+
+// sweepExpired removes all expired entries
+func (store *MemoryStorage) sweepExpired() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.sweepNode(store.kv, time.Now())
+	return nil
+}
+
+func (store *MemoryStorage) sweepNode(node *memoryNode, now time.Time) {
+	for k, entry := range node.Entries {
+		if entry.isExpired(now) {
+			delete(node.Entries, k)
+		}
+	}
+	for _, child := range node.Children {
+		store.sweepNode(child, now)
+	}
+}
+
+// AddValueContext saves a value to the given timeseries
+func (store *MemoryStorage) AddValueContext(ctx context.Context, key string, value float64) error {
+	return store.AddValuesContext(ctx, key, []*TimeSeriesEntry{{Value: value, Timestamp: time.Now()}})
+}
+
+// AddValuesContext saves multiple values to the given timeseries
+func (store *MemoryStorage) AddValuesContext(ctx context.Context, key string, entries []*TimeSeriesEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.checkDuplicates(key, entries); err != nil {
+		return err
+	}
+	store.addValues(key, entries)
+	return nil
+}
+
+// checkDuplicates returns ErrDuplicateTimestamp if key has the reject policy and entries use one of its timestamps
+// or a timestamp twice. It is called before anything is written, so that rejected writes change nothing.
+func (store *MemoryStorage) checkDuplicates(key string, entries []*TimeSeriesEntry) error {
+	if store.policyFor(key) != DuplicateReject {
+		return nil
+	}
+	series := store.series[key]
+	seen := make(map[int64]bool)
+	for _, entry := range entries {
+		stamp := entry.Timestamp.UnixNano()
+		idx := sort.Search(len(series), func(i int) bool {
+			return series[i].Timestamp.UnixNano() >= stamp
+		})
+		if seen[stamp] || idx < len(series) && series[idx].Timestamp.UnixNano() == stamp {
+			return duplicateTimestamp(key, entry.Timestamp)
+		}
+		seen[stamp] = true
+	}
+	return nil
+}
+
+// addValues inserts entries keeping the timeseries sorted, the caller must hold the write lock.
+// Like in the other backends an entry with an existing timestamp replaces the old one,
+// unless key has the keep policy which inserts it behind the existing ones.
+func (store *MemoryStorage) addValues(key string, entries []*TimeSeriesEntry) {
+	keep := store.policyFor(key) == DuplicateKeep
+	series := store.series[key]
+	for _, entry := range entries {
+		stamp := entry.Timestamp.UnixNano()
+		idx := sort.Search(len(series), func(i int) bool {
+			return series[i].Timestamp.UnixNano() >= stamp
+		})
+		copied := &TimeSeriesEntry{Value: entry.Value, Timestamp: time.Unix(0, stamp), Fields: copyFields(entry.Fields)}
+		if idx < len(series) && series[idx].Timestamp.UnixNano() == stamp {
+			if !keep {
+				series[idx] = copied
+				continue
+			}
+			for idx < len(series) && series[idx].Timestamp.UnixNano() == stamp {
+				idx++
+			}
+		}
+		series = append(series, nil)
+		copy(series[idx+1:], series[idx:])
+		series[idx] = copied
+	}
+	store.series[key] = series
+}
+
+// rangeIndexes returns the slice indexes of all entries between from and to (inclusive)
+func rangeIndexes(series []*TimeSeriesEntry, from, to time.Time) (int, int) {
+	start := sort.Search(len(series), func(i int) bool {
+		return series[i].Timestamp.UnixNano() >= from.UnixNano()
+	})
+	end := sort.Search(len(series), func(i int) bool {
+		return series[i].Timestamp.UnixNano() > to.UnixNano()
+	})
+	if end < start {
+		end = start
+	}
+	return start, end
+}
+
+// GetRangeContext returns an iterator over all values in a timerange
+// The iterator works on a copy of the range taken when it is created.
+func (store *MemoryStorage) GetRangeContext(ctx context.Context, key string, from time.Time, to time.Time) (Iterator, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	series := store.series[key]
+	start, end := rangeIndexes(series, from, to)
+	entries := make([]*TimeSeriesEntry, 0, end-start)
+	for _, entry := range series[start:end] {
+		entries = append(entries, &TimeSeriesEntry{Value: entry.Value, Timestamp: entry.Timestamp, Fields: copyFields(entry.Fields)})
+	}
+	return newSliceIterator(ctx, entries), nil
+}
+
+// DeleteRangeContext deletes a range from a timeseries
+func (store *MemoryStorage) DeleteRangeContext(ctx context.Context, key string, from time.Time, to time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	series, ok := store.series[key]
+	if !ok {
+		return notFound(key)
+	}
+	start, end := rangeIndexes(series, from, to)
+	store.series[key] = append(series[:start], series[end:]...)
+	return nil
+}
+
+// ListSeriesContext returns the keys of all timeseries starting with prefix
+func (store *MemoryStorage) ListSeriesContext(ctx context.Context, prefix string) ([]string, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	keys := []string{}
+	for key, series := range store.series {
+		if strings.HasPrefix(key, prefix) && len(series) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// AggregateContext returns one aggregated value per step in a timerange
+func (store *MemoryStorage) AggregateContext(ctx context.Context, key string, from time.Time, to time.Time, step time.Duration, agg Aggregation) (Iterator, error) {
+	return aggregateRange(ctx, store, key, from, to, step, agg)
+}
+
+// CommitContext applies all operations of txn while holding the write lock
+func (store *MemoryStorage) CommitContext(ctx context.Context, txn *Txn) error {
+	_, err := store.commitVersioned(ctx, txn)
+	return err
+}
+
+// commitVersioned commits txn and returns the new versions of the keys written by its put operations
+func (store *MemoryStorage) commitVersioned(ctx context.Context, txn *Txn) ([]uint64, error) {
+	if err := txn.Validate(); err != nil {
+		return nil, err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, op := range txn.Ops {
+		if op.IsGuard() {
+			entry := store.get(op.Key)
+			var version uint64
+			if entry != nil {
+				version = entry.Version
+			}
+			if !checkGuard(op, entry != nil, version) {
+				return nil, ErrGuardFailed
+			}
+		}
+	}
+	now := time.Now()
+	added := make(map[string][]*TimeSeriesEntry)
+	for _, op := range txn.Ops {
+		if op.Type == TxnAddValue {
+			added[op.Key] = append(added[op.Key], entryWithStamp(op, now))
+		}
+	}
+	for key, entries := range added {
+		if err := store.checkDuplicates(key, entries); err != nil {
+			return nil, err
+		}
+	}
+	versions := make([]uint64, len(txn.Ops))
+	for i, op := range txn.Ops {
+		switch op.Type {
+		case TxnPut:
+			versions[i] = store.put(op.Key, op.Value, time.Time{})
+		case TxnDelete:
+			store.delete(op.Key)
+		case TxnAddValue:
+			store.addValues(op.Key, []*TimeSeriesEntry{entryWithStamp(op, now)})
+		}
+	}
+	return versions, nil
+}
+
+// Close stops the sweeper and writes the snapshot if configured. Closing it again returns the result of the first call.
+func (store *MemoryStorage) Close() error {
+	return store.closeOnce.do(func() error {
+		close(store.stop)
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+		if store.snapshot == "" {
+			return nil
+		}
+		return store.save()
+	})
+}
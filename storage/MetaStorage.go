@@ -1,21 +1,28 @@
 package storage
 
 import (
-	"errors"
+	"context"
 	"net/url"
+	"strings"
 	"time"
 )
 
 // MetaStorage wraps a specific storage
+// It implements the features which are independent of the backend, like watching for changes.
 type MetaStorage struct {
-	base Storage
+	noContext
+	base    Storage
+	writer  versionedWriter
+	watches *watchHub
+	follows *watchHub
+	locks   seriesLocks
 }
 
 // NewMetaStorage returns a new Storage object with the correct implementation for the given URI
 func NewMetaStorage(uriStr string) (Storage, error) {
 	uri, err := url.Parse(uriStr)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(ErrInvalidArgument, err)
 	}
 	var base Storage
 	switch uri.Scheme {
@@ -25,37 +32,280 @@ func NewMetaStorage(uriStr string) (Storage, error) {
 		base, err = NewBoltStorage(uri.Host + uri.Path)
 	case "mongodb":
 		base, err = NewMongoStorage(uriStr)
+	case "memory":
+		base, err = NewMemoryStorage(uri.Host + uri.Path)
 	default:
-		err = errors.New("unknown uri scheme, try bolt:// or leveldb://")
+		err = invalidArgument("unknown uri scheme, try bolt://, leveldb://, mongodb:// or memory://")
+	}
+	if err != nil {
+		return nil, err
+	}
+	store := &MetaStorage{base: base, writer: base.(versionedWriter), watches: newWatchHub(), follows: newWatchHub()}
+	store.noContext = noContext{store}
+	if err := store.buildCatalog(context.Background()); err != nil {
+		base.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *MetaStorage) PutContext(ctx context.Context, key string, value []byte) error {
+	if err := checkKey(ctx, key); err != nil {
+		return err
+	}
+	unlock := store.locks.lock(key)
+	defer unlock()
+	version, err := store.writer.putVersioned(ctx, key, value, time.Time{})
+	if err != nil {
+		return err
 	}
+	store.publishPut(key, value, version)
+	return nil
+}
+
+func (store *MetaStorage) PutWithTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := checkKey(ctx, key); err != nil {
+		return err
+	}
+	unlock := store.locks.lock(key)
+	defer unlock()
+	version, err := store.writer.putVersioned(ctx, key, value, time.Now().Add(ttl))
 	if err != nil {
+		return err
+	}
+	store.publishPut(key, value, version)
+	return nil
+}
+
+func (store *MetaStorage) GetContext(ctx context.Context, key string) ([]byte, error) {
+	if err := checkKey(ctx, key); err != nil {
 		return nil, err
 	}
-	return &MetaStorage{base}, nil
+	return store.base.GetContext(ctx, key)
+}
+
+func (store *MetaStorage) GetVersionedContext(ctx context.Context, key string) ([]byte, uint64, error) {
+	if err := checkKey(ctx, key); err != nil {
+		return nil, 0, err
+	}
+	return store.base.GetVersionedContext(ctx, key)
 }
 
-func (store *MetaStorage) Put(key string, value []byte) error {
-	return store.base.Put(key, value)
+func (store *MetaStorage) CompareAndSwapContext(ctx context.Context, key string, expectedVersion uint64, value []byte) (uint64, error) {
+	if err := checkKey(ctx, key); err != nil {
+		return 0, err
+	}
+	unlock := store.locks.lock(key)
+	defer unlock()
+	version, err := store.base.CompareAndSwapContext(ctx, key, expectedVersion, value)
+	if err != nil {
+		return 0, err
+	}
+	store.publishPut(key, value, version)
+	return version, nil
+}
+
+func (store *MetaStorage) DeleteContext(ctx context.Context, key string) error {
+	if err := checkKey(ctx, key); err != nil {
+		return err
+	}
+	unlock := store.locks.lock(key)
+	defer unlock()
+	if err := store.base.DeleteContext(ctx, key); err != nil {
+		return err
+	}
+	store.watches.publish(&Event{Type: EventDelete, Key: key})
+	return nil
+}
+
+func (store *MetaStorage) CompareAndDeleteContext(ctx context.Context, key string, expectedVersion uint64) error {
+	if err := checkKey(ctx, key); err != nil {
+		return err
+	}
+	unlock := store.locks.lock(key)
+	defer unlock()
+	if err := store.base.CompareAndDeleteContext(ctx, key, expectedVersion); err != nil {
+		return err
+	}
+	store.watches.publish(&Event{Type: EventDelete, Key: key})
+	return nil
 }
 
-func (store *MetaStorage) Get(key string) ([]byte, error) {
-	return store.base.Get(key)
+// Watch returns a channel which receives an event for every change of a key starting with prefix
+// Changes done by the backends themselves, like the removal of expired entries, are not reported.
+func (store *MetaStorage) Watch(prefix string) (<-chan *Event, func()) {
+	return store.watches.watch(prefix, false)
 }
 
-func (store *MetaStorage) Delete(key string) error {
-	return store.base.Delete(key)
+// Follow returns a channel which receives an event for every entry added to the timeseries key
+// A key ending with '*' follows all timeseries with the given prefix.
+func (store *MetaStorage) Follow(key string) (<-chan *Event, func()) {
+	if strings.HasSuffix(key, "*") {
+		return store.follows.watch(key[:len(key)-1], false)
+	}
+	return store.follows.watch(key, true)
+}
+
+func (store *MetaStorage) publishEntries(key string, entries []*TimeSeriesEntry) {
+	for _, entry := range entries {
+		store.follows.publish(&Event{Type: EventAddValue, Key: key, Entry: entry})
+	}
 }
 
-func (store *MetaStorage) AddValue(key string, value float64) error {
-	return store.base.AddValue(key, value)
+// versionedWriter is implemented by all backends, so that the written versions are reported to the watchers
+// without reading the keys back
+type versionedWriter interface {
+	// putVersioned saves a value which expires at expires unless it is zero and returns its new version
+	putVersioned(ctx context.Context, key string, value []byte, expires time.Time) (uint64, error)
+	// commitVersioned commits txn and returns the new versions of the keys written by its put operations,
+	// the versions are indexed like the operations
+	commitVersioned(ctx context.Context, txn *Txn) ([]uint64, error)
 }
 
-func (store *MetaStorage) GetRange(key string, from time.Time, to time.Time) (chan *TimeSeriesEntry, error) {
-	return store.base.GetRange(key, from, to)
+// publishPut reports a written value of key and its version to the watchers, the value is copied
+// because the caller may reuse it. The caller holds the lock of key, so that the versions are published in order.
+func (store *MetaStorage) publishPut(key string, value []byte, version uint64) {
+	store.watches.publish(&Event{Type: EventPut, Key: key, Value: append([]byte{}, value...), Version: version})
 }
-func (store *MetaStorage) DeleteRange(key string, from time.Time, to time.Time) error {
-	return store.base.DeleteRange(key, from, to)
+
+func (store *MetaStorage) ListContext(ctx context.Context, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return store.base.ListContext(ctx, prefix)
+}
+
+func (store *MetaStorage) ScanContext(ctx context.Context, start, end string, limit int) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return store.base.ScanContext(ctx, start, end, limit)
+}
+
+func (store *MetaStorage) AddValueContext(ctx context.Context, key string, value float64) error {
+	// the backends stamp the value themselves, so stamp it here to know the timestamp of the new entry
+	return store.AddValuesContext(ctx, key, []*TimeSeriesEntry{{Value: value, Timestamp: time.Now()}})
+}
+
+func (store *MetaStorage) AddValuesContext(ctx context.Context, key string, entries []*TimeSeriesEntry) error {
+	if err := checkKey(ctx, key); err != nil {
+		return err
+	}
+	if err := validateSeriesKey(key); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := validateFields(entry); err != nil {
+			return err
+		}
+	}
+	// the values are committed together with the catalog entry of the timeseries
+	txn := &Txn{make([]*TxnOp, len(entries))}
+	for i, entry := range entries {
+		txn.Ops[i] = &TxnOp{Type: TxnAddValue, Key: key, Entry: entry}
+	}
+	unlock := store.locks.lock(key)
+	defer unlock()
+	if _, err := store.commitWithCatalog(ctx, txn); err != nil {
+		return err
+	}
+	store.publishEntries(key, entries)
+	return nil
+}
+
+func (store *MetaStorage) GetRangeContext(ctx context.Context, key string, from time.Time, to time.Time) (Iterator, error) {
+	if err := checkKey(ctx, key); err != nil {
+		return nil, err
+	}
+	return store.base.GetRangeContext(ctx, key, from, to)
+}
+func (store *MetaStorage) DeleteRangeContext(ctx context.Context, key string, from time.Time, to time.Time) error {
+	if err := checkKey(ctx, key); err != nil {
+		return err
+	}
+	return store.deleteRangeWithCatalog(ctx, key, from, to, true)
+}
+
+// ListSeriesContext returns the keys of the timeseries starting with prefix.
+// The timeseries in the reserved namespace, like rollups, are only listed if prefix is in it.
+func (store *MetaStorage) ListSeriesContext(ctx context.Context, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	keys, err := store.base.ListSeriesContext(ctx, prefix)
+	if err != nil || IsReserved(prefix) {
+		return keys, err
+	}
+	res := keys[:0]
+	for _, key := range keys {
+		if !IsReserved(key) {
+			res = append(res, key)
+		}
+	}
+	return res, nil
+}
+func (store *MetaStorage) AggregateContext(ctx context.Context, key string, from time.Time, to time.Time, step time.Duration, agg Aggregation) (Iterator, error) {
+	if err := checkKey(ctx, key); err != nil {
+		return nil, err
+	}
+	return store.base.AggregateContext(ctx, key, from, to, step, agg)
+}
+func (store *MetaStorage) CommitContext(ctx context.Context, txn *Txn) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := txn.Validate(); err != nil {
+		return err
+	}
+	// stamp new timeseries entries here to know their timestamps
+	stamped := &Txn{make([]*TxnOp, len(txn.Ops))}
+	now := time.Now()
+	for i, op := range txn.Ops {
+		stamped.Ops[i] = op
+		if op.Type == TxnAddValue && op.Entry != nil {
+			stampedOp := *op
+			stampedOp.Entry = entryWithStamp(op, now)
+			stamped.Ops[i] = &stampedOp
+		}
+	}
+	keys := make([]string, 0, len(stamped.Ops))
+	for _, op := range stamped.Ops {
+		if !op.IsGuard() {
+			keys = append(keys, op.Key)
+		}
+	}
+	unlock := store.locks.lock(keys...)
+	defer unlock()
+	versions, err := store.commitWithCatalog(ctx, stamped)
+	if err != nil {
+		return err
+	}
+	for i, op := range stamped.Ops {
+		switch op.Type {
+		case TxnAddValue:
+			store.publishEntries(op.Key, []*TimeSeriesEntry{op.Entry})
+		case TxnPut:
+			store.publishPut(op.Key, op.Value, versions[i])
+		case TxnDelete:
+			store.watches.publish(&Event{Type: EventDelete, Key: op.Key})
+		}
+	}
+	return nil
+}
+func (store *MetaStorage) SetDuplicateRules(rules []*DuplicateRule) {
+	store.base.SetDuplicateRules(rules)
+}
+func (store *MetaStorage) DuplicateRules() []*DuplicateRule {
+	return store.base.DuplicateRules()
 }
 func (store *MetaStorage) Close() error {
 	return store.base.Close()
 }
+
+// checkKey is called before every operation on key, it fails if ctx is already done or key is invalid
+func checkKey(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return validateKey(key)
+}
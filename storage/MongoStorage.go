@@ -1,7 +1,16 @@
 package storage
 
 import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	neturl "net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	mgo "gopkg.in/mgo.v2"
@@ -9,121 +18,611 @@ import (
 )
 
 // MongoStorage is an implementation for KeyValueStorage and TimeSeriesStorage
+// Every operation works on a copy of the session, so that concurrent operations use their own sockets.
 type MongoStorage struct {
+	noContext
+	duplicateRules
 	db      *mgo.Database
 	session *mgo.Session
+	// indexed holds the names of the collections whose indexes are already ensured
+	indexed sync.Map
 }
 
 type kvEntry struct {
-	Key   string `bson:"k"`
-	Value []byte `bson:"v"`
+	Key      string     `bson:"k"`
+	Value    []byte     `bson:"v"`
+	Expires  *time.Time `bson:"e,omitempty"`
+	Revision int64      `bson:"r"`
 }
 
+// tsEntry is a value of a timeseries, kept duplicates are numbered by Seq starting with 1
 type tsEntry struct {
-	Key   int64   `bson:"k"`
-	Value float64 `bson:"v"`
+	Key    int64              `bson:"k"`
+	Seq    int64              `bson:"s,omitempty"`
+	Value  float64            `bson:"v"`
+	Fields map[string]float64 `bson:"f,omitempty"`
 }
 
-// NewMongoStorage creates a new storage with mongodb as its backend
+// NewMongoStorage creates a new storage with mongodb as its backend.
+// The write concern can be given with the w, wtimeoutMS and journal options of the URL.
 func NewMongoStorage(url string) (Storage, error) {
-	info, err := mgo.ParseURL(url)
+	url, safe, err := parseWriteConcern(url)
 	if err != nil {
 		return nil, err
 	}
+	info, err := mgo.ParseURL(url)
+	if err != nil {
+		return nil, wrapError(ErrInvalidArgument, err)
+	}
 	s, err := mgo.DialWithInfo(info)
 	if err != nil {
+		return nil, wrapError(ErrBackendUnavailable, err)
+	}
+	s.SetSafe(safe)
+	store := &MongoStorage{db: s.DB(info.Database), session: s}
+	store.noContext = noContext{store}
+	if err := store.migrateIndexes(); err != nil {
+		s.Close()
 		return nil, err
 	}
-	return &MongoStorage{s.DB(info.Database), s}, nil
+	return store, nil
 }
 
-// Put stores data in the db
+// migrateIndexes drops the unique indexes on "k" alone of the timeseries collections which were written before
+// values could be kept, the index on "k" and "s" replacing them is ensured by the next write to the collection.
+func (store *MongoStorage) migrateIndexes() error {
+	db := store.copyDB()
+	defer db.Session.Close()
+	names, err := db.CollectionNames()
+	if err != nil {
+		return mongoError(err)
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, "ts/") {
+			continue
+		}
+		c := db.C(name)
+		indexes, err := c.Indexes()
+		if err != nil {
+			return mongoError(err)
+		}
+		for _, index := range indexes {
+			if index.Unique && len(index.Key) == 1 && index.Key[0] == "k" {
+				if err := c.DropIndexName(index.Name); err != nil {
+					return mongoError(err)
+				}
+				log.Printf("migration: dropped the unique index %v of %v", index.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// parseWriteConcern removes the write concern options from the query of a mongodb:// URL, mgo doesn't support them.
+// w is the number of nodes or a mode like "majority", w=0 disables acknowledgements which also hides conflicts.
+// Without options the writes are acknowledged by the primary.
+func parseWriteConcern(url string) (string, *mgo.Safe, error) {
+	idx := strings.Index(url, "?")
+	if idx < 0 {
+		return url, &mgo.Safe{}, nil
+	}
+	query, err := neturl.ParseQuery(url[idx+1:])
+	if err != nil {
+		return "", nil, wrapError(ErrInvalidArgument, err)
+	}
+	safe := &mgo.Safe{}
+	w := query.Get("w")
+	if n, err := strconv.Atoi(w); err == nil && n >= 0 {
+		safe.W = n
+	} else {
+		safe.WMode = w
+	}
+	if str := query.Get("wtimeoutMS"); str != "" {
+		if safe.WTimeout, err = strconv.Atoi(str); err != nil || safe.WTimeout < 0 {
+			return "", nil, invalidArgument("'wtimeoutMS' needs to be a positive integer")
+		}
+	}
+	if str := query.Get("journal"); str != "" {
+		if safe.J, err = strconv.ParseBool(str); err != nil {
+			return "", nil, invalidArgument("'journal' needs to be true or false")
+		}
+	}
+	for _, option := range []string{"w", "wtimeoutMS", "journal"} {
+		query.Del(option)
+	}
+	url = url[:idx]
+	if len(query) > 0 {
+		url += "?" + query.Encode()
+	}
+	if w == "0" {
+		return url, nil, nil
+	}
+	return url, safe, nil
+}
+
+// copyDB returns the database on a copy of the session, the session has to be closed after the operation
+func (store *MongoStorage) copyDB() *mgo.Database {
+	return store.db.With(store.session.Copy())
+}
+
+// PutContext stores data in the db
 // seperate collections can be specified by using slashes in the key
 // -> Put("foo/bar", "baz") will create a doc with key bar in collection foo (containing baz)
-func (store *MongoStorage) Put(key string, value []byte) error {
-	c, keyName, err := store.getCollectionAndKey("kv/" + key)
+func (store *MongoStorage) PutContext(ctx context.Context, key string, value []byte) error {
+	_, err := store.putVersioned(ctx, key, value, time.Time{})
+	return err
+}
+
+// PutWithTTLContext stores data in the db which expires after ttl
+// Expired docs are hidden from queries and removed by the TTL index on their "e" field
+func (store *MongoStorage) PutWithTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := store.putVersioned(ctx, key, value, time.Now().Add(ttl))
+	return err
+}
+
+// putVersioned stores data which expires at expires unless it is zero and returns its new version
+func (store *MongoStorage) putVersioned(ctx context.Context, key string, value []byte, expires time.Time) (uint64, error) {
+	db := store.copyDB()
+	defer db.Session.Close()
+	c, keyName, err := store.getCollectionAndKey(db, "kv/"+key)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	revision, err := store.nextRevision(db)
+	if err != nil {
+		return 0, err
 	}
-	return c.Insert(bson.M{"k": keyName, "v": value})
+	update := bson.M{
+		"$set":   bson.M{"v": value, "r": revision},
+		"$unset": bson.M{"e": ""},
+	}
+	if !expires.IsZero() {
+		update = bson.M{"$set": bson.M{"v": value, "e": expires, "r": revision}}
+	}
+	if _, err = c.Upsert(bson.M{"k": keyName}, update); err != nil {
+		return 0, mongoError(err)
+	}
+	return uint64(revision), nil
 }
 
-// Get retrieves a doc from the db
-func (store *MongoStorage) Get(key string) ([]byte, error) {
-	c, keyName, err := store.getCollectionAndKey("kv/" + key)
+// CompareAndSwapContext stores data in the db if the current version of key is expectedVersion
+// An expectedVersion of 0 means that the key must not exist.
+func (store *MongoStorage) CompareAndSwapContext(ctx context.Context, key string, expectedVersion uint64, value []byte) (uint64, error) {
+	db := store.copyDB()
+	defer db.Session.Close()
+	c, keyName, err := store.getCollectionAndKey(db, "kv/"+key)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	revision, err := store.nextRevision(db)
+	if err != nil {
+		return 0, err
+	}
+	if expectedVersion == 0 {
+		// expired docs which are not yet removed by the TTL index would violate the unique index
+		c.Remove(bson.M{"k": keyName, "e": bson.M{"$lte": time.Now()}})
+		err = c.Insert(bson.M{"k": keyName, "v": value, "r": revision})
+		if mgo.IsDup(err) {
+			return 0, ErrVersionMismatch
+		}
+	} else {
+		err = c.Update(notExpired(bson.M{"k": keyName, "r": int64(expectedVersion)}), bson.M{
+			"$set":   bson.M{"v": value, "r": revision},
+			"$unset": bson.M{"e": ""},
+		})
+		if err == mgo.ErrNotFound {
+			return 0, ErrVersionMismatch
+		}
+	}
+	if err != nil {
+		return 0, mongoError(err)
+	}
+	return uint64(revision), nil
+}
+
+// nextRevision increments the revision counter in the "meta" collection and returns its new value
+func (store *MongoStorage) nextRevision(db *mgo.Database) (int64, error) {
+	res := &struct {
+		N int64 `bson:"n"`
+	}{}
+	_, err := db.C("meta").FindId("revision").Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"n": 1}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, res)
+	return res.N, mongoError(err)
+}
+
+// notExpired returns a query for all docs matching query which are not expired
+func notExpired(query bson.M) bson.M {
+	query["$or"] = []bson.M{
+		{"e": bson.M{"$exists": false}},
+		{"e": bson.M{"$gt": time.Now()}},
+	}
+	return query
+}
+
+// GetContext retrieves a doc from the db
+func (store *MongoStorage) GetContext(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := store.GetVersionedContext(ctx, key)
+	return value, err
+}
+
+// GetVersionedContext retrieves a doc and its version from the db
+func (store *MongoStorage) GetVersionedContext(ctx context.Context, key string) ([]byte, uint64, error) {
+	db := store.copyDB()
+	defer db.Session.Close()
+	c, keyName := store.collectionAndKey(db, "kv/"+key)
 	res := &kvEntry{}
-	err = c.Find(bson.M{"k": keyName}).One(res)
+	err := c.Find(notExpired(bson.M{"k": keyName})).One(res)
+	if err == mgo.ErrNotFound {
+		return nil, 0, notFound(key)
+	}
 	if err != nil {
-		return nil, err
+		return nil, 0, mongoError(err)
+	}
+	return res.Value, uint64(res.Revision), nil
+}
+
+// DeleteContext drops an entry from db, expired entries are not found like by GetContext
+func (store *MongoStorage) DeleteContext(ctx context.Context, key string) error {
+	db := store.copyDB()
+	defer db.Session.Close()
+	c, keyName := store.collectionAndKey(db, "kv/"+key)
+	err := c.Remove(notExpired(bson.M{"k": keyName}))
+	if err == mgo.ErrNotFound {
+		return notFound(key)
+	}
+	return mongoError(err)
+}
+
+// CompareAndDeleteContext drops an entry from db if its current version is expectedVersion
+func (store *MongoStorage) CompareAndDeleteContext(ctx context.Context, key string, expectedVersion uint64) error {
+	db := store.copyDB()
+	defer db.Session.Close()
+	c, keyName := store.collectionAndKey(db, "kv/"+key)
+	err := c.Remove(notExpired(bson.M{"k": keyName, "r": int64(expectedVersion)}))
+	if err == mgo.ErrNotFound {
+		return ErrVersionMismatch
 	}
-	return res.Value, nil
+	return mongoError(err)
 }
 
-// Delete drops an entry from db
-func (store *MongoStorage) Delete(key string) error {
-	c, keyName, err := store.getCollectionAndKey("kv/" + key)
+// ListContext returns all keys starting with prefix
+func (store *MongoStorage) ListContext(ctx context.Context, prefix string) ([]string, error) {
+	return store.ScanContext(ctx, prefix, PrefixEnd(prefix), 0)
+}
+
+// ScanContext returns at most limit keys in the range [start, end)
+// The keys are collected from the "kv" collection and all "kv/..." collections,
+// each of them is queried for at most limit keys in the range using the index on "k".
+func (store *MongoStorage) ScanContext(ctx context.Context, start, end string, limit int) ([]string, error) {
+	db := store.copyDB()
+	defer db.Session.Close()
+	names, err := db.CollectionNames()
 	if err != nil {
-		return err
+		return nil, mongoError(err)
 	}
-	return c.Remove(bson.M{"k": keyName})
+	keys := []string{}
+	for _, name := range names {
+		var prefix string
+		switch {
+		case name == "kv":
+			prefix = ""
+		case strings.HasPrefix(name, "kv/"):
+			prefix = name[3:] + "/"
+		default:
+			continue
+		}
+		if !prefixInRange(prefix, start, end) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		query := db.C(name).Find(notExpired(bson.M{"k": keyRange(prefix, start, end)})).Select(bson.M{"k": 1}).Sort("k")
+		if limit > 0 {
+			query = query.Limit(limit)
+		}
+		iter := query.Iter()
+		entry := &kvEntry{}
+		for iter.Next(entry) {
+			if key := prefix + entry.Key; keyInRange(key, start, end) {
+				keys = append(keys, key)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, mongoError(err)
+		}
+	}
+	sort.Strings(keys)
+	return limitKeys(keys, limit), nil
+}
+
+// keyRange returns the query on the "k" field of a collection holding the keys starting with prefix,
+// which matches the keys in the range [start, end)
+func keyRange(prefix, start, end string) bson.M {
+	query := bson.M{"$exists": true}
+	if strings.HasPrefix(start, prefix) {
+		query["$gte"] = start[len(prefix):]
+	}
+	if end != "" && strings.HasPrefix(end, prefix) {
+		query["$lt"] = end[len(prefix):]
+	}
+	return query
+}
+
+// AddValueContext adds a value to a timeseries
+func (store *MongoStorage) AddValueContext(ctx context.Context, key string, value float64) error {
+	return store.AddValuesContext(ctx, key, []*TimeSeriesEntry{{Value: value, Timestamp: time.Now()}})
 }
 
-// AddValue adds a value to a timeseries
-func (store *MongoStorage) AddValue(key string, value float64) error {
-	c, _, err := store.getCollectionAndKey("ts/" + key + "/")
+// AddValuesContext adds multiple values to a timeseries using a single bulk write.
+// Like the transactions, this is not atomic: if a value is rejected as duplicate the values before it are saved.
+func (store *MongoStorage) AddValuesContext(ctx context.Context, key string, entries []*TimeSeriesEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	db := store.copyDB()
+	defer db.Session.Close()
+	c, _, err := store.getCollectionAndKey(db, "ts/"+key+"/")
 	if err != nil {
 		return err
 	}
-	return c.Insert(bson.M{"k": time.Now().UnixNano(), "v": value})
+	policy := store.policyFor(key)
+	if policy == DuplicateKeep {
+		for _, entry := range entries {
+			if err := store.addKept(c, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	bulk := c.Bulk()
+	for _, entry := range entries {
+		if policy == DuplicateReject {
+			bulk.Insert(tsDoc(entry))
+			continue
+		}
+		update := bson.M{"$set": bson.M{"v": entry.Value, "f": entry.Fields}}
+		if len(entry.Fields) == 0 {
+			update = bson.M{"$set": bson.M{"v": entry.Value}, "$unset": bson.M{"f": ""}}
+		}
+		// the first value at a timestamp has no "s", which also matches null
+		bulk.Upsert(bson.M{"k": entry.Timestamp.UnixNano(), "s": nil}, update)
+	}
+	_, err = bulk.Run()
+	if policy == DuplicateReject && mgo.IsDup(err) {
+		return wrapError(ErrDuplicateTimestamp, err)
+	}
+	return mongoError(err)
 }
 
-// GetRange returns a aspecific range in a timeseries
-func (store *MongoStorage) GetRange(key string, from time.Time, to time.Time) (chan *TimeSeriesEntry, error) {
-	c, _, err := store.getCollectionAndKey("ts/" + key + "/")
-	if err != nil {
-		return nil, err
+// addKept inserts entry behind the existing values at its timestamp.
+// Concurrent writers may pick the same sequence number, the insert is retried then.
+func (store *MongoStorage) addKept(c *mgo.Collection, entry *TimeSeriesEntry) error {
+	nanos := entry.Timestamp.UnixNano()
+	for attempt := 1; ; attempt++ {
+		doc := tsDoc(entry)
+		last := &tsEntry{}
+		err := c.Find(bson.M{"k": nanos}).Sort("-s").One(last)
+		switch {
+		case err == nil:
+			doc["s"] = last.Seq + 1
+		case err != mgo.ErrNotFound:
+			return mongoError(err)
+		}
+		err = c.Insert(doc)
+		if !mgo.IsDup(err) || attempt == 3 {
+			return mongoError(err)
+		}
+	}
+}
+
+// tsDoc returns the document of a timeseries entry, the fields of a point are kept in its "f" subdocument
+func tsDoc(entry *TimeSeriesEntry) bson.M {
+	doc := bson.M{"k": entry.Timestamp.UnixNano(), "v": entry.Value}
+	if len(entry.Fields) > 0 {
+		doc["f"] = entry.Fields
 	}
-	ch := make(chan *TimeSeriesEntry, 64)
-	iter := c.Find(bson.M{"k": bson.M{"$gte": from.UnixNano(), "$lte": to.UnixNano()}}).Iter()
-	go func() {
+	return doc
+}
+
+// GetRangeContext returns an iterator over a specific range in a timeseries
+// The iterator holds a copy of the session until it is closed.
+func (store *MongoStorage) GetRangeContext(ctx context.Context, key string, from time.Time, to time.Time) (Iterator, error) {
+	db := store.copyDB()
+	c, _ := store.collectionAndKey(db, "ts/"+key+"/")
+	iter := c.Find(bson.M{"k": bson.M{"$gte": from.UnixNano(), "$lte": to.UnixNano()}}).Sort("k", "s").Iter()
+	return newFuncIterator(ctx, func() (*TimeSeriesEntry, error) {
 		entry := &tsEntry{}
-		for iter.Next(entry) {
-			ch <- &TimeSeriesEntry{entry.Value, time.Unix(0, entry.Key)}
+		if iter.Next(entry) {
+			return &TimeSeriesEntry{Value: entry.Value, Timestamp: time.Unix(0, entry.Key), Fields: entry.Fields}, nil
 		}
-		close(ch)
-	}()
-	return ch, nil
+		return nil, mongoError(iter.Err())
+	}, func() error {
+		defer db.Session.Close()
+		return mongoError(iter.Close())
+	}), nil
+}
+
+// DeleteRangeContext returns a aspecific range in a timeseries
+func (store *MongoStorage) DeleteRangeContext(ctx context.Context, key string, from time.Time, to time.Time) error {
+	db := store.copyDB()
+	defer db.Session.Close()
+	c, _ := store.collectionAndKey(db, "ts/"+key+"/")
+	_, err := c.RemoveAll(bson.M{"k": bson.M{"$gte": from.UnixNano(), "$lte": to.UnixNano()}})
+	return mongoError(err)
 }
 
-// DeleteRange returns a aspecific range in a timeseries
-func (store *MongoStorage) DeleteRange(key string, from time.Time, to time.Time) error {
-	c, _, err := store.getCollectionAndKey("ts/" + key + "/")
+// ListSeriesContext returns the keys of all timeseries starting with prefix
+// Every timeseries is stored in its own "ts/..." collection
+func (store *MongoStorage) ListSeriesContext(ctx context.Context, prefix string) ([]string, error) {
+	db := store.copyDB()
+	defer db.Session.Close()
+	names, err := db.CollectionNames()
 	if err != nil {
-		return err
+		return nil, mongoError(err)
 	}
+	keys := []string{}
+	for _, name := range names {
+		if strings.HasPrefix(name, "ts/"+prefix) {
+			keys = append(keys, name[3:])
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
 
-	_, err = c.RemoveAll(bson.M{"k": bson.M{"$gte": from.UnixNano(), "$lte": to.UnixNano()}})
+// AggregateContext returns one aggregated value per step in a timerange
+// The aggregation is done by the mongodb aggregation pipeline, the iterator holds a copy of the session until it is closed.
+func (store *MongoStorage) AggregateContext(ctx context.Context, key string, from time.Time, to time.Time, step time.Duration, agg Aggregation) (Iterator, error) {
+	if step <= 0 {
+		return nil, invalidArgument("step needs to be positive")
+	}
+	db := store.copyDB()
+	c, _ := store.collectionAndKey(db, "ts/"+key+"/")
+	var op bson.M
+	switch agg {
+	case AggCount:
+		op = bson.M{"$sum": 1}
+	case AggStddev:
+		op = bson.M{"$stdDevPop": "$v"}
+	default:
+		op = bson.M{"$" + string(agg): "$v"}
+	}
+	start := from.UnixNano()
+	pipeline := []bson.M{
+		{"$match": bson.M{"k": bson.M{"$gte": start, "$lte": to.UnixNano()}}},
+		{"$sort": bson.M{"k": 1}},
+		{"$group": bson.M{
+			"_id": bson.M{"$subtract": []interface{}{"$k", bson.M{"$mod": []interface{}{bson.M{"$subtract": []interface{}{"$k", start}}, int64(step)}}}},
+			"v":   op,
+		}},
+		{"$sort": bson.M{"_id": 1}},
+	}
+	iter := c.Pipe(pipeline).AllowDiskUse().Iter()
+	res := &struct {
+		Key   int64   `bson:"_id"`
+		Value float64 `bson:"v"`
+	}{}
+	return newFuncIterator(ctx, func() (*TimeSeriesEntry, error) {
+		if iter.Next(res) {
+			return &TimeSeriesEntry{Value: res.Value, Timestamp: time.Unix(0, res.Key)}, nil
+		}
+		return nil, mongoError(iter.Err())
+	}, func() error {
+		defer db.Session.Close()
+		return mongoError(iter.Close())
+	}), nil
+}
+
+// CommitContext applies all operations of txn one after another.
+// Mongodb has no multi-document transactions, so this is best effort: the guards are checked
+// before any write, but concurrent writers are not excluded and a failing write leaves the previous ones applied.
+func (store *MongoStorage) CommitContext(ctx context.Context, txn *Txn) error {
+	_, err := store.commitVersioned(ctx, txn)
 	return err
 }
 
+// commitVersioned commits txn and returns the new versions of the keys written by its put operations
+func (store *MongoStorage) commitVersioned(ctx context.Context, txn *Txn) ([]uint64, error) {
+	if err := txn.Validate(); err != nil {
+		return nil, err
+	}
+	for _, op := range txn.Ops {
+		if op.IsGuard() {
+			_, version, err := store.GetVersionedContext(ctx, op.Key)
+			if !checkGuard(op, err == nil, version) {
+				return nil, ErrGuardFailed
+			}
+		}
+	}
+	now := time.Now()
+	versions := make([]uint64, len(txn.Ops))
+	for i, op := range txn.Ops {
+		var err error
+		switch op.Type {
+		case TxnPut:
+			versions[i], err = store.putVersioned(ctx, op.Key, op.Value, time.Time{})
+		case TxnDelete:
+			if err = store.DeleteContext(ctx, op.Key); errors.Is(err, ErrNotFound) {
+				err = nil
+			}
+		case TxnAddValue:
+			err = store.AddValuesContext(ctx, op.Key, []*TimeSeriesEntry{entryWithStamp(op, now)})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
 // Close closes the db
 func (store *MongoStorage) Close() error {
 	store.session.Close()
 	return nil
 }
 
-func (store *MongoStorage) getCollectionAndKey(str string) (*mgo.Collection, string, error) {
+// collectionAndKey splits str at its last slash into the collection of db and the key in it.
+// Reading from a collection which doesn't exist doesn't create it, so reads use the collection as it is.
+func (store *MongoStorage) collectionAndKey(db *mgo.Database, str string) (*mgo.Collection, string) {
 	idx := strings.LastIndex(str, "/")
-	c := store.db.C(str[:idx])
+	return db.C(str[:idx]), str[idx+1:]
+}
+
+// getCollectionAndKey returns the collection and the key for a write like collectionAndKey and ensures the indexes
+// of the collection, which creates it. The indexes of a collection are ensured once per store.
+func (store *MongoStorage) getCollectionAndKey(db *mgo.Database, str string) (*mgo.Collection, string, error) {
+	c, key := store.collectionAndKey(db, str)
+	if _, ok := store.indexed.Load(c.Name); ok {
+		return c, key, nil
+	}
 	index := mgo.Index{
 		Key:        []string{"k"},
 		Unique:     true,
 		DropDups:   true,
 		Background: true,
 	}
+	if strings.HasPrefix(str, "ts/") {
+		// kept duplicates share the timestamp "k"
+		index.Key = []string{"k", "s"}
+	}
 	err := c.EnsureIndex(index)
-	return c, str[idx+1:], err
+	if err == nil && strings.HasPrefix(str, "kv/") {
+		err = c.EnsureIndex(mgo.Index{
+			Key:         []string{"e"},
+			ExpireAfter: time.Second,
+			Background:  true,
+		})
+	}
+	if err != nil {
+		return nil, "", mongoError(err)
+	}
+	store.indexed.Store(c.Name, true)
+	return c, key, nil
+}
+
+// mongoError wraps the errors of mgo into the errors of this package
+func mongoError(err error) error {
+	var (
+		netErr  net.Error
+		lastErr *mgo.LastError
+	)
+	switch {
+	case err == nil:
+		return nil
+	case err == mgo.ErrNotFound:
+		return wrapError(ErrNotFound, err)
+	case mgo.IsDup(err):
+		return wrapError(ErrConflict, err)
+	case errors.As(err, &lastErr) && lastErr.WTimeout:
+		// the write concern wasn't satisfied in time
+		return wrapError(ErrBackendUnavailable, err)
+	case err == io.EOF, errors.As(err, &netErr), err.Error() == "no reachable servers", err.Error() == "Closed explicitly":
+		// mgo reports lost connections and closed sessions with plain errors
+		return wrapError(ErrBackendUnavailable, err)
+	}
+	return err
 }
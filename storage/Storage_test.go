@@ -1,219 +1,197 @@
-package storage
+package storage_test
 
 import (
-	"encoding/json"
+	"context"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storaged/storage"
+	"github.com/trusch/storaged/storage/storagetest"
+	"gopkg.in/mgo.v2"
 )
 
-type StorageSuite struct {
-	suite.Suite
-	store Storage
-	typ   string
-}
-
-func (suite *StorageSuite) toBytes(val interface{}) []byte {
-	bs, err := json.Marshal(val)
-	suite.NoError(err)
-	return bs
-}
-
-func (suite *StorageSuite) clearStore() {
-	if suite.typ == "mongo" {
-		cmd := exec.Command("mongo", "test-store", "--eval", "db.kv.drop(); db['ts/test/value'].drop(); db['ts/test'].drop();")
-		cmd.Run()
-	} else {
-		os.RemoveAll("./test-store.db")
+// openStore is a factory for storagetest.RunConformance, clear is called before the store is opened
+func openStore(t *testing.T, uri string, clear func()) func() storage.Storage {
+	return func() storage.Storage {
+		clear()
+		store, err := storage.NewMetaStorage(uri)
+		assert.NoError(t, err)
+		return store
 	}
 }
 
-func (suite *StorageSuite) TearDownTest() {
-	err := suite.store.Close()
-	suite.NoError(err)
-	suite.clearStore()
-	switch suite.typ {
-	case "leveldb":
-		{
-			store, err := NewMetaStorage("leveldb://test-store.db")
-			suite.NoError(err)
-			suite.NotNil(store)
-			suite.store = store
-		}
-	case "bolt":
-		{
-			store, err := NewMetaStorage("bolt://test-store.db")
-			suite.NoError(err)
-			suite.NotNil(store)
-			suite.store = store
-		}
-	case "mongo":
-		{
-			store, err := NewMetaStorage("mongodb://localhost/test-store")
-			suite.NoError(err)
-			suite.NotNil(store)
-			suite.store = store
-		}
-	}
-}
-
-func (suite *StorageSuite) TearDownSuite() {
-	suite.clearStore()
-}
-
-func (suite *StorageSuite) TestPut() {
-	obj := suite.toBytes(map[string]interface{}{
-		"int":    123,
-		"float":  321.123,
-		"string": "string",
-		"object": map[string]interface{}{"foo": "bar"},
-	})
-	err := suite.store.Put("test", obj)
-	suite.NoError(err)
+func removeTestStore() {
+	os.RemoveAll("./test-store.db")
 }
 
-func (suite *StorageSuite) TestComplexPut() {
-	obj := suite.toBytes(map[string]interface{}{
-		"object": []map[string]interface{}{map[string]interface{}{"foo": "bar"}},
-	})
-	err := suite.store.Put("test", obj)
-	suite.NoError(err)
-	restored, err := suite.store.Get("test")
-	suite.NoError(err)
-	suite.Equal(obj, restored)
-}
-
-func (suite *StorageSuite) TestGet() {
-	obj := suite.toBytes(map[string]interface{}{
-		"int":    123,
-		"float":  321.123,
-		"string": "string",
-		"object": map[string]interface{}{"foo": "bar"},
-	})
-	err := suite.store.Put("test", obj)
-	suite.NoError(err)
-	restored, err := suite.store.Get("test")
-	suite.NoError(err)
-	suite.Equal(obj, restored)
+func TestLevelDBStorage(t *testing.T) {
+	defer removeTestStore()
+	storagetest.RunConformance(t, openStore(t, "leveldb://test-store.db", removeTestStore))
 }
 
-func (suite *StorageSuite) TestGetNonExisting() {
-	_, err := suite.store.Get("test")
-	suite.Error(err)
+func TestBoltStorage(t *testing.T) {
+	defer removeTestStore()
+	storagetest.RunConformance(t, openStore(t, "bolt://test-store.db", removeTestStore))
 }
 
-func (suite *StorageSuite) TestDelete() {
-	obj := suite.toBytes(map[string]interface{}{
-		"int":    123,
-		"float":  321.123,
-		"string": "string",
-		"object": map[string]interface{}{"foo": "bar"},
-	})
-	err := suite.store.Put("test", obj)
-	suite.NoError(err)
-	err = suite.store.Delete("test")
-	suite.NoError(err)
-	restored, err := suite.store.Get("test")
-	suite.Error(err)
-	suite.Nil(restored)
+func TestMemoryStorage(t *testing.T) {
+	storagetest.RunConformance(t, openStore(t, "memory://", func() {}))
 }
 
-func (suite *StorageSuite) TestAddValue() {
-	err := suite.store.AddValue("test", 123.123)
-	suite.NoError(err)
+// TestMongoStorage needs a running mongod, set STORAGED_TEST_MONGO to its uri (e.g. mongodb://localhost/test-store) to enable it
+func TestMongoStorage(t *testing.T) {
+	uri := os.Getenv("STORAGED_TEST_MONGO")
+	if uri == "" {
+		t.Skip("STORAGED_TEST_MONGO is not set")
+	}
+	dropDatabase := func() {
+		session, err := mgo.Dial(uri)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer session.Close()
+		assert.NoError(t, session.DB("").DropDatabase())
+	}
+	defer dropDatabase()
+	storagetest.RunConformance(t, openStore(t, uri, dropDatabase))
 }
 
-func (suite *StorageSuite) TestAddValueNestedBucket() {
-	err := suite.store.AddValue("test/value", 123.123)
-	suite.NoError(err)
+func TestMemoryStorageSnapshot(t *testing.T) {
+	defer os.Remove("./test-store.snapshot")
+	store, err := storage.NewMetaStorage("memory://test-store.snapshot")
+	assert.NoError(t, err)
+	assert.NoError(t, store.Put("foo/bar", []byte("baz")))
+	assert.NoError(t, store.AddValue("test", 1))
+	assert.NoError(t, store.Close())
+	store, err = storage.NewMetaStorage("memory://test-store.snapshot")
+	assert.NoError(t, err)
+	value, version, err := store.GetVersioned("foo/bar")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("baz"), value)
+	assert.Equal(t, uint64(1), version)
+	ch, err := store.GetRange("test", time.Time{}, time.Now())
+	assert.NoError(t, err)
+	entry := <-ch
+	assert.Equal(t, 1., entry.Value)
+	_, err = store.CompareAndSwap("foo/bar", 1, []byte("qux"))
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+	// the snapshot is written to a temporary file which replaces the old snapshot
+	leftovers, err := filepath.Glob("./test-store.snapshot.tmp-*")
+	assert.NoError(t, err)
+	assert.Empty(t, leftovers)
+	store, err = storage.NewMetaStorage("memory://test-store.snapshot")
+	assert.NoError(t, err)
+	value, err = store.Get("foo/bar")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("qux"), value)
+	assert.NoError(t, store.Close())
 }
 
-func (suite *StorageSuite) TestGetRange() {
-	for i := 0; i < 100; i++ {
-		err := suite.store.AddValue("test", float64(i))
-		suite.NoError(err)
+func TestInvalidKeys(t *testing.T) {
+	store, err := storage.NewMetaStorage("memory://")
+	assert.NoError(t, err)
+	defer store.Close()
+	for _, key := range []string{"", "/foo", "foo/", "foo//bar"} {
+		assert.ErrorIs(t, store.Put(key, []byte("foo")), storage.ErrInvalidKey, key)
+		_, err := store.Get(key)
+		assert.ErrorIs(t, err, storage.ErrInvalidKey, key)
+		assert.ErrorIs(t, store.AddValue(key, 1), storage.ErrInvalidKey, key)
+		assert.ErrorIs(t, store.Commit(storage.NewTxn().Put(key, []byte("foo"))), storage.ErrInvalidKey, key)
 	}
-	ch, err := suite.store.GetRange("test", time.Time{}, time.Now())
-	suite.NoError(err)
-	for i := 0; i < 100; i++ {
-		kv, ok := <-ch
-		suite.True(ok)
-		suite.Equal(float64(i), kv.Value)
+	_, err = store.Aggregate("foo", time.Time{}, time.Now(), 0, storage.AggAvg)
+	assert.ErrorIs(t, err, storage.ErrInvalidArgument)
+	// the last segment "last" is reserved for timeseries
+	assert.ErrorIs(t, store.AddValue("foo/last", 1), storage.ErrInvalidKey)
+	assert.ErrorIs(t, store.Commit(storage.NewTxn().AddValue("foo/last", 1, time.Time{})), storage.ErrInvalidKey)
+	assert.NoError(t, store.Put("foo/last", []byte("foo")))
+	assert.ErrorIs(t, store.AddValue("foo@1m", 1), storage.ErrInvalidKey)
+	assert.NoError(t, store.Put("foo@1m", []byte("foo")))
+}
+
+func TestCanceledContext(t *testing.T) {
+	store, err := storage.NewMetaStorage("memory://")
+	assert.NoError(t, err)
+	defer store.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, store.PutContext(ctx, "foo", []byte("bar")), context.Canceled)
+	_, err = store.Get("foo")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = store.ListContext(ctx, "")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, store.CommitContext(ctx, storage.NewTxn().Put("foo", []byte("bar"))), context.Canceled)
+}
+
+func TestInvalidFields(t *testing.T) {
+	store, err := storage.NewMetaStorage("memory://")
+	assert.NoError(t, err)
+	defer store.Close()
+	for _, name := range []string{"", storage.DefaultField} {
+		entry := &storage.TimeSeriesEntry{Value: 1, Timestamp: time.Now(), Fields: map[string]float64{name: 2}}
+		assert.ErrorIs(t, store.AddValues("foo", []*storage.TimeSeriesEntry{entry}), storage.ErrInvalidArgument, name)
+		txn := storage.NewTxn().AddValue("foo", 1, time.Now())
+		txn.Ops[0].Entry.Fields = map[string]float64{name: 2}
+		assert.ErrorIs(t, store.Commit(txn), storage.ErrInvalidArgument, name)
 	}
-	_, ok := <-ch
-	suite.False(ok)
 }
 
-func (suite *StorageSuite) TestDeleteRange() {
-	var stopTime time.Time
-	for i := 0; i < 100; i++ {
-		err := suite.store.AddValue("test", float64(i))
-		if i == 49 {
-			stopTime = time.Now()
-		}
-		suite.NoError(err)
-	}
-	err := suite.store.DeleteRange("test", stopTime, time.Now())
-	suite.NoError(err)
-	ch, err := suite.store.GetRange("test", time.Time{}, time.Now())
-	suite.NoError(err)
-	for i := 0; i < 50; i++ {
-		kv, ok := <-ch
-		suite.True(ok)
-		suite.Equal(float64(i), kv.Value)
-	}
-	_, ok := <-ch
-	suite.False(ok)
+func TestBadMetaStorageURI(t *testing.T) {
+	store, err := storage.NewMetaStorage("wrong://uri")
+	assert.ErrorIs(t, err, storage.ErrInvalidArgument)
+	assert.Empty(t, store)
+	store, err = storage.NewMetaStorage("://foo")
+	assert.ErrorIs(t, err, storage.ErrInvalidArgument)
+	assert.Empty(t, store)
 }
 
-func (suite *StorageSuite) TestBadMetaStorageURI() {
-	store, err := NewMetaStorage("wrong://uri")
-	suite.Error(err)
-	suite.Empty(store)
-	store, err = NewMetaStorage("://foo")
-	suite.Error(err)
-	suite.Empty(store)
+func TestBadOpenRightsStorageURI(t *testing.T) {
+	store, err := storage.NewMetaStorage("leveldb:///root/forbidden")
+	assert.ErrorIs(t, err, storage.ErrBackendUnavailable)
+	assert.Empty(t, store)
+	store, err = storage.NewMetaStorage("bolt:///root/forbidden")
+	assert.ErrorIs(t, err, storage.ErrBackendUnavailable)
+	assert.Empty(t, store)
 }
 
-func (suite *StorageSuite) TestBadOpenRightsStorageURI() {
-	store, err := NewMetaStorage("leveldb:///root/forbidden")
-	suite.Error(err)
-	suite.Empty(store)
-	store, err = NewMetaStorage("bolt:///root/forbidden")
-	suite.Error(err)
-	suite.Empty(store)
-}
+func TestInstrumentedStorage(t *testing.T) {
+	storagetest.RunConformance(t, func() storage.Storage {
+		store, err := storage.NewMetaStorage("memory://")
+		assert.NoError(t, err)
+		return storage.NewInstrumentedStorage(store, func(string, time.Duration, error) {})
+	})
 
-func TestLevelDBStorage(t *testing.T) {
-	store, err := NewMetaStorage("leveldb://test-store.db")
+	var methods []string
+	store, err := storage.NewMetaStorage("memory://")
 	assert.NoError(t, err)
-	assert.NotNil(t, store)
-	s := new(StorageSuite)
-	s.store = store
-	s.typ = "leveldb"
-	suite.Run(t, s)
-}
-
-func TestBoltStorage(t *testing.T) {
-	store, err := NewMetaStorage("bolt://test-store.db")
+	instrumented := storage.NewInstrumentedStorage(store, func(method string, duration time.Duration, err error) {
+		methods = append(methods, method)
+	})
+	assert.True(t, storage.Supports[storage.Labeler](instrumented))
+	assert.NoError(t, instrumented.Put("foo", []byte("bar")))
+	_, err = instrumented.Get("missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.NoError(t, instrumented.AddValue("series", 1))
+	it, err := instrumented.GetRangeContext(context.Background(), "series", time.Time{}, time.Now())
 	assert.NoError(t, err)
-	assert.NotNil(t, store)
-	s := new(StorageSuite)
-	s.store = store
-	s.typ = "bolt"
-	suite.Run(t, s)
-}
+	assert.Equal(t, []string{"Put", "Get", "AddValue"}, methods, "reads of timeranges are reported when they are closed")
+	for it.Next() {
+	}
+	assert.NoError(t, it.Close())
+	assert.NoError(t, it.Close())
+	assert.Equal(t, []string{"Put", "Get", "AddValue", "GetRange"}, methods)
 
-func TestMongoStorage(t *testing.T) {
-	store, err := NewMetaStorage("mongodb://localhost/test-store")
+	bolt, err := storage.NewBoltStorage("./test-store.db")
+	assert.NoError(t, err)
+	defer removeTestStore()
+	defer bolt.Close()
+	instrumented = storage.NewInstrumentedStorage(bolt, func(string, time.Duration, error) {})
+	assert.False(t, storage.Supports[storage.Labeler](instrumented))
+	size, ok, err := instrumented.Size()
 	assert.NoError(t, err)
-	assert.NotNil(t, store)
-	s := new(StorageSuite)
-	s.store = store
-	s.typ = "mongo"
-	suite.Run(t, s)
+	assert.True(t, ok)
+	assert.True(t, size > 0)
 }
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// An Aggregation specifies how the values of a time bucket are summarised
+type Aggregation string
+
+// Supported aggregations
+const (
+	AggAvg    Aggregation = "avg"
+	AggMin    Aggregation = "min"
+	AggMax    Aggregation = "max"
+	AggSum    Aggregation = "sum"
+	AggCount  Aggregation = "count"
+	AggFirst  Aggregation = "first"
+	AggLast   Aggregation = "last"
+	AggStddev Aggregation = "stddev"
+)
+
+// ParseAggregation checks if str names a supported aggregation
+func ParseAggregation(str string) (Aggregation, error) {
+	switch agg := Aggregation(str); agg {
+	case AggAvg, AggMin, AggMax, AggSum, AggCount, AggFirst, AggLast, AggStddev:
+		return agg, nil
+	}
+	return "", invalidArgument("unknown aggregation, try avg, min, max, sum, count, first, last or stddev")
+}
+
+// accumulator collects the values of a single time bucket
+type accumulator struct {
+	start   time.Time
+	count   int64
+	sum     float64
+	sumSq   float64
+	min     float64
+	max     float64
+	first   float64
+	last    float64
+	firstAt time.Time
+	lastAt  time.Time
+}
+
+// add adds an entry, the entries don't need to be added in time order.
+// Of entries with equal timestamps, the first added one is the first and the last added one is the last.
+func (acc *accumulator) add(entry *TimeSeriesEntry) {
+	value := entry.Value
+	if acc.count == 0 {
+		acc.min, acc.max = value, value
+	}
+	if acc.count == 0 || entry.Timestamp.Before(acc.firstAt) {
+		acc.first, acc.firstAt = value, entry.Timestamp
+	}
+	if acc.count == 0 || !entry.Timestamp.Before(acc.lastAt) {
+		acc.last, acc.lastAt = value, entry.Timestamp
+	}
+	acc.count++
+	acc.sum += value
+	acc.sumSq += value * value
+	acc.min = math.Min(acc.min, value)
+	acc.max = math.Max(acc.max, value)
+}
+
+func (acc *accumulator) result(agg Aggregation) float64 {
+	switch agg {
+	case AggMin:
+		return acc.min
+	case AggMax:
+		return acc.max
+	case AggSum:
+		return acc.sum
+	case AggCount:
+		return float64(acc.count)
+	case AggFirst:
+		return acc.first
+	case AggLast:
+		return acc.last
+	case AggStddev:
+		mean := acc.sum / float64(acc.count)
+		return math.Sqrt(math.Max(0, acc.sumSq/float64(acc.count)-mean*mean))
+	default:
+		return acc.sum / float64(acc.count)
+	}
+}
+
+// bucketStart returns the start of the bucket containing stamp, buckets are aligned to from
+func bucketStart(stamp, from time.Time, step time.Duration) time.Time {
+	offset := stamp.Sub(from)
+	return from.Add(offset - offset%step)
+}
+
+// accumulate groups the (time ordered) entries of input into buckets of size step.
+// The returned function returns the next bucket or nil at the end, empty buckets are skipped.
+func accumulate(input Iterator, from time.Time, step time.Duration) func() (*accumulator, error) {
+	var pending *TimeSeriesEntry
+	done := false
+	return func() (*accumulator, error) {
+		var acc *accumulator
+		for {
+			entry := pending
+			pending = nil
+			if entry == nil {
+				if done || !input.Next() {
+					done = true
+					return acc, input.Err()
+				}
+				entry = input.Entry()
+			}
+			start := bucketStart(entry.Timestamp, from, step)
+			if acc != nil && !acc.start.Equal(start) {
+				pending = entry
+				return acc, nil
+			}
+			if acc == nil {
+				acc = &accumulator{start: start}
+			}
+			acc.add(entry)
+		}
+	}
+}
+
+// aggregateRange is the generic AggregateContext implementation based on GetRangeContext.
+// The timestamp of each resulting entry is the start of its bucket.
+func aggregateRange(ctx context.Context, store ContextStorage, key string, from, to time.Time, step time.Duration, agg Aggregation) (Iterator, error) {
+	if step <= 0 {
+		return nil, invalidArgument("step needs to be positive")
+	}
+	input, err := store.GetRangeContext(ctx, key, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return aggregateIterator(ctx, input, from, step, agg), nil
+}
+
+// aggregateSeriesWindow is the number of buckets AggregateSeries accumulates at once
+var aggregateSeriesWindow = 1024
+
+// AggregateSeries summarises a timerange of multiple timeseries into one entry per step,
+// the values of all timeseries are aggregated like they were a single timeseries.
+// The timeseries are read one after another for every window of aggregateSeriesWindow buckets,
+// so that only one of them is read at a time. Windows without any values are skipped.
+func AggregateSeries(ctx context.Context, store ContextStorage, keys []string, from, to time.Time, step time.Duration, agg Aggregation) (Iterator, error) {
+	if step <= 0 {
+		return nil, invalidArgument("step needs to be positive")
+	}
+	// unread holds the timestamp of the first entry of every timeseries which wasn't accumulated yet, nil if there is none
+	unread := make([]*time.Time, len(keys))
+	for i := range unread {
+		start := from
+		unread[i] = &start
+	}
+	var pending []*TimeSeriesEntry
+	return newFuncIterator(ctx, func() (*TimeSeriesEntry, error) {
+		for len(pending) == 0 {
+			var next *time.Time
+			for _, stamp := range unread {
+				if stamp != nil && (next == nil || stamp.Before(*next)) {
+					next = stamp
+				}
+			}
+			if next == nil {
+				return nil, nil
+			}
+			start := bucketStart(*next, from, step)
+			window := make([]*accumulator, aggregateSeriesWindow)
+			end := start.Add(time.Duration(len(window)) * step)
+			for i, key := range keys {
+				if unread[i] == nil {
+					continue
+				}
+				stamp, err := accumulateWindow(ctx, store, key, *unread[i], to, end, window, from, step)
+				if err != nil {
+					return nil, err
+				}
+				unread[i] = stamp
+			}
+			for _, acc := range window {
+				if acc != nil {
+					pending = append(pending, &TimeSeriesEntry{Value: acc.result(agg), Timestamp: acc.start})
+				}
+			}
+		}
+		entry := pending[0]
+		pending = pending[1:]
+		return entry, nil
+	}, func() error { return nil }), nil
+}
+
+// accumulateWindow adds the values of key between from and to which are before end to the buckets in window,
+// which starts at end minus its length. It returns the timestamp of the first value at or after end, nil if there is none.
+func accumulateWindow(ctx context.Context, store ContextStorage, key string, from, to, end time.Time, window []*accumulator, epoch time.Time, step time.Duration) (*time.Time, error) {
+	it, err := store.GetRangeContext(ctx, key, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	start := end.Add(-time.Duration(len(window)) * step)
+	for it.Next() {
+		entry := it.Entry()
+		if !entry.Timestamp.Before(end) {
+			stamp := entry.Timestamp
+			return &stamp, nil
+		}
+		i := bucketStart(entry.Timestamp, epoch, step).Sub(start) / step
+		if window[i] == nil {
+			window[i] = &accumulator{start: start.Add(i * step)}
+		}
+		window[i].add(entry)
+	}
+	return nil, it.Err()
+}
+
+// aggregateIterator aggregates the time ordered entries of input, it closes input once it is closed
+func aggregateIterator(ctx context.Context, input Iterator, from time.Time, step time.Duration, agg Aggregation) Iterator {
+	next := accumulate(input, from, step)
+	return newFuncIterator(ctx, func() (*TimeSeriesEntry, error) {
+		acc, err := next()
+		if acc == nil || err != nil {
+			return nil, err
+		}
+		return &TimeSeriesEntry{Value: acc.result(agg), Timestamp: acc.start}, nil
+	}, input.Close)
+}
@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregateSeriesWindows(t *testing.T) {
+	defer func(size int) { aggregateSeriesWindow = size }(aggregateSeriesWindow)
+	aggregateSeriesWindow = 2
+	store, err := NewMetaStorage("memory://")
+	assert.NoError(t, err)
+	defer store.Close()
+	base := time.Unix(1500000000, 0)
+	at := func(minutes int) time.Time { return base.Add(time.Duration(minutes) * time.Minute) }
+	assert.NoError(t, store.AddValues("a", []*TimeSeriesEntry{{Value: 1, Timestamp: at(0)}, {Value: 2, Timestamp: at(1)}, {Value: 3, Timestamp: at(5)}}))
+	assert.NoError(t, store.AddValues("b", []*TimeSeriesEntry{{Value: 4, Timestamp: at(1)}, {Value: 5, Timestamp: at(100)}}))
+
+	for agg, expected := range map[Aggregation][]float64{
+		AggSum:   {1, 6, 3, 5},
+		AggFirst: {1, 2, 3, 5},
+		AggLast:  {1, 4, 3, 5},
+	} {
+		it, err := AggregateSeries(context.Background(), store, []string{"a", "b"}, base, at(200), time.Minute, agg)
+		assert.NoError(t, err)
+		values, stamps := []float64{}, []time.Time{}
+		for it.Next() {
+			values = append(values, it.Entry().Value)
+			stamps = append(stamps, it.Entry().Timestamp)
+		}
+		assert.NoError(t, it.Err())
+		assert.NoError(t, it.Close())
+		assert.Equal(t, expected, values, agg)
+		assert.Equal(t, []time.Time{at(0), at(1), at(5), at(100)}, stamps, agg)
+	}
+}
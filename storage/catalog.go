@@ -0,0 +1,499 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SeriesInfo describes a timeseries in the series catalog
+type SeriesInfo struct {
+	Key   string
+	First time.Time
+	Last  time.Time
+	Count int64
+	// LastEntry is the entry at Last, the last added one if there are multiple
+	LastEntry *TimeSeriesEntry
+	// tracked and changes are the state of the ChangeTracker
+	tracked time.Time
+	changes SeriesChanges
+	// dirty marks an entry which may not match the timeseries, because an update of both was interrupted
+	dirty bool
+}
+
+// SeriesCatalog is implemented by storages which keep a catalog of their timeseries,
+// so that their metadata and last entries can be read without scanning them.
+type SeriesCatalog interface {
+	// SeriesInfo returns the catalog entry of the timeseries key, ErrNotFound if it has no values
+	SeriesInfo(ctx context.Context, key string) (*SeriesInfo, error)
+	// ListSeriesInfo returns the catalog entries of all timeseries starting with prefix in lexical order of their keys
+	ListSeriesInfo(ctx context.Context, prefix string) ([]*SeriesInfo, error)
+}
+
+// SeriesChanges is the timerange of a timeseries in which entries were added or deleted
+type SeriesChanges struct {
+	From time.Time
+	To   time.Time
+	// Generation counts the recorded changes, it is 0 if there are none
+	Generation int64
+}
+
+// ChangeTracker is implemented by storages which record in which timeranges the entries of a timeseries change,
+// so that data derived from older entries, like rollups, can be updated.
+type ChangeTracker interface {
+	// TrackChanges records the changes of entries of key before until from now on, an earlier until than before is ignored.
+	// It returns the changes recorded so far.
+	TrackChanges(ctx context.Context, key string, until time.Time) (SeriesChanges, error)
+	// ResetChanges forgets the recorded changes of key, unless there were more changes since they were returned by TrackChanges
+	ResetChanges(ctx context.Context, key string, changes SeriesChanges) error
+	// ExpireRange deletes the entries of key up to until like DeleteRange, but doesn't record it as a change,
+	// so that data derived from the entries is kept
+	ExpireRange(ctx context.Context, key string, until time.Time) error
+}
+
+// The catalog entry of a timeseries is kept in catalogPrefix followed by its key escaped with escapeKeySegment.
+// Timeseries without an entry have no values.
+const catalogPrefix = ReservedPrefix + "catalog/"
+
+// catalogBuiltKey marks that every timeseries has a catalog entry.
+// The entries of the timeseries written before the catalog existed are built once by buildCatalog.
+const catalogBuiltKey = ReservedPrefix + "catalog-built"
+
+// catalogEntry is the stored format of a SeriesInfo
+type catalogEntry struct {
+	First  int64              `json:"first"`
+	Last   int64              `json:"last"`
+	Count  int64              `json:"count"`
+	Value  float64            `json:"value"`
+	Fields map[string]float64 `json:"fields,omitempty"`
+	// Tracked is the time before which changes are recorded in ChangedFrom, ChangedTo and Changes
+	Tracked     int64 `json:"tracked,omitempty"`
+	ChangedFrom int64 `json:"changedFrom,omitempty"`
+	ChangedTo   int64 `json:"changedTo,omitempty"`
+	Changes     int64 `json:"changes,omitempty"`
+	Dirty       bool  `json:"dirty,omitempty"`
+}
+
+func catalogKey(key string) string {
+	return catalogPrefix + escapeKeySegment(key)
+}
+
+func encodeSeriesInfo(info *SeriesInfo) []byte {
+	entry := &catalogEntry{
+		First: info.First.UnixNano(),
+		Last:  info.Last.UnixNano(),
+		Count: info.Count,
+		Dirty: info.dirty,
+	}
+	// timeseries without values keep their entry while changes are tracked
+	if info.LastEntry != nil {
+		entry.Value, entry.Fields = info.LastEntry.Value, info.LastEntry.Fields
+	}
+	if !info.tracked.IsZero() {
+		entry.Tracked = info.tracked.UnixNano()
+	}
+	if info.changes.Generation > 0 {
+		entry.ChangedFrom = info.changes.From.UnixNano()
+		entry.ChangedTo = info.changes.To.UnixNano()
+		entry.Changes = info.changes.Generation
+	}
+	bs, _ := json.Marshal(entry)
+	return bs
+}
+
+func decodeSeriesInfo(key string, bs []byte) (*SeriesInfo, error) {
+	entry := &catalogEntry{}
+	if err := json.Unmarshal(bs, entry); err != nil {
+		return nil, fmt.Errorf("corrupted catalog entry of '%v': %w", key, err)
+	}
+	last := time.Unix(0, entry.Last)
+	info := &SeriesInfo{
+		Key:       key,
+		First:     time.Unix(0, entry.First),
+		Last:      last,
+		Count:     entry.Count,
+		LastEntry: &TimeSeriesEntry{Value: entry.Value, Timestamp: last, Fields: entry.Fields},
+		dirty:     entry.Dirty,
+	}
+	if entry.Tracked != 0 {
+		info.tracked = time.Unix(0, entry.Tracked)
+	}
+	if entry.Changes > 0 {
+		info.changes = SeriesChanges{From: time.Unix(0, entry.ChangedFrom), To: time.Unix(0, entry.ChangedTo), Generation: entry.Changes}
+	}
+	return info, nil
+}
+
+// add updates the info with entries which were added to the timeseries
+func (info *SeriesInfo) add(entries []*TimeSeriesEntry) {
+	for _, entry := range entries {
+		if info.Count == 0 || entry.Timestamp.Before(info.First) {
+			info.First = entry.Timestamp
+		}
+		if info.Count == 0 || !entry.Timestamp.Before(info.Last) {
+			info.Last = entry.Timestamp
+			info.LastEntry = &TimeSeriesEntry{Value: entry.Value, Timestamp: entry.Timestamp, Fields: copyFields(entry.Fields)}
+		}
+		info.Count++
+	}
+}
+
+// recordChange records that the entries of the timeseries in [from, to] changed, if the range starts before tracked
+func (info *SeriesInfo) recordChange(from, to time.Time) {
+	if info.tracked.IsZero() || !from.Before(info.tracked) {
+		return
+	}
+	changes := &info.changes
+	if changes.Generation == 0 || from.Before(changes.From) {
+		changes.From = from
+	}
+	if changes.Generation == 0 || to.After(changes.To) {
+		changes.To = to
+	}
+	changes.Generation++
+}
+
+// seriesLocks serializes the writes of a key together with the updates of its catalog entry and the events
+// published about them, so that watchers get the events in the order of the writes.
+// Keys are mapped to a fixed number of mutexes, so unrelated keys may share one.
+type seriesLocks [64]sync.Mutex
+
+func (locks *seriesLocks) index(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(locks)))
+}
+
+// lock locks the mutexes of all keys in a fixed order and returns the function unlocking them
+func (locks *seriesLocks) lock(keys ...string) func() {
+	indexes := make([]int, 0, len(keys))
+	seen := make(map[int]bool)
+	for _, key := range keys {
+		if i := locks.index(key); !seen[i] {
+			seen[i] = true
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		locks[i].Lock()
+	}
+	return func() {
+		for _, i := range indexes {
+			locks[i].Unlock()
+		}
+	}
+}
+
+// SeriesInfo returns the catalog entry of the timeseries key
+func (store *MetaStorage) SeriesInfo(ctx context.Context, key string) (*SeriesInfo, error) {
+	if err := checkKey(ctx, key); err != nil {
+		return nil, err
+	}
+	unlock := store.locks.lock(key)
+	defer unlock()
+	info, err := store.seriesInfo(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if info.Count == 0 {
+		return nil, notFound(key)
+	}
+	return info, nil
+}
+
+// ListSeriesInfo returns the catalog entries of all timeseries starting with prefix
+func (store *MetaStorage) ListSeriesInfo(ctx context.Context, prefix string) ([]*SeriesInfo, error) {
+	keys, err := store.ListSeriesContext(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*SeriesInfo, 0, len(keys))
+	for _, key := range keys {
+		info, err := store.SeriesInfo(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			// removed in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, info)
+	}
+	return res, nil
+}
+
+// seriesInfo reads the catalog entry of key, a timeseries without values has an info with a count of 0.
+// Dirty entries are rebuilt by scanning the timeseries, the lock of key has to be held.
+func (store *MetaStorage) seriesInfo(ctx context.Context, key string) (*SeriesInfo, error) {
+	bs, err := store.base.GetContext(ctx, catalogKey(key))
+	if errors.Is(err, ErrNotFound) {
+		return &SeriesInfo{Key: key}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := decodeSeriesInfo(key, bs)
+	if err != nil || !info.dirty {
+		return info, err
+	}
+	log.Printf("catalog: rebuilding the entry of '%v' after an interrupted update", key)
+	rebuilt, err := store.scanSeriesInfo(ctx, key, minTimestamp, maxTimestamp)
+	if err != nil {
+		return nil, err
+	}
+	rebuilt.tracked, rebuilt.changes = info.tracked, info.changes
+	return rebuilt, store.saveSeriesInfo(ctx, rebuilt)
+}
+
+// saveSeriesInfo writes the catalog entry of info.
+// The entry of a timeseries without values is removed, unless its changes are tracked.
+func (store *MetaStorage) saveSeriesInfo(ctx context.Context, info *SeriesInfo) error {
+	if info.Count <= 0 && info.tracked.IsZero() {
+		err := store.base.DeleteContext(ctx, catalogKey(info.Key))
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if info.Count <= 0 {
+		info.Count, info.LastEntry = 0, nil
+	}
+	return store.base.PutContext(ctx, catalogKey(info.Key), encodeSeriesInfo(info))
+}
+
+// buildCatalog creates the catalog entries of the timeseries which were written before the catalog existed.
+// It runs once when the store is opened, an interrupted run continues with the timeseries which have no entry yet.
+func (store *MetaStorage) buildCatalog(ctx context.Context) error {
+	_, err := store.base.GetContext(ctx, catalogBuiltKey)
+	if err == nil || !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	keys, err := store.base.ListSeriesContext(ctx, "")
+	if err != nil || len(keys) == 0 {
+		// new timeseries get their entries when they are written, so an empty store needs no marker
+		return err
+	}
+	built := 0
+	for _, key := range keys {
+		_, err := store.base.GetContext(ctx, catalogKey(key))
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		info, err := store.scanSeriesInfo(ctx, key, minTimestamp, maxTimestamp)
+		if err != nil {
+			return err
+		}
+		if err := store.saveSeriesInfo(ctx, info); err != nil {
+			return err
+		}
+		built++
+	}
+	if built > 0 {
+		log.Printf("catalog: built the entries of %v timeseries", built)
+	}
+	return store.base.PutContext(ctx, catalogBuiltKey, []byte("1"))
+}
+
+// scanSeriesInfo builds the info of the entries of key in a timerange
+func (store *MetaStorage) scanSeriesInfo(ctx context.Context, key string, from, to time.Time) (*SeriesInfo, error) {
+	info := &SeriesInfo{Key: key}
+	it, err := store.base.GetRangeContext(ctx, key, from, to)
+	if errors.Is(err, ErrNotFound) {
+		return info, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	for it.Next() {
+		info.add([]*TimeSeriesEntry{it.Entry()})
+	}
+	return info, it.Err()
+}
+
+// hasEntryAt checks if the timeseries key has an entry at stamp
+func (store *MetaStorage) hasEntryAt(ctx context.Context, key string, stamp time.Time) (bool, error) {
+	info, err := store.scanSeriesInfo(ctx, key, stamp, stamp)
+	if err != nil {
+		return false, err
+	}
+	return info.Count > 0, nil
+}
+
+// catalogAdds returns the catalog entries of the timeseries in txn after its add operations are applied.
+// Entries overwriting an existing entry are not counted, the locks of all timeseries in txn have to be held.
+func (store *MetaStorage) catalogAdds(ctx context.Context, txn *Txn) (map[string]*SeriesInfo, error) {
+	infos := make(map[string]*SeriesInfo)
+	// the timestamps added to every timeseries with the overwrite policy by txn so far
+	added := make(map[string]map[int64]bool)
+	for _, op := range txn.Ops {
+		if op.Type != TxnAddValue {
+			continue
+		}
+		info, ok := infos[op.Key]
+		if !ok {
+			var err error
+			if info, err = store.seriesInfo(ctx, op.Key); err != nil {
+				return nil, err
+			}
+			infos[op.Key] = info
+		}
+		stamp := op.Entry.Timestamp
+		info.recordChange(stamp, stamp)
+		if DuplicatePolicyFor(store.base.DuplicateRules(), op.Key) != DuplicateOverwrite {
+			info.add([]*TimeSeriesEntry{op.Entry})
+			continue
+		}
+		if added[op.Key] == nil {
+			added[op.Key] = make(map[int64]bool)
+		}
+		overwrites := added[op.Key][stamp.UnixNano()]
+		if !overwrites && info.Count > 0 && !stamp.After(info.Last) && !stamp.Before(info.First) {
+			var err error
+			if overwrites, err = store.hasEntryAt(ctx, op.Key, stamp); err != nil {
+				return nil, err
+			}
+		}
+		added[op.Key][stamp.UnixNano()] = true
+		info.add([]*TimeSeriesEntry{op.Entry})
+		if overwrites {
+			info.Count--
+		}
+	}
+	return infos, nil
+}
+
+// commitWithCatalog commits txn together with the updated catalog entries of the timeseries it adds values to.
+// It returns the new versions of the keys written by the put operations of txn. The caller holds the locks of the keys of txn.
+func (store *MetaStorage) commitWithCatalog(ctx context.Context, txn *Txn) ([]uint64, error) {
+	infos, err := store.catalogAdds(ctx, txn)
+	if err != nil {
+		return nil, err
+	}
+	// the catalog entries are written behind the operations of txn, so the versions of its operations keep their indexes
+	withCatalog := &Txn{append([]*TxnOp{}, txn.Ops...)}
+	for key, info := range infos {
+		withCatalog.Put(catalogKey(key), encodeSeriesInfo(info))
+	}
+	return store.writer.commitVersioned(ctx, withCatalog)
+}
+
+// deleteRangeWithCatalog deletes a timerange of key and updates its catalog entry.
+// The entries in the range are counted before they are deleted. The new first entry is found by reading the
+// first entry behind the range, the new last entry needs a scan of all entries before the range.
+// The catalog entry is marked as dirty until the entries are deleted, so that it is rebuilt by the next read
+// if the delete fails or is interrupted. The deleted range is recorded as a change if record is set.
+func (store *MetaStorage) deleteRangeWithCatalog(ctx context.Context, key string, from, to time.Time, record bool) error {
+	unlock := store.locks.lock(key)
+	defer unlock()
+	info, err := store.seriesInfo(ctx, key)
+	if err != nil {
+		return err
+	}
+	if info.Count == 0 || to.Before(info.First) || from.After(info.Last) {
+		return store.base.DeleteRangeContext(ctx, key, from, to)
+	}
+	deleted, err := store.scanSeriesInfo(ctx, key, from, to)
+	if err != nil {
+		return err
+	}
+	rest := *info
+	if deleted.Count > 0 && record {
+		rest.recordChange(deleted.First, deleted.Last)
+	}
+	rest.dirty = true
+	if err := store.base.PutContext(ctx, catalogKey(key), encodeSeriesInfo(&rest)); err != nil {
+		return err
+	}
+	if err := store.base.DeleteRangeContext(ctx, key, from, to); err != nil {
+		return err
+	}
+	rest.dirty = false
+	rest.Count -= deleted.Count
+	if rest.Count <= 0 {
+		if err := store.saveSeriesInfo(ctx, &rest); err != nil {
+			return err
+		}
+		// the labels belong to the timeseries, which is gone with its last entry
+		return store.SetLabels(ctx, key, nil)
+	}
+	if !from.After(info.First) {
+		it, err := store.base.GetRangeContext(ctx, key, to.Add(1), info.Last)
+		if err != nil {
+			return err
+		}
+		if it.Next() {
+			rest.First = it.Entry().Timestamp
+		}
+		err = it.Err()
+		it.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if !to.Before(info.Last) {
+		before, err := store.scanSeriesInfo(ctx, key, rest.First, from.Add(-1))
+		if err != nil {
+			return err
+		}
+		rest.Last, rest.LastEntry = before.Last, before.LastEntry
+	}
+	return store.saveSeriesInfo(ctx, &rest)
+}
+
+// TrackChanges records the changes of entries of key before until in its catalog entry
+func (store *MetaStorage) TrackChanges(ctx context.Context, key string, until time.Time) (SeriesChanges, error) {
+	if err := checkKey(ctx, key); err != nil {
+		return SeriesChanges{}, err
+	}
+	unlock := store.locks.lock(key)
+	defer unlock()
+	info, err := store.seriesInfo(ctx, key)
+	if err != nil {
+		return SeriesChanges{}, err
+	}
+	if !until.After(info.tracked) {
+		return info.changes, nil
+	}
+	info.tracked = until
+	return info.changes, store.base.PutContext(ctx, catalogKey(key), encodeSeriesInfo(info))
+}
+
+// ExpireRange deletes the entries of key up to until without recording a change
+func (store *MetaStorage) ExpireRange(ctx context.Context, key string, until time.Time) error {
+	if err := checkKey(ctx, key); err != nil {
+		return err
+	}
+	return store.deleteRangeWithCatalog(ctx, key, time.Time{}, until, false)
+}
+
+// ResetChanges removes the recorded changes from the catalog entry of key if it has no newer ones
+func (store *MetaStorage) ResetChanges(ctx context.Context, key string, changes SeriesChanges) error {
+	if err := checkKey(ctx, key); err != nil {
+		return err
+	}
+	if changes.Generation == 0 {
+		return nil
+	}
+	unlock := store.locks.lock(key)
+	defer unlock()
+	info, err := store.seriesInfo(ctx, key)
+	if err != nil {
+		return err
+	}
+	if info.changes.Generation != changes.Generation {
+		return nil
+	}
+	info.changes = SeriesChanges{}
+	return store.base.PutContext(ctx, catalogKey(key), encodeSeriesInfo(info))
+}
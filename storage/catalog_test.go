@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildCatalog(t *testing.T) {
+	path := "./test-catalog.db"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	base := time.Unix(1500000000, 0)
+	// timeseries written without the catalog
+	bolt, err := NewBoltStorage(path)
+	assert.NoError(t, err)
+	assert.NoError(t, bolt.AddValues("foo", []*TimeSeriesEntry{{Value: 1, Timestamp: base}, {Value: 2, Timestamp: base.Add(time.Second)}}))
+	assert.NoError(t, bolt.Close())
+
+	store, err := NewMetaStorage("bolt://" + path)
+	assert.NoError(t, err)
+	defer store.Close()
+	info, err := store.(SeriesCatalog).SeriesInfo(context.Background(), "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2), info.Count)
+		assert.Equal(t, base.UnixNano(), info.First.UnixNano())
+		assert.Equal(t, 2., info.LastEntry.Value)
+	}
+	_, err = store.Get(catalogBuiltKey)
+	assert.NoError(t, err)
+}
+
+func TestRepairCatalog(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMetaStorage("memory://")
+	assert.NoError(t, err)
+	defer store.Close()
+	meta := store.(*MetaStorage)
+	base := time.Unix(1500000000, 0)
+	assert.NoError(t, store.AddValues("foo", []*TimeSeriesEntry{{Value: 1, Timestamp: base}, {Value: 2, Timestamp: base.Add(time.Second)}}))
+
+	// a delete which was interrupted after the entry was marked as dirty
+	info, err := meta.SeriesInfo(ctx, "foo")
+	assert.NoError(t, err)
+	info.dirty = true
+	assert.NoError(t, meta.base.PutContext(ctx, catalogKey("foo"), encodeSeriesInfo(info)))
+	assert.NoError(t, meta.base.DeleteRangeContext(ctx, "foo", base, base))
+
+	info, err = meta.SeriesInfo(ctx, "foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1), info.Count)
+		assert.Equal(t, base.Add(time.Second).UnixNano(), info.First.UnixNano())
+	}
+	bs, err := meta.base.GetContext(ctx, catalogKey("foo"))
+	assert.NoError(t, err)
+	info, err = decodeSeriesInfo("foo", bs)
+	assert.NoError(t, err)
+	assert.False(t, info.dirty)
+}
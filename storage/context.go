@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// noContext implements the Storage methods without context on top of their context variants.
+// The storages embed it, so that they only need to implement the context variants.
+type noContext struct {
+	store ContextStorage
+}
+
+// Put saves a value
+func (s noContext) Put(key string, value []byte) error {
+	return s.store.PutContext(context.Background(), key, value)
+}
+
+// PutWithTTL saves a value which expires after ttl
+func (s noContext) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	return s.store.PutWithTTLContext(context.Background(), key, value, ttl)
+}
+
+// Get retrieves a value
+func (s noContext) Get(key string) ([]byte, error) {
+	return s.store.GetContext(context.Background(), key)
+}
+
+// GetVersioned retrieves a value and its version
+func (s noContext) GetVersioned(key string) ([]byte, uint64, error) {
+	return s.store.GetVersionedContext(context.Background(), key)
+}
+
+// CompareAndSwap saves a value if the current version of key is expectedVersion
+func (s noContext) CompareAndSwap(key string, expectedVersion uint64, value []byte) (uint64, error) {
+	return s.store.CompareAndSwapContext(context.Background(), key, expectedVersion, value)
+}
+
+// Delete drops an entry
+func (s noContext) Delete(key string) error {
+	return s.store.DeleteContext(context.Background(), key)
+}
+
+// CompareAndDelete drops an entry if its current version is expectedVersion
+func (s noContext) CompareAndDelete(key string, expectedVersion uint64) error {
+	return s.store.CompareAndDeleteContext(context.Background(), key, expectedVersion)
+}
+
+// List returns all keys starting with prefix
+func (s noContext) List(prefix string) ([]string, error) {
+	return s.store.ListContext(context.Background(), prefix)
+}
+
+// Scan returns at most limit keys in the range [start, end)
+func (s noContext) Scan(start, end string, limit int) ([]string, error) {
+	return s.store.ScanContext(context.Background(), start, end, limit)
+}
+
+// AddValue saves a value to the given timeseries
+func (s noContext) AddValue(key string, value float64) error {
+	return s.store.AddValueContext(context.Background(), key, value)
+}
+
+// AddValues saves multiple values to the given timeseries
+func (s noContext) AddValues(key string, entries []*TimeSeriesEntry) error {
+	return s.store.AddValuesContext(context.Background(), key, entries)
+}
+
+// GetRange returns a channel which will give all values in a timerange
+func (s noContext) GetRange(key string, from time.Time, to time.Time) (chan *TimeSeriesEntry, error) {
+	it, err := s.store.GetRangeContext(context.Background(), key, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return iteratorToChan(it), nil
+}
+
+// DeleteRange deletes a range from a timeseries
+func (s noContext) DeleteRange(key string, from time.Time, to time.Time) error {
+	return s.store.DeleteRangeContext(context.Background(), key, from, to)
+}
+
+// ListSeries returns the keys of all timeseries starting with prefix
+func (s noContext) ListSeries(prefix string) ([]string, error) {
+	return s.store.ListSeriesContext(context.Background(), prefix)
+}
+
+// Aggregate returns one aggregated value per step in a timerange
+func (s noContext) Aggregate(key string, from time.Time, to time.Time, step time.Duration, agg Aggregation) (chan *TimeSeriesEntry, error) {
+	it, err := s.store.AggregateContext(context.Background(), key, from, to, step, agg)
+	if err != nil {
+		return nil, err
+	}
+	return iteratorToChan(it), nil
+}
+
+// Commit applies all operations of txn atomically
+func (s noContext) Commit(txn *Txn) error {
+	return s.store.CommitContext(context.Background(), txn)
+}
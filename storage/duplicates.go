@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DuplicatePolicy decides what happens to a value which is added to a timeseries at an already used timestamp
+type DuplicatePolicy string
+
+const (
+	// DuplicateOverwrite replaces the existing value, this is the default
+	DuplicateOverwrite DuplicatePolicy = "overwrite"
+	// DuplicateReject fails the write with ErrDuplicateTimestamp
+	DuplicateReject DuplicatePolicy = "reject"
+	// DuplicateKeep keeps all values, they are returned in the order they were added
+	DuplicateKeep DuplicatePolicy = "keep"
+)
+
+// ErrDuplicateTimestamp is returned if a value is added at an already used timestamp of a timeseries with the reject policy
+var ErrDuplicateTimestamp = fmt.Errorf("%w: duplicate timestamp", ErrConflict)
+
+func duplicateTimestamp(key string, stamp time.Time) error {
+	return fmt.Errorf("%w: '%v' already has a value at %v", ErrDuplicateTimestamp, key, stamp.UnixNano())
+}
+
+// ParseDuplicatePolicy parses the name of a duplicate policy
+func ParseDuplicatePolicy(str string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(str); policy {
+	case DuplicateOverwrite, DuplicateReject, DuplicateKeep:
+		return policy, nil
+	}
+	return "", invalidArgument(fmt.Sprintf("unknown duplicate policy '%v'", str))
+}
+
+// DuplicateRule specifies the duplicate policy of the matching timeseries.
+// The patterns work like the ones of retention rules.
+type DuplicateRule struct {
+	Pattern string
+	Policy  DuplicatePolicy
+}
+
+// ParseDuplicateRule parses rules of the form "sensors/* keep"
+func ParseDuplicateRule(str string) (*DuplicateRule, error) {
+	fields := strings.Fields(str)
+	if len(fields) != 2 {
+		return nil, invalidArgument(fmt.Sprintf("malformed duplicate rule '%v', expected '<pattern> overwrite|reject|keep'", str))
+	}
+	policy, err := ParseDuplicatePolicy(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	return &DuplicateRule{fields[0], policy}, nil
+}
+
+// Matches checks if the rule applies to the given timeseries key
+func (rule *DuplicateRule) Matches(key string) bool {
+	return matchesPattern(rule.Pattern, key)
+}
+
+func (rule *DuplicateRule) String() string {
+	return fmt.Sprintf("%v %v", rule.Pattern, rule.Policy)
+}
+
+// duplicateRules holds the duplicate rules of a storage, the storages embed it
+type duplicateRules struct {
+	mutex sync.RWMutex
+	rules []*DuplicateRule
+}
+
+// SetDuplicateRules replaces the duplicate rules
+func (d *duplicateRules) SetDuplicateRules(rules []*DuplicateRule) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.rules = rules
+}
+
+// DuplicateRules returns the current duplicate rules
+func (d *duplicateRules) DuplicateRules() []*DuplicateRule {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.rules
+}
+
+// policyFor returns the duplicate policy of key
+func (d *duplicateRules) policyFor(key string) DuplicatePolicy {
+	return DuplicatePolicyFor(d.DuplicateRules(), key)
+}
+
+// DuplicatePolicyFor returns the policy of the most specific rule for key, DuplicateOverwrite if no rule matches
+func DuplicatePolicyFor(rules []*DuplicateRule, key string) DuplicatePolicy {
+	var match *DuplicateRule
+	for _, rule := range rules {
+		if rule.Matches(key) && (match == nil || len(rule.Pattern) > len(match.Pattern)) {
+			match = rule
+		}
+	}
+	if match == nil {
+		return DuplicateOverwrite
+	}
+	return match.Policy
+}
+
+// appendSequence appends the sequence number of a kept duplicate to the encoded timestamp of an entry.
+// The first value at a timestamp has no sequence number, so that it sorts first.
+func appendSequence(key []byte, seq uint32) []byte {
+	if seq == 0 {
+		return key
+	}
+	return binary.BigEndian.AppendUint32(key, seq)
+}
+
+// decodeSequence returns the sequence number of an entry from the bytes behind its encoded timestamp
+func decodeSequence(suffix []byte) uint32 {
+	if len(suffix) != 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(suffix)
+}
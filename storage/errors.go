@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The backends wrap their errors into one of these, use errors.Is to check for them
+var (
+	// ErrNotFound is returned if a key or timeseries doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned if a write conflicts with the current content of the store
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidKey is returned for keys which can't be stored
+	ErrInvalidKey = errors.New("invalid key")
+	// ErrInvalidArgument is returned for malformed arguments like a negative step
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrBackendUnavailable is returned if the backend can't be reached or is closed
+	ErrBackendUnavailable = errors.New("backend unavailable")
+)
+
+// ErrVersionMismatch is returned by conditional writes if the current version of a key is not the expected one
+var ErrVersionMismatch = fmt.Errorf("%w: version mismatch", ErrConflict)
+
+// kindError marks a backend specific error as one of the errors above
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e *kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// wrapError marks err as kind, errors.Is holds for both kind and err afterwards
+func wrapError(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind, err}
+}
+
+func notFound(key string) error {
+	return fmt.Errorf("%w: '%v'", ErrNotFound, key)
+}
+
+func invalidArgument(msg string) error {
+	return fmt.Errorf("%w: %v", ErrInvalidArgument, msg)
+}
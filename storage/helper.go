@@ -3,8 +3,18 @@ package storage
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// TTLSweepInterval is the interval in which expired kv entries are physically removed
+var TTLSweepInterval = time.Minute
+
 // FloatToBytes converts a float64 to bytes
 func FloatToBytes(value float64) []byte {
 	buf := &bytes.Buffer{}
@@ -19,3 +29,252 @@ func BytesToFloat(data []byte) float64 {
 	binary.Read(buf, binary.LittleEndian, &result)
 	return result
 }
+
+// encodeEntryValue converts the value and the fields of entry to bytes.
+// The value is stored like FloatToBytes does, the fields follow sorted by name
+// as uvarint length of the name, the name and the value.
+func encodeEntryValue(entry *TimeSeriesEntry) []byte {
+	bs := FloatToBytes(entry.Value)
+	names := make([]string, 0, len(entry.Fields))
+	for name := range entry.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		bs = binary.AppendUvarint(bs, uint64(len(name)))
+		bs = append(bs, name...)
+		bs = binary.LittleEndian.AppendUint64(bs, math.Float64bits(entry.Fields[name]))
+	}
+	return bs
+}
+
+// decodeEntryValue converts the output of encodeEntryValue back to the value and the fields of an entry
+func decodeEntryValue(bs []byte) (float64, map[string]float64) {
+	if len(bs) < 8 {
+		return BytesToFloat(bs), nil
+	}
+	value := BytesToFloat(bs[:8])
+	var fields map[string]float64
+	for rest := bs[8:]; len(rest) > 0; {
+		length, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < length+8 {
+			break
+		}
+		if fields == nil {
+			fields = make(map[string]float64)
+		}
+		name := string(rest[n : n+int(length)])
+		rest = rest[n+int(length):]
+		fields[name] = math.Float64frombits(binary.LittleEndian.Uint64(rest))
+		rest = rest[8:]
+	}
+	return value, fields
+}
+
+// copyFields returns a copy of the fields of an entry
+func copyFields(fields map[string]float64) map[string]float64 {
+	if fields == nil {
+		return nil
+	}
+	res := make(map[string]float64, len(fields))
+	for name, value := range fields {
+		res[name] = value
+	}
+	return res
+}
+
+// PrefixEnd returns the smallest key which is greater than all keys starting with prefix.
+// An empty string is returned if there is no such key (which means "no upper bound" in Scan)
+func PrefixEnd(prefix string) string {
+	bs := []byte(prefix)
+	for i := len(bs) - 1; i >= 0; i-- {
+		if bs[i] < 0xff {
+			bs[i]++
+			return string(bs[:i+1])
+		}
+	}
+	return ""
+}
+
+// keyInRange checks if start <= key < end, an empty end means no upper bound
+func keyInRange(key, start, end string) bool {
+	return key >= start && (end == "" || key < end)
+}
+
+// prefixInRange checks if any key starting with prefix can be in the range [start, end)
+func prefixInRange(prefix, start, end string) bool {
+	if end != "" && prefix >= end {
+		return false
+	}
+	if start > prefix && !strings.HasPrefix(start, prefix) {
+		return false
+	}
+	return true
+}
+
+// matchesPattern checks if key matches a rule pattern.
+// A pattern ending with '*' matches all keys with the given prefix, other patterns match exactly one key.
+func matchesPattern(pattern, key string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(key, pattern[:len(pattern)-1])
+	}
+	return key == pattern
+}
+
+// limitKeys truncates a sorted list of keys to limit entries, a limit <= 0 means no limit
+func limitKeys(keys []string, limit int) []string {
+	if limit > 0 && len(keys) > limit {
+		return keys[:limit]
+	}
+	return keys
+}
+
+// encodeExpiry converts an expiry time to 8 big endian bytes
+func encodeExpiry(stamp time.Time) []byte {
+	bs := make([]byte, 8)
+	binary.BigEndian.PutUint64(bs, uint64(stamp.UnixNano()))
+	return bs
+}
+
+// isExpired checks if an encoded expiry time is before now, missing expiry times never expire
+func isExpired(expiry []byte, now time.Time) bool {
+	if len(expiry) != 8 {
+		return false
+	}
+	return int64(binary.BigEndian.Uint64(expiry)) <= now.UnixNano()
+}
+
+// the range of timestamps which can be represented in nanoseconds
+var (
+	minTimestamp = time.Unix(0, math.MinInt64)
+	maxTimestamp = time.Unix(0, math.MaxInt64)
+)
+
+// encodeTimestamp converts a timestamp to 8 big endian bytes which sort like the timestamps.
+// The sign bit is flipped, so that timestamps before 1970 sort first.
+// Timestamps which can't be represented in nanoseconds (like time.Time{}) are clamped.
+func encodeTimestamp(stamp time.Time) []byte {
+	nanos := stamp.UnixNano()
+	switch {
+	case stamp.Before(minTimestamp):
+		nanos = math.MinInt64
+	case stamp.After(maxTimestamp):
+		nanos = math.MaxInt64
+	}
+	bs := make([]byte, 8)
+	binary.BigEndian.PutUint64(bs, uint64(nanos)^(1<<63))
+	return bs
+}
+
+// decodeTimestamp converts the output of encodeTimestamp back to a timestamp
+func decodeTimestamp(bs []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(bs)^(1<<63)))
+}
+
+// runSweeper calls sweep every TTLSweepInterval until stop is closed
+func runSweeper(sweep func() error, stop chan struct{}) {
+	ticker := time.NewTicker(TTLSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := sweep(); err != nil {
+				log.Print("failed to remove expired entries: ", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// closeOnce makes Close of a store idempotent, the first call closes it and the later ones return its result
+type closeOnce struct {
+	once sync.Once
+	err  error
+}
+
+func (c *closeOnce) do(fn func() error) error {
+	c.once.Do(func() {
+		c.err = fn()
+	})
+	return c.err
+}
+
+// encodeVersion converts a version to 8 big endian bytes
+func encodeVersion(version uint64) []byte {
+	bs := make([]byte, 8)
+	binary.BigEndian.PutUint64(bs, version)
+	return bs
+}
+
+// decodeVersion converts 8 big endian bytes to a version, a missing version is 0
+func decodeVersion(bs []byte) uint64 {
+	if len(bs) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(bs)
+}
+
+// versionMatches checks the precondition of a conditional write.
+// An expected version of 0 means that the key must not exist.
+func versionMatches(exists bool, current, expected uint64) bool {
+	if !exists {
+		return expected == 0
+	}
+	return expected != 0 && current == expected
+}
+
+// validateKey checks that key can be stored by all backends.
+// Keys are paths, so they must not be empty, start or end with a slash or contain empty segments.
+func validateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") || strings.Contains(key, "//") {
+		return fmt.Errorf("%w: '%v'", ErrInvalidKey, key)
+	}
+	return nil
+}
+
+// LastSuffix is reserved at the end of timeseries keys, it addresses the last entry of a timeseries in the HTTP API
+const LastSuffix = "/last"
+
+// validateSeriesKey checks the key of a timeseries which values are added to.
+// Keys ending with LastSuffix are rejected and RollupSeparator is only allowed in the reserved namespace,
+// existing timeseries with such keys can still be read and deleted.
+func validateSeriesKey(key string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if strings.HasSuffix(key, LastSuffix) {
+		return fmt.Errorf("%w: '%v', keys of timeseries can't end with %v", ErrInvalidKey, key, LastSuffix)
+	}
+	if strings.Contains(key, RollupSeparator) && !IsReserved(key) {
+		return fmt.Errorf("%w: '%v', keys of timeseries can't contain %v", ErrInvalidKey, key, RollupSeparator)
+	}
+	return nil
+}
+
+// keySegmentEscaper escapes keys into a single key segment, keySegmentUnescaper reverts it
+var (
+	keySegmentEscaper   = strings.NewReplacer("%", "%25", "/", "%2F")
+	keySegmentUnescaper = strings.NewReplacer("%25", "%", "%2F", "/")
+)
+
+// escapeKeySegment makes key usable as the last segment of another key.
+// BoltStorage keeps the segments of kv keys in nested buckets, so keys derived from nested keys
+// like a and a/b would collide without it.
+func escapeKeySegment(key string) string {
+	return keySegmentEscaper.Replace(key)
+}
+
+func unescapeKeySegment(segment string) string {
+	return keySegmentUnescaper.Replace(segment)
+}
+
+// validateFields checks that the field names of entry can be told apart from the default field
+func validateFields(entry *TimeSeriesEntry) error {
+	for name := range entry.Fields {
+		if name == "" || name == DefaultField {
+			return invalidArgument(fmt.Sprintf("invalid field name '%v'", name))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// OperationObserver is called with the duration and the result of every operation of an InstrumentedStorage.
+// The method is the name of the Storage method without the Context suffix, like "Put" or "GetRange".
+type OperationObserver func(method string, duration time.Duration, err error)
+
+// InstrumentedStorage decorates a Storage and reports all of its operations to an observer.
+// Reading a timerange is reported once its iterator is closed, so the duration includes the iteration.
+//
+// It implements the optional interfaces Watcher, SeriesWatcher, Labeler, SeriesCatalog, ChangeTracker and Sizer by forwarding
+// them to the decorated storage, use Supports to check if that storage really implements them.
+type InstrumentedStorage struct {
+	noContext
+	base     Storage
+	observer OperationObserver
+}
+
+// NewInstrumentedStorage decorates base, so that its operations are reported to observer
+func NewInstrumentedStorage(base Storage, observer OperationObserver) *InstrumentedStorage {
+	store := &InstrumentedStorage{base: base, observer: observer}
+	store.noContext = noContext{store}
+	return store
+}
+
+// Unwrap returns the decorated storage
+func (store *InstrumentedStorage) Unwrap() Storage {
+	return store.base
+}
+
+// Supports checks if the storage behind all decorators implements the optional interface T, like Watcher or Labeler.
+// Decorators implement all optional interfaces, so type assertions on them always succeed.
+func Supports[T any](store Storage) bool {
+	for {
+		decorator, ok := store.(interface{ Unwrap() Storage })
+		if !ok {
+			break
+		}
+		store = decorator.Unwrap()
+	}
+	_, ok := store.(T)
+	return ok
+}
+
+// errNotSupported is returned by the forwarded optional interfaces if the decorated storage doesn't implement them
+var errNotSupported = errors.New("the decorated storage doesn't support the operation")
+
+// observe reports an operation which started at start, it is deferred with a pointer to the result of the operation
+func (store *InstrumentedStorage) observe(method string, start time.Time, err *error) {
+	store.observer(method, time.Since(start), *err)
+}
+
+func (store *InstrumentedStorage) PutContext(ctx context.Context, key string, value []byte) (err error) {
+	defer store.observe("Put", time.Now(), &err)
+	return store.base.PutContext(ctx, key, value)
+}
+
+func (store *InstrumentedStorage) PutWithTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) (err error) {
+	defer store.observe("PutWithTTL", time.Now(), &err)
+	return store.base.PutWithTTLContext(ctx, key, value, ttl)
+}
+
+func (store *InstrumentedStorage) GetContext(ctx context.Context, key string) (_ []byte, err error) {
+	defer store.observe("Get", time.Now(), &err)
+	return store.base.GetContext(ctx, key)
+}
+
+func (store *InstrumentedStorage) GetVersionedContext(ctx context.Context, key string) (_ []byte, _ uint64, err error) {
+	defer store.observe("GetVersioned", time.Now(), &err)
+	return store.base.GetVersionedContext(ctx, key)
+}
+
+func (store *InstrumentedStorage) CompareAndSwapContext(ctx context.Context, key string, expectedVersion uint64, value []byte) (_ uint64, err error) {
+	defer store.observe("CompareAndSwap", time.Now(), &err)
+	return store.base.CompareAndSwapContext(ctx, key, expectedVersion, value)
+}
+
+func (store *InstrumentedStorage) DeleteContext(ctx context.Context, key string) (err error) {
+	defer store.observe("Delete", time.Now(), &err)
+	return store.base.DeleteContext(ctx, key)
+}
+
+func (store *InstrumentedStorage) CompareAndDeleteContext(ctx context.Context, key string, expectedVersion uint64) (err error) {
+	defer store.observe("CompareAndDelete", time.Now(), &err)
+	return store.base.CompareAndDeleteContext(ctx, key, expectedVersion)
+}
+
+func (store *InstrumentedStorage) ListContext(ctx context.Context, prefix string) (_ []string, err error) {
+	defer store.observe("List", time.Now(), &err)
+	return store.base.ListContext(ctx, prefix)
+}
+
+func (store *InstrumentedStorage) ScanContext(ctx context.Context, start, end string, limit int) (_ []string, err error) {
+	defer store.observe("Scan", time.Now(), &err)
+	return store.base.ScanContext(ctx, start, end, limit)
+}
+
+func (store *InstrumentedStorage) AddValueContext(ctx context.Context, key string, value float64) (err error) {
+	defer store.observe("AddValue", time.Now(), &err)
+	return store.base.AddValueContext(ctx, key, value)
+}
+
+func (store *InstrumentedStorage) AddValuesContext(ctx context.Context, key string, entries []*TimeSeriesEntry) (err error) {
+	defer store.observe("AddValues", time.Now(), &err)
+	return store.base.AddValuesContext(ctx, key, entries)
+}
+
+func (store *InstrumentedStorage) GetRangeContext(ctx context.Context, key string, from time.Time, to time.Time) (Iterator, error) {
+	start := time.Now()
+	it, err := store.base.GetRangeContext(ctx, key, from, to)
+	if err != nil {
+		store.observe("GetRange", start, &err)
+		return nil, err
+	}
+	return &observedIterator{Iterator: it, store: store, method: "GetRange", start: start}, nil
+}
+
+func (store *InstrumentedStorage) DeleteRangeContext(ctx context.Context, key string, from time.Time, to time.Time) (err error) {
+	defer store.observe("DeleteRange", time.Now(), &err)
+	return store.base.DeleteRangeContext(ctx, key, from, to)
+}
+
+func (store *InstrumentedStorage) ListSeriesContext(ctx context.Context, prefix string) (_ []string, err error) {
+	defer store.observe("ListSeries", time.Now(), &err)
+	return store.base.ListSeriesContext(ctx, prefix)
+}
+
+func (store *InstrumentedStorage) AggregateContext(ctx context.Context, key string, from time.Time, to time.Time, step time.Duration, agg Aggregation) (Iterator, error) {
+	start := time.Now()
+	it, err := store.base.AggregateContext(ctx, key, from, to, step, agg)
+	if err != nil {
+		store.observe("Aggregate", start, &err)
+		return nil, err
+	}
+	return &observedIterator{Iterator: it, store: store, method: "Aggregate", start: start}, nil
+}
+
+func (store *InstrumentedStorage) CommitContext(ctx context.Context, txn *Txn) (err error) {
+	defer store.observe("Commit", time.Now(), &err)
+	return store.base.CommitContext(ctx, txn)
+}
+
+func (store *InstrumentedStorage) SetDuplicateRules(rules []*DuplicateRule) {
+	store.base.SetDuplicateRules(rules)
+}
+
+func (store *InstrumentedStorage) DuplicateRules() []*DuplicateRule {
+	return store.base.DuplicateRules()
+}
+
+func (store *InstrumentedStorage) Close() error {
+	return store.base.Close()
+}
+
+// Watch forwards to the decorated storage, the channel is closed immediately if it isn't a Watcher
+func (store *InstrumentedStorage) Watch(prefix string) (<-chan *Event, func()) {
+	if watcher, ok := store.base.(Watcher); ok {
+		return watcher.Watch(prefix)
+	}
+	return closedEvents(), func() {}
+}
+
+// Follow forwards to the decorated storage, the channel is closed immediately if it isn't a SeriesWatcher
+func (store *InstrumentedStorage) Follow(key string) (<-chan *Event, func()) {
+	if follower, ok := store.base.(SeriesWatcher); ok {
+		return follower.Follow(key)
+	}
+	return closedEvents(), func() {}
+}
+
+func closedEvents() <-chan *Event {
+	ch := make(chan *Event)
+	close(ch)
+	return ch
+}
+
+func (store *InstrumentedStorage) SetLabels(ctx context.Context, key string, labels Labels) (err error) {
+	defer store.observe("SetLabels", time.Now(), &err)
+	labeler, ok := store.base.(Labeler)
+	if !ok {
+		return errNotSupported
+	}
+	return labeler.SetLabels(ctx, key, labels)
+}
+
+func (store *InstrumentedStorage) Labels(ctx context.Context, key string) (_ Labels, err error) {
+	defer store.observe("Labels", time.Now(), &err)
+	labeler, ok := store.base.(Labeler)
+	if !ok {
+		return nil, errNotSupported
+	}
+	return labeler.Labels(ctx, key)
+}
+
+func (store *InstrumentedStorage) MatchSeries(ctx context.Context, matchers []*LabelMatcher) (_ []*LabeledSeries, err error) {
+	defer store.observe("MatchSeries", time.Now(), &err)
+	labeler, ok := store.base.(Labeler)
+	if !ok {
+		return nil, errNotSupported
+	}
+	return labeler.MatchSeries(ctx, matchers)
+}
+
+func (store *InstrumentedStorage) SeriesInfo(ctx context.Context, key string) (_ *SeriesInfo, err error) {
+	defer store.observe("SeriesInfo", time.Now(), &err)
+	catalog, ok := store.base.(SeriesCatalog)
+	if !ok {
+		return nil, errNotSupported
+	}
+	return catalog.SeriesInfo(ctx, key)
+}
+
+func (store *InstrumentedStorage) ListSeriesInfo(ctx context.Context, prefix string) (_ []*SeriesInfo, err error) {
+	defer store.observe("ListSeriesInfo", time.Now(), &err)
+	catalog, ok := store.base.(SeriesCatalog)
+	if !ok {
+		return nil, errNotSupported
+	}
+	return catalog.ListSeriesInfo(ctx, prefix)
+}
+
+func (store *InstrumentedStorage) TrackChanges(ctx context.Context, key string, until time.Time) (_ SeriesChanges, err error) {
+	defer store.observe("TrackChanges", time.Now(), &err)
+	tracker, ok := store.base.(ChangeTracker)
+	if !ok {
+		return SeriesChanges{}, errNotSupported
+	}
+	return tracker.TrackChanges(ctx, key, until)
+}
+
+func (store *InstrumentedStorage) ResetChanges(ctx context.Context, key string, changes SeriesChanges) (err error) {
+	defer store.observe("ResetChanges", time.Now(), &err)
+	tracker, ok := store.base.(ChangeTracker)
+	if !ok {
+		return errNotSupported
+	}
+	return tracker.ResetChanges(ctx, key, changes)
+}
+
+func (store *InstrumentedStorage) ExpireRange(ctx context.Context, key string, until time.Time) (err error) {
+	defer store.observe("ExpireRange", time.Now(), &err)
+	tracker, ok := store.base.(ChangeTracker)
+	if !ok {
+		return errNotSupported
+	}
+	return tracker.ExpireRange(ctx, key, until)
+}
+
+// Size returns the size of the files of the decorated storage, it isn't reported to the observer
+func (store *InstrumentedStorage) Size() (int64, bool, error) {
+	if sizer, ok := store.base.(Sizer); ok {
+		return sizer.Size()
+	}
+	return 0, false, nil
+}
+
+// observedIterator reports the read of a timerange once it is closed
+type observedIterator struct {
+	Iterator
+	store  *InstrumentedStorage
+	method string
+	start  time.Time
+	closed bool
+}
+
+func (it *observedIterator) Close() error {
+	if !it.closed {
+		it.closed = true
+		err := it.Iterator.Err()
+		it.store.observe(it.method, it.start, &err)
+	}
+	return it.Iterator.Close()
+}
@@ -1,30 +1,103 @@
 package storage
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // KeyValueStorage is the interface for key-value-storage backends
+// Errors are wrapped into ErrNotFound, ErrConflict, ErrInvalidKey, ErrInvalidArgument or ErrBackendUnavailable where they apply.
 type KeyValueStorage interface {
 	Put(key string, value []byte) error
+	// PutWithTTL saves a value which is invisible to Get once ttl is over
+	PutWithTTL(key string, value []byte, ttl time.Duration) error
+	// Get returns ErrNotFound if the key doesn't exist
 	Get(key string) ([]byte, error)
+	// GetVersioned returns a value together with its version.
+	// Every write of a key assigns it a new version which is greater than all versions assigned before.
+	GetVersioned(key string) ([]byte, uint64, error)
+	// CompareAndSwap saves a value if the current version of the key is expectedVersion and returns the new version.
+	// An expectedVersion of 0 means that the key must not exist. ErrVersionMismatch is returned if the check fails.
+	CompareAndSwap(key string, expectedVersion uint64, value []byte) (uint64, error)
+	// Delete returns ErrNotFound if the key doesn't exist
 	Delete(key string) error
+	// CompareAndDelete deletes a key if its current version is expectedVersion
+	CompareAndDelete(key string, expectedVersion uint64) error
+	// List returns all keys starting with prefix in lexical order
+	List(prefix string) ([]string, error)
+	// Scan returns at most limit keys in the range [start, end) in lexical order.
+	// An empty end means no upper bound, a limit <= 0 means no limit.
+	Scan(start, end string, limit int) ([]string, error)
 }
 
-// A TimeSeriesEntry is a single entry of a timeseries
+// A TimeSeriesEntry is a single entry of a timeseries.
+// Value is the default field of the point, Fields holds its other named fields (or nil if there are none).
+// Aggregations and rollups only use Value.
 type TimeSeriesEntry struct {
 	Value     float64
 	Timestamp time.Time
+	Fields    map[string]float64
+}
+
+// DefaultField is the name of TimeSeriesEntry.Value when fields are selected by name
+const DefaultField = "value"
+
+// Field returns the value of the named field of the entry
+func (entry *TimeSeriesEntry) Field(name string) (float64, bool) {
+	if name == DefaultField {
+		return entry.Value, true
+	}
+	value, ok := entry.Fields[name]
+	return value, ok
 }
 
 // TimeSeriesStorage is the interface for timeseries handling
 type TimeSeriesStorage interface {
 	AddValue(key string, value float64) error
+	// AddValues saves multiple entries with caller supplied timestamps in one batch.
+	// ErrDuplicateTimestamp is returned if a timestamp is already used and the timeseries has the reject policy.
+	AddValues(key string, entries []*TimeSeriesEntry) error
+	// GetRange returns the entries of a timerange (including from and to) in time order.
+	// The channel has to be drained, use GetRangeContext to stop early.
 	GetRange(key string, from time.Time, to time.Time) (chan *TimeSeriesEntry, error)
 	DeleteRange(key string, from time.Time, to time.Time) error
+	// ListSeries returns the keys of all timeseries starting with prefix in lexical order
+	ListSeries(prefix string) ([]string, error)
+	// Aggregate summarises a timerange into one entry per step using the given aggregation
+	Aggregate(key string, from time.Time, to time.Time, step time.Duration, agg Aggregation) (chan *TimeSeriesEntry, error)
+	// SetDuplicateRules replaces the rules which decide how values at an already used timestamp are handled.
+	// Timeseries without a matching rule use DuplicateOverwrite.
+	SetDuplicateRules(rules []*DuplicateRule)
+	DuplicateRules() []*DuplicateRule
+}
+
+// ContextStorage contains the context aware variants of the Storage methods.
+// Timeseries are read with an Iterator instead of a channel, it stops once ctx is done.
+type ContextStorage interface {
+	PutContext(ctx context.Context, key string, value []byte) error
+	PutWithTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	GetContext(ctx context.Context, key string) ([]byte, error)
+	GetVersionedContext(ctx context.Context, key string) ([]byte, uint64, error)
+	CompareAndSwapContext(ctx context.Context, key string, expectedVersion uint64, value []byte) (uint64, error)
+	DeleteContext(ctx context.Context, key string) error
+	CompareAndDeleteContext(ctx context.Context, key string, expectedVersion uint64) error
+	ListContext(ctx context.Context, prefix string) ([]string, error)
+	ScanContext(ctx context.Context, start, end string, limit int) ([]string, error)
+	AddValueContext(ctx context.Context, key string, value float64) error
+	AddValuesContext(ctx context.Context, key string, entries []*TimeSeriesEntry) error
+	GetRangeContext(ctx context.Context, key string, from time.Time, to time.Time) (Iterator, error)
+	DeleteRangeContext(ctx context.Context, key string, from time.Time, to time.Time) error
+	ListSeriesContext(ctx context.Context, prefix string) ([]string, error)
+	AggregateContext(ctx context.Context, key string, from time.Time, to time.Time, step time.Duration, agg Aggregation) (Iterator, error)
+	CommitContext(ctx context.Context, txn *Txn) error
 }
 
 // Storage is a combined interface of KeyValueStorage and TimeSeriesStorage
 type Storage interface {
 	KeyValueStorage
 	TimeSeriesStorage
+	ContextStorage
+	// Commit applies all operations of a transaction atomically
+	Commit(txn *Txn) error
 	Close() error
 }
@@ -0,0 +1,120 @@
+package storage
+
+import "context"
+
+// Iterator iterates over the entries of a timeseries in time order.
+// Next has to be called before the first entry is read and Close has to be called once the iterator
+// isn't needed anymore, even if Next returned false. The iteration stops with the error of the
+// context the iterator was created with once the context is done.
+type Iterator interface {
+	// Next advances to the next entry and returns false at the end of the range or on errors
+	Next() bool
+	// Entry returns the current entry
+	Entry() *TimeSeriesEntry
+	// Err returns the error which stopped the iteration, if any
+	Err() error
+	// Close releases the resources held by the iterator
+	Close() error
+}
+
+// funcIterator implements Iterator on top of a function returning the next entry or nil at the end
+type funcIterator struct {
+	ctx    context.Context
+	next   func() (*TimeSeriesEntry, error)
+	close  func() error
+	entry  *TimeSeriesEntry
+	err    error
+	closed bool
+}
+
+// newFuncIterator creates an iterator calling next for every entry and close (which may be nil) on Close
+func newFuncIterator(ctx context.Context, next func() (*TimeSeriesEntry, error), close func() error) *funcIterator {
+	return &funcIterator{ctx: ctx, next: next, close: close}
+}
+
+func (it *funcIterator) Next() bool {
+	if it.closed || it.err != nil {
+		return false
+	}
+	if it.err = it.ctx.Err(); it.err != nil {
+		return false
+	}
+	it.entry, it.err = it.next()
+	if it.err != nil {
+		it.entry = nil
+	}
+	return it.entry != nil
+}
+
+func (it *funcIterator) Entry() *TimeSeriesEntry {
+	return it.entry
+}
+
+func (it *funcIterator) Err() error {
+	return it.err
+}
+
+func (it *funcIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.entry = nil
+	if it.close == nil {
+		return nil
+	}
+	return it.close()
+}
+
+// newSliceIterator creates an iterator over entries
+func newSliceIterator(ctx context.Context, entries []*TimeSeriesEntry) Iterator {
+	return newFuncIterator(ctx, func() (*TimeSeriesEntry, error) {
+		if len(entries) == 0 {
+			return nil, nil
+		}
+		entry := entries[0]
+		entries = entries[1:]
+		return entry, nil
+	}, nil)
+}
+
+// concatIterators creates an iterator returning the entries of all iterators one after another
+func concatIterators(ctx context.Context, iterators ...Iterator) Iterator {
+	closeAll := func() error {
+		var err error
+		for _, it := range iterators {
+			if e := it.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+		return err
+	}
+	rest := iterators
+	return newFuncIterator(ctx, func() (*TimeSeriesEntry, error) {
+		for len(rest) > 0 {
+			if rest[0].Next() {
+				return rest[0].Entry(), nil
+			}
+			if err := rest[0].Err(); err != nil {
+				return nil, err
+			}
+			rest = rest[1:]
+		}
+		return nil, nil
+	}, closeAll)
+}
+
+// iteratorToChan feeds the entries of it into a channel which is closed at the end.
+// Errors end the channel early without being reported. The channel has to be drained,
+// otherwise the feeding goroutine and the iterator are never released.
+func iteratorToChan(it Iterator) chan *TimeSeriesEntry {
+	ch := make(chan *TimeSeriesEntry, 64)
+	go func() {
+		defer close(ch)
+		defer it.Close()
+		for it.Next() {
+			ch <- it.Entry()
+		}
+	}()
+	return ch
+}
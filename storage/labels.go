@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Labels are the name=value pairs attached to a timeseries, like host=a,region=eu
+type Labels map[string]string
+
+// ParseLabels parses labels of the form "host=a,region=eu"
+func ParseLabels(str string) (Labels, error) {
+	labels := make(Labels)
+	for _, part := range strings.Split(str, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) != 2 {
+			return nil, invalidArgument(fmt.Sprintf("malformed label '%v', expected '<name>=<value>'", part))
+		}
+		labels[pair[0]] = pair[1]
+	}
+	if err := labels.Validate(); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// Validate checks that the labels can be stored in the index.
+// Names consist of letters, digits and underscores and don't start with a digit,
+// values must not be empty and must not contain ',' or '/'.
+func (labels Labels) Validate() error {
+	for name, value := range labels {
+		if !validLabelName(name) {
+			return invalidArgument(fmt.Sprintf("invalid label name '%v'", name))
+		}
+		if value == "" || strings.ContainsAny(value, ",/") {
+			return invalidArgument(fmt.Sprintf("invalid value '%v' of label '%v'", value, name))
+		}
+	}
+	return nil
+}
+
+func validLabelName(name string) bool {
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+// String formats the labels sorted by name like "host=a,region=eu"
+func (labels Labels) String() string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// LabelMatcher selects the timeseries whose label Name has the value Value, or not if Negate is set.
+// Timeseries without the label don't match negated matchers either.
+type LabelMatcher struct {
+	Name   string
+	Value  string
+	Negate bool
+}
+
+// ParseLabelMatchers parses matchers of the form "region=eu,host!=a"
+func ParseLabelMatchers(str string) ([]*LabelMatcher, error) {
+	matchers := make([]*LabelMatcher, 0)
+	for _, part := range strings.Split(str, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) != 2 {
+			return nil, invalidArgument(fmt.Sprintf("malformed matcher '%v', expected '<name>=<value>' or '<name>!=<value>'", part))
+		}
+		matcher := &LabelMatcher{Name: pair[0], Value: pair[1]}
+		if strings.HasSuffix(matcher.Name, "!") {
+			matcher.Name = matcher.Name[:len(matcher.Name)-1]
+			matcher.Negate = true
+		}
+		if err := (Labels{matcher.Name: matcher.Value}).Validate(); err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+	if len(matchers) == 0 {
+		return nil, invalidArgument("need at least one matcher")
+	}
+	return matchers, nil
+}
+
+// Matches checks if labels satisfy the matcher
+func (matcher *LabelMatcher) Matches(labels Labels) bool {
+	value, ok := labels[matcher.Name]
+	return ok && (value == matcher.Value) != matcher.Negate
+}
+
+func (matcher *LabelMatcher) String() string {
+	if matcher.Negate {
+		return matcher.Name + "!=" + matcher.Value
+	}
+	return matcher.Name + "=" + matcher.Value
+}
+
+// LabeledSeries is a timeseries returned by MatchSeries
+type LabeledSeries struct {
+	Key    string
+	Labels Labels
+}
+
+// Labeler is implemented by storages which maintain an index of timeseries labels
+type Labeler interface {
+	// SetLabels replaces the labels of the timeseries key, empty labels remove the timeseries from the index.
+	// Labels are independent of the values of the timeseries, a timeseries can be labeled before it has values.
+	SetLabels(ctx context.Context, key string, labels Labels) error
+	// Labels returns the labels of the timeseries key, which are empty if it has none
+	Labels(ctx context.Context, key string) (Labels, error)
+	// MatchSeries returns the timeseries matching all matchers in lexical order of their keys
+	MatchSeries(ctx context.Context, matchers []*LabelMatcher) ([]*LabeledSeries, error)
+}
+
+// The label index is kept in the reserved kv namespace of the base storage.
+// labelSeriesPrefix+key holds the labels of a timeseries as formatted by Labels.String,
+// labelIndexPrefix+name=value/key exists for every label of a timeseries. The keys are escaped with escapeKeySegment.
+const (
+	labelSeriesPrefix = ReservedPrefix + "labels/series/"
+	labelIndexPrefix  = ReservedPrefix + "labels/index/"
+)
+
+func labelIndexKey(name, value, key string) string {
+	return labelIndexPrefix + name + "=" + value + "/" + escapeKeySegment(key)
+}
+
+// SetLabels replaces the labels of the timeseries key.
+// The index is updated in a transaction guarded by the version of the old labels and retried on concurrent changes.
+func (store *MetaStorage) SetLabels(ctx context.Context, key string, labels Labels) error {
+	if err := checkKey(ctx, key); err != nil {
+		return err
+	}
+	if err := labels.Validate(); err != nil {
+		return err
+	}
+	for {
+		old, version, err := store.labels(ctx, key)
+		if err != nil {
+			return err
+		}
+		txn := NewTxn()
+		seriesKey := labelSeriesPrefix + escapeKeySegment(key)
+		if version == 0 {
+			txn.MustNotExist(seriesKey)
+		} else {
+			txn.VersionIs(seriesKey, version)
+		}
+		for name, value := range old {
+			if labels[name] != value {
+				txn.Delete(labelIndexKey(name, value, key))
+			}
+		}
+		for name, value := range labels {
+			if old[name] != value {
+				txn.Put(labelIndexKey(name, value, key), []byte(key))
+			}
+		}
+		switch {
+		case len(labels) > 0:
+			txn.Put(seriesKey, []byte(labels.String()))
+		case version != 0:
+			txn.Delete(seriesKey)
+		default:
+			return nil
+		}
+		err = store.base.CommitContext(ctx, txn)
+		if !errors.Is(err, ErrGuardFailed) {
+			return err
+		}
+	}
+}
+
+// Labels returns the labels of the timeseries key
+func (store *MetaStorage) Labels(ctx context.Context, key string) (Labels, error) {
+	if err := checkKey(ctx, key); err != nil {
+		return nil, err
+	}
+	labels, _, err := store.labels(ctx, key)
+	return labels, err
+}
+
+// labels reads the labels of key together with the version of their index entry, which is 0 if key has no labels
+func (store *MetaStorage) labels(ctx context.Context, key string) (Labels, uint64, error) {
+	bs, version, err := store.base.GetVersionedContext(ctx, labelSeriesPrefix+escapeKeySegment(key))
+	if errors.Is(err, ErrNotFound) {
+		return Labels{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	labels, err := ParseLabels(string(bs))
+	if err != nil {
+		return nil, 0, fmt.Errorf("corrupted labels of '%v': %w", key, err)
+	}
+	return labels, version, nil
+}
+
+// MatchSeries returns the timeseries matching all matchers.
+// The candidates are the intersection of the index entries of all non negated matchers (or all labeled
+// timeseries if there are none), their labels are read afterwards to check the negated matchers.
+func (store *MetaStorage) MatchSeries(ctx context.Context, matchers []*LabelMatcher) ([]*LabeledSeries, error) {
+	var candidates []string
+	for _, matcher := range matchers {
+		if matcher.Negate {
+			continue
+		}
+		prefix := labelIndexPrefix + matcher.Name + "=" + matcher.Value + "/"
+		keys, err := store.listEscapedKeys(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if candidates == nil {
+			candidates = keys
+		} else {
+			candidates = intersectSorted(candidates, keys)
+		}
+	}
+	if candidates == nil {
+		keys, err := store.listEscapedKeys(ctx, labelSeriesPrefix)
+		if err != nil {
+			return nil, err
+		}
+		candidates = keys
+	}
+	res := make([]*LabeledSeries, 0, len(candidates))
+	for _, key := range candidates {
+		labels, _, err := store.labels(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if matchesAll(matchers, labels) {
+			res = append(res, &LabeledSeries{key, labels})
+		}
+	}
+	return res, nil
+}
+
+// listEscapedKeys returns the unescaped keys behind prefix in the kv namespace of the base storage, sorted
+func (store *MetaStorage) listEscapedKeys(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := store.base.ListContext(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		keys[i] = unescapeKeySegment(keys[i][len(prefix):])
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func matchesAll(matchers []*LabelMatcher, labels Labels) bool {
+	for _, matcher := range matchers {
+		if !matcher.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// intersectSorted returns the keys contained in both sorted lists
+func intersectSorted(a, b []string) []string {
+	res := make([]string, 0)
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			a = a[1:]
+		case a[0] > b[0]:
+			b = b[1:]
+		default:
+			res = append(res, a[0])
+			a, b = a[1:], b[1:]
+		}
+	}
+	return res
+}
@@ -0,0 +1,322 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// seriesFormat is the layout of the timeseries entries written by LevelDBStorage and BoltStorage.
+// Format 0 (no format marker) stored the timestamps as decimal strings directly behind the key.
+// Format 1 stores them as returned by encodeTimestamp, LevelDB keys are prefixed with their length.
+const seriesFormat = 1
+
+func unsupportedFormat(format uint64) error {
+	return fmt.Errorf("%w: unsupported timeseries format %v, this version supports up to %v", ErrBackendUnavailable, format, seriesFormat)
+}
+
+// migrationBatchSize is the number of writes a migration collects in a batch or transaction before writing it
+var migrationBatchSize = 10000
+
+// migrationError stops a migration at an entry which can't be rewritten. The entries which were rewritten before
+// are kept, so that the migration continues once the entry is fixed or removed.
+func migrationError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: migration: %v, fix or remove it to continue", ErrBackendUnavailable, fmt.Sprintf(format, args...))
+}
+
+// The LevelDB migration moves every entry to its new key below levelDBStagingPrefix first and then
+// moves all of them back to "ts/", the current phase is kept in "meta/migration". That way the entries
+// below "ts/" are either all in the old or all in the new format, so an interrupted migration can resume.
+const levelDBStagingPrefix = "migrate/"
+
+// migrateLevelDB rewrites the timeseries entries of db to the current format, the format is kept in "meta/format".
+// The entries are rewritten in batches of migrationBatchSize writes, the format is written last.
+func migrateLevelDB(db *leveldb.DB) error {
+	bs, err := db.Get([]byte("meta/format"), nil)
+	if err == nil {
+		if format := decodeVersion(bs); format > seriesFormat {
+			return unsupportedFormat(format)
+		}
+		return nil
+	}
+	if err != leveldb.ErrNotFound {
+		return levelDBError(err)
+	}
+	_, err = db.Get([]byte("meta/migration"), nil)
+	if err == leveldb.ErrNotFound {
+		series, err := decimalSeriesKeys(db)
+		if err != nil {
+			return err
+		}
+		count, err := moveLevelDBEntries(db, "ts/", func(k []byte) ([]byte, error) {
+			key, stamp, ok := splitDecimalSeriesKey(string(k[3:]))
+			if !ok {
+				return nil, migrationError("malformed timeseries entry %q", k)
+			}
+			if other, ok := otherDecimalSeries(string(k[3:]), key, series); ok {
+				return nil, migrationError("the timeseries entry %q may belong to %q or %q", k, key, other)
+			}
+			return append([]byte(levelDBStagingPrefix), levelDBSeriesKey(key, stamp)...), nil
+		})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			log.Printf("migration: rewrote %v timeseries entries to format %v", count, seriesFormat)
+		}
+		if err := db.Put([]byte("meta/migration"), []byte("staged"), nil); err != nil {
+			return levelDBError(err)
+		}
+	} else if err != nil {
+		return levelDBError(err)
+	}
+	_, err = moveLevelDBEntries(db, levelDBStagingPrefix, func(k []byte) ([]byte, error) {
+		return k[len(levelDBStagingPrefix):], nil
+	})
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete([]byte("meta/migration"))
+	batch.Put([]byte("meta/format"), encodeVersion(seriesFormat))
+	return levelDBError(db.Write(batch, nil))
+}
+
+// moveLevelDBEntries moves all entries starting with prefix to the keys returned by rename, it stops at the first error of rename.
+// Every batch deletes the moved entries, so that a repeated call continues with the entries which are left.
+func moveLevelDBEntries(db *leveldb.DB, prefix string, rename func(k []byte) ([]byte, error)) (int, error) {
+	iter := db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	count := 0
+	for iter.Next() {
+		k, err := rename(iter.Key())
+		if err != nil {
+			if err := db.Write(batch, nil); err != nil {
+				return 0, levelDBError(err)
+			}
+			return 0, err
+		}
+		batch.Delete(iter.Key())
+		batch.Put(k, iter.Value())
+		count++
+		if batch.Len() >= migrationBatchSize {
+			if err := db.Write(batch, nil); err != nil {
+				return 0, levelDBError(err)
+			}
+			batch.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return 0, levelDBError(err)
+	}
+	return count, levelDBError(db.Write(batch, nil))
+}
+
+// decimalSeriesKeys returns the keys of the timeseries with format 0 entries in db, including the ones which are already staged
+func decimalSeriesKeys(db *leveldb.DB) (map[string]bool, error) {
+	series := make(map[string]bool)
+	iter := db.NewIterator(util.BytesPrefix([]byte("ts/")), nil)
+	for iter.Next() {
+		if key, _, ok := splitDecimalSeriesKey(string(iter.Key()[3:])); ok {
+			series[key] = true
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, levelDBError(err)
+	}
+	iter = db.NewIterator(util.BytesPrefix([]byte(levelDBStagingPrefix)), nil)
+	for iter.Next() {
+		if key, ok := levelDBSeriesOf(iter.Key()[len(levelDBStagingPrefix):]); ok {
+			series[key] = true
+		}
+	}
+	iter.Release()
+	return series, levelDBError(iter.Error())
+}
+
+// splitDecimalSeriesKey splits a format 0 LevelDB key (without "ts/") into the timeseries key and the timestamp.
+// The format has no separator, so the timestamp is assumed to be the trailing 19 digits which is the
+// length of all nanosecond timestamps between 2001 and 2262. If the key of the timeseries ends with a digit,
+// older timestamps are split at the wrong position, see otherDecimalSeries.
+func splitDecimalSeriesKey(key string) (string, time.Time, bool) {
+	i := len(key)
+	for i > 0 && len(key)-i < 19 && key[i-1] >= '0' && key[i-1] <= '9' {
+		i--
+	}
+	if i > 0 && key[i-1] == '-' {
+		i--
+	}
+	nanos, err := strconv.ParseInt(key[i:], 10, 64)
+	if err != nil || i == 0 {
+		return "", time.Time{}, false
+	}
+	return key[:i], time.Unix(0, nanos), true
+}
+
+// otherDecimalSeries checks if the format 0 entry, which splitDecimalSeriesKey assigned to key, could also be an entry
+// with a shorter timestamp of another of the timeseries in series. Such entries can't be assigned without guessing.
+func otherDecimalSeries(entry, key string, series map[string]bool) (string, bool) {
+	for end := len(key) + 1; end < len(entry); end++ {
+		if series[entry[:end]] {
+			return entry[:end], true
+		}
+	}
+	return "", false
+}
+
+// The Bolt migration works like the LevelDB one: the rewritten entries are moved to the same nested buckets
+// below the "migrate" bucket first and then back to the "ts" bucket, the current phase is kept in the
+// "migration" key of the "meta" bucket. Every batch is moved in its own transaction.
+const boltStagingBucket = "migrate"
+
+// migrateBolt rewrites the timeseries entries of db to the current format in batches of migrationBatchSize entries.
+// The format is kept in the "format" key of the "meta" bucket.
+func migrateBolt(db *bolt.DB) error {
+	var format, migration []byte
+	err := db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte("meta"))
+		if err != nil {
+			return err
+		}
+		format = append([]byte{}, meta.Get([]byte("format"))...)
+		migration = append([]byte{}, meta.Get([]byte("migration"))...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(format) > 0 {
+		if format := decodeVersion(format); format > seriesFormat {
+			return unsupportedFormat(format)
+		}
+		return nil
+	}
+	if len(migration) == 0 {
+		count, err := moveBoltEntries(db, "ts", boltStagingBucket, func(k []byte) ([]byte, error) {
+			nanos, err := strconv.ParseInt(string(k), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed timeseries entry %q", k)
+			}
+			return encodeTimestamp(time.Unix(0, nanos)), nil
+		})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			log.Printf("migration: rewrote %v timeseries entries to format %v", count, seriesFormat)
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("meta")).Put([]byte("migration"), []byte("staged"))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = moveBoltEntries(db, boltStagingBucket, "ts", func(k []byte) ([]byte, error) {
+		return k, nil
+	})
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(boltStagingBucket)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		meta := tx.Bucket([]byte("meta"))
+		if err := meta.Delete([]byte("migration")); err != nil {
+			return err
+		}
+		return meta.Put([]byte("format"), encodeVersion(seriesFormat))
+	})
+}
+
+// boltEntry is an entry of a nested bucket, path holds the names of the buckets below the top-level bucket
+type boltEntry struct {
+	path [][]byte
+	k, v []byte
+}
+
+// errBatchFull stops collecting entries once a batch is complete
+var errBatchFull = errors.New("batch is full")
+
+// collectBoltEntries appends copies of the entries of b and all nested buckets to entries until there are migrationBatchSize of them
+func collectBoltEntries(b *bolt.Bucket, path [][]byte, entries *[]boltEntry) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			nested := append(append([][]byte{}, path...), append([]byte{}, k...))
+			return collectBoltEntries(b.Bucket(k), nested, entries)
+		}
+		if len(*entries) >= migrationBatchSize {
+			return errBatchFull
+		}
+		*entries = append(*entries, boltEntry{path, append([]byte{}, k...), append([]byte{}, v...)})
+		return nil
+	})
+}
+
+// moveBoltEntries moves all entries of the top-level bucket from to the same nested buckets of the top-level bucket to,
+// using the keys returned by rename. Every batch is moved in its own transaction, so that a repeated call continues
+// with the entries which are left. It stops at the first error of rename.
+func moveBoltEntries(db *bolt.DB, from, to string, rename func(k []byte) ([]byte, error)) (int, error) {
+	count := 0
+	for {
+		n := 0
+		var renameErr error
+		err := db.Update(func(tx *bolt.Tx) error {
+			src := tx.Bucket([]byte(from))
+			if src == nil {
+				return nil
+			}
+			entries := []boltEntry{}
+			if err := collectBoltEntries(src, nil, &entries); err != nil && err != errBatchFull {
+				return err
+			}
+			dst, err := tx.CreateBucketIfNotExists([]byte(to))
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				k, err := rename(e.k)
+				if err != nil {
+					// the entries which were moved before are kept
+					renameErr = migrationError("%v in bucket %q", err, bytes.Join(e.path, []byte("/")))
+					return nil
+				}
+				srcBucket, dstBucket := src, dst
+				for _, name := range e.path {
+					srcBucket = srcBucket.Bucket(name)
+					if dstBucket, err = dstBucket.CreateBucketIfNotExists(name); err != nil {
+						return err
+					}
+				}
+				if err := srcBucket.Delete(e.k); err != nil {
+					return err
+				}
+				if err := dstBucket.Put(k, e.v); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+		if err == nil {
+			err = renameErr
+		}
+		if err != nil {
+			return 0, err
+		}
+		count += n
+		if n < migrationBatchSize {
+			return count, nil
+		}
+	}
+}
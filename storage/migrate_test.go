@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var migrationStamps = []time.Time{time.Unix(999999999, 0), time.Unix(1500000000, 0), time.Unix(1500000001, 0)}
+
+func checkMigratedSeries(t *testing.T, store Storage) {
+	for i, key := range []string{"foo", "foo/bar"} {
+		ch, err := store.GetRange(key, time.Time{}, time.Now())
+		assert.NoError(t, err)
+		n := 0
+		for entry := range ch {
+			assert.Equal(t, migrationStamps[n].UnixNano(), entry.Timestamp.UnixNano(), key)
+			assert.Equal(t, float64(i*10+n), entry.Value, key)
+			n++
+		}
+		assert.Equal(t, len(migrationStamps), n, key)
+	}
+	keys, err := store.ListSeries("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo", "foo/bar"}, keys)
+}
+
+func TestMigrateLevelDB(t *testing.T) {
+	path := "./test-migrate-leveldb.db"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	db, err := leveldb.OpenFile(path, nil)
+	assert.NoError(t, err)
+	for i, key := range []string{"foo", "foo/bar"} {
+		for n, stamp := range migrationStamps {
+			assert.NoError(t, db.Put([]byte(fmt.Sprintf("ts/%v%v", key, stamp.UnixNano())), FloatToBytes(float64(i*10+n)), nil))
+		}
+	}
+	assert.NoError(t, db.Close())
+
+	// the second open must not touch the migrated entries
+	for i := 0; i < 2; i++ {
+		store, err := NewLevelDBStorage(path)
+		assert.NoError(t, err)
+		checkMigratedSeries(t, store)
+		assert.NoError(t, store.Close())
+	}
+}
+
+func TestMigrateLevelDBResume(t *testing.T) {
+	path := "./test-migrate-leveldb.db"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	defer func(size int) { migrationBatchSize = size }(migrationBatchSize)
+	migrationBatchSize = 2
+	db, err := leveldb.OpenFile(path, nil)
+	assert.NoError(t, err)
+	// an interrupted migration which already staged the entries of foo/bar
+	for n, stamp := range migrationStamps {
+		assert.NoError(t, db.Put([]byte(fmt.Sprintf("ts/foo%v", stamp.UnixNano())), FloatToBytes(float64(n)), nil))
+		assert.NoError(t, db.Put(append([]byte(levelDBStagingPrefix), levelDBSeriesKey("foo/bar", stamp)...), FloatToBytes(float64(10+n)), nil))
+	}
+	assert.NoError(t, db.Close())
+
+	store, err := NewLevelDBStorage(path)
+	assert.NoError(t, err)
+	checkMigratedSeries(t, store)
+	_, err = store.db.Get([]byte("meta/migration"), nil)
+	assert.Equal(t, leveldb.ErrNotFound, err)
+	assert.NoError(t, store.Close())
+}
+
+func TestMigrateBolt(t *testing.T) {
+	path := "./test-migrate-bolt.db"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	db, err := bolt.Open(path, 0600, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		foo, err := tx.CreateBucketIfNotExists([]byte("ts"))
+		assert.NoError(t, err)
+		foo, err = foo.CreateBucket([]byte("foo"))
+		assert.NoError(t, err)
+		bar, err := foo.CreateBucket([]byte("bar"))
+		assert.NoError(t, err)
+		for i, b := range []*bolt.Bucket{foo, bar} {
+			for n, stamp := range migrationStamps {
+				assert.NoError(t, b.Put([]byte(fmt.Sprint(stamp.UnixNano())), FloatToBytes(float64(i*10+n))))
+			}
+		}
+		return nil
+	}))
+	assert.NoError(t, db.Close())
+
+	for i := 0; i < 2; i++ {
+		store, err := NewBoltStorage(path)
+		assert.NoError(t, err)
+		checkMigratedSeries(t, store)
+		assert.NoError(t, store.Close())
+	}
+}
+
+func TestMigrateBoltResume(t *testing.T) {
+	path := "./test-migrate-bolt.db"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	defer func(size int) { migrationBatchSize = size }(migrationBatchSize)
+	migrationBatchSize = 2
+	db, err := bolt.Open(path, 0600, nil)
+	assert.NoError(t, err)
+	// an interrupted migration which already staged the entries of foo/bar
+	assert.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		foo, err := tx.CreateBucketIfNotExists([]byte("ts"))
+		assert.NoError(t, err)
+		foo, err = foo.CreateBucket([]byte("foo"))
+		assert.NoError(t, err)
+		staged, err := tx.CreateBucketIfNotExists([]byte(boltStagingBucket))
+		assert.NoError(t, err)
+		staged, err = staged.CreateBucket([]byte("foo"))
+		assert.NoError(t, err)
+		bar, err := staged.CreateBucket([]byte("bar"))
+		assert.NoError(t, err)
+		for n, stamp := range migrationStamps {
+			assert.NoError(t, foo.Put([]byte(fmt.Sprint(stamp.UnixNano())), FloatToBytes(float64(n))))
+			assert.NoError(t, bar.Put(encodeTimestamp(stamp), FloatToBytes(float64(10+n))))
+		}
+		return nil
+	}))
+	assert.NoError(t, db.Close())
+
+	store, err := NewBoltStorage(path)
+	assert.NoError(t, err)
+	checkMigratedSeries(t, store)
+	assert.NoError(t, store.(*BoltStorage).db.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket([]byte(boltStagingBucket)))
+		assert.Nil(t, tx.Bucket([]byte("meta")).Get([]byte("migration")))
+		return nil
+	}))
+	assert.NoError(t, store.Close())
+}
+
+func TestMigrateMalformed(t *testing.T) {
+	path := "./test-migrate-malformed.db"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	db, err := bolt.Open(path, 0600, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("ts"))
+		assert.NoError(t, err)
+		b, err = b.CreateBucket([]byte("foo"))
+		assert.NoError(t, err)
+		return b.Put([]byte("bar"), FloatToBytes(1))
+	}))
+	assert.NoError(t, db.Close())
+	_, err = NewBoltStorage(path)
+	assert.ErrorIs(t, err, ErrBackendUnavailable)
+	os.RemoveAll(path)
+
+	// the second entry may be one of sensor1 from before 2001
+	ldb, err := leveldb.OpenFile(path, nil)
+	assert.NoError(t, err)
+	for _, key := range []string{"ts/sensor11500000000000000000", "ts/sensor1999999999000000000"} {
+		assert.NoError(t, ldb.Put([]byte(key), FloatToBytes(1), nil))
+	}
+	assert.NoError(t, ldb.Close())
+	_, err = NewLevelDBStorage(path)
+	assert.ErrorIs(t, err, ErrBackendUnavailable)
+	ldb, err = leveldb.OpenFile(path, nil)
+	assert.NoError(t, err)
+	_, err = ldb.Get([]byte("ts/sensor1999999999000000000"), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, ldb.Close())
+}
+
+func TestUnsupportedFormat(t *testing.T) {
+	path := "./test-format-leveldb.db"
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+	db, err := leveldb.OpenFile(path, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Put([]byte("meta/format"), encodeVersion(seriesFormat+1), nil))
+	assert.NoError(t, db.Close())
+	_, err = NewLevelDBStorage(path)
+	assert.ErrorIs(t, err, ErrBackendUnavailable)
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	mgo "gopkg.in/mgo.v2"
+)
+
+func TestParseWriteConcern(t *testing.T) {
+	url, safe, err := parseWriteConcern("mongodb://localhost/db")
+	assert.NoError(t, err)
+	assert.Equal(t, "mongodb://localhost/db", url)
+	assert.Equal(t, &mgo.Safe{}, safe)
+
+	url, safe, err = parseWriteConcern("mongodb://a:27017,b:27017/db?replicaSet=rs&w=majority&wtimeoutMS=500&journal=true")
+	assert.NoError(t, err)
+	assert.Equal(t, "mongodb://a:27017,b:27017/db?replicaSet=rs", url)
+	assert.Equal(t, &mgo.Safe{WMode: "majority", WTimeout: 500, J: true}, safe)
+
+	url, safe, err = parseWriteConcern("mongodb://localhost/db?w=2")
+	assert.NoError(t, err)
+	assert.Equal(t, "mongodb://localhost/db", url)
+	assert.Equal(t, &mgo.Safe{W: 2}, safe)
+
+	_, safe, err = parseWriteConcern("mongodb://localhost/db?w=0")
+	assert.NoError(t, err)
+	assert.Nil(t, safe)
+
+	_, _, err = parseWriteConcern("mongodb://localhost/db?wtimeoutMS=soon")
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	_, _, err = parseWriteConcern("mongodb://localhost/db?journal=maybe")
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Pinger is implemented by storages which can check if their backend is able to serve requests
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// pingKey is read by Ping to probe storages which don't implement Pinger
+const pingKey = ReservedPrefix + "ping"
+
+// Ping checks if store is able to serve requests.
+// Storages which don't implement Pinger are probed by reading a key, which only needs to not fail.
+func Ping(ctx context.Context, store Storage) error {
+	if pinger, ok := store.(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	_, err := store.GetContext(ctx, pingKey)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Ping checks the backend of the store
+func (store *MetaStorage) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return Ping(ctx, store.base)
+}
+
+// Ping checks the decorated storage
+func (store *InstrumentedStorage) Ping(ctx context.Context) (err error) {
+	defer store.observe("Ping", time.Now(), &err)
+	return Ping(ctx, store.base)
+}
+
+// Ping checks if the mongod is reachable, mgo has no contexts so a slow ping keeps running after ctx is done
+func (store *MongoStorage) Ping(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		session := store.session.Copy()
+		defer session.Close()
+		done <- session.Ping()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return wrapError(ErrBackendUnavailable, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
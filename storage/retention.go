@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetentionRule specifies how long the values of the matching timeseries are kept.
+// A pattern ending with '*' matches all keys with the given prefix, other patterns match exactly one key.
+type RetentionRule struct {
+	Pattern string
+	Keep    time.Duration
+}
+
+// ParseRetentionRule parses rules of the form "sensors/* keep 30d"
+func ParseRetentionRule(str string) (*RetentionRule, error) {
+	fields := strings.Fields(str)
+	if len(fields) != 3 || fields[1] != "keep" {
+		return nil, fmt.Errorf("malformed retention rule '%v', expected '<pattern> keep <duration>'", str)
+	}
+	keep, err := ParseRetentionDuration(fields[2])
+	if err != nil {
+		return nil, err
+	}
+	return &RetentionRule{fields[0], keep}, nil
+}
+
+// ParseRetentionDuration parses a duration like time.ParseDuration, but additionally supports days (d) and weeks (w)
+func ParseRetentionDuration(str string) (time.Duration, error) {
+	var (
+		unit time.Duration
+		keep time.Duration
+		err  error
+	)
+	switch {
+	case strings.HasSuffix(str, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(str, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+	if unit != 0 {
+		var n int64
+		n, err = strconv.ParseInt(str[:len(str)-1], 10, 64)
+		keep = time.Duration(n) * unit
+	} else {
+		keep, err = time.ParseDuration(str)
+	}
+	if err != nil || keep <= 0 {
+		return 0, fmt.Errorf("malformed retention duration '%v'", str)
+	}
+	return keep, nil
+}
+
+// Matches checks if the rule applies to the given timeseries key
+func (rule *RetentionRule) Matches(key string) bool {
+	return matchesPattern(rule.Pattern, key)
+}
+
+func (rule *RetentionRule) String() string {
+	keep := rule.Keep.String()
+	if day := 24 * time.Hour; rule.Keep%day == 0 {
+		keep = fmt.Sprintf("%vd", int64(rule.Keep/day))
+	}
+	return fmt.Sprintf("%v keep %v", rule.Pattern, keep)
+}
+
+// Janitor periodically removes timeseries values which are older than allowed by its retention rules
+type Janitor struct {
+	store    Storage
+	interval time.Duration
+	mutex    sync.Mutex
+	rules    []*RetentionRule
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewJanitor creates a new janitor which checks the store every interval once started
+func NewJanitor(store Storage, interval time.Duration) *Janitor {
+	return &Janitor{store: store, interval: interval}
+}
+
+// SetRules replaces the retention rules
+func (janitor *Janitor) SetRules(rules []*RetentionRule) {
+	janitor.mutex.Lock()
+	defer janitor.mutex.Unlock()
+	janitor.rules = rules
+}
+
+// Rules returns the current retention rules
+func (janitor *Janitor) Rules() []*RetentionRule {
+	janitor.mutex.Lock()
+	defer janitor.mutex.Unlock()
+	return janitor.rules
+}
+
+// ruleFor returns the most specific rule for key or nil if there is none
+func (janitor *Janitor) ruleFor(rules []*RetentionRule, key string) *RetentionRule {
+	var match *RetentionRule
+	for _, rule := range rules {
+		if rule.Matches(key) && (match == nil || len(rule.Pattern) > len(match.Pattern)) {
+			match = rule
+		}
+	}
+	return match
+}
+
+// Run applies the retention rules once and returns the number of removed values per timeseries.
+// If dryRun is set, nothing is deleted but the values which would be removed are counted.
+func (janitor *Janitor) Run(dryRun bool) (map[string]int, error) {
+	rules := janitor.Rules()
+	result := make(map[string]int)
+	if len(rules) == 0 {
+		return result, nil
+	}
+	keys, err := janitor.store.ListSeries("")
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, key := range keys {
+		rule := janitor.ruleFor(rules, key)
+		if rule == nil {
+			continue
+		}
+		cutoff := now.Add(-rule.Keep)
+		it, err := janitor.store.GetRangeContext(context.Background(), key, time.Time{}, cutoff)
+		if err != nil {
+			return nil, err
+		}
+		count := 0
+		for it.Next() {
+			count++
+		}
+		err = it.Err()
+		it.Close()
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			continue
+		}
+		result[key] = count
+		if !dryRun {
+			if err := janitor.expire(key, cutoff); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// expire deletes the values of key up to cutoff.
+// Storages tracking changes don't record them as changes, so that the rollups of the removed values are kept.
+func (janitor *Janitor) expire(key string, cutoff time.Time) error {
+	if tracker, ok := janitor.store.(ChangeTracker); ok && Supports[ChangeTracker](janitor.store) {
+		return tracker.ExpireRange(context.Background(), key, cutoff)
+	}
+	return janitor.store.DeleteRange(key, time.Time{}, cutoff)
+}
+
+// Start runs the janitor every interval in the background until Stop is called
+func (janitor *Janitor) Start() error {
+	janitor.mutex.Lock()
+	defer janitor.mutex.Unlock()
+	if janitor.stop != nil {
+		return errors.New("janitor is already running")
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	janitor.stop, janitor.done = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(janitor.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				removed, err := janitor.Run(false)
+				if err != nil {
+					log.Print("retention failed: ", err)
+				}
+				for key, count := range removed {
+					log.Printf("retention: removed %v values from %v", count, key)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops the background janitor and waits until a run which is in progress is finished
+func (janitor *Janitor) Stop() {
+	janitor.mutex.Lock()
+	stop, done := janitor.stop, janitor.done
+	janitor.stop, janitor.done = nil, nil
+	// the run reads the rules with the mutex, so it is released before waiting
+	janitor.mutex.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetentionRule(t *testing.T) {
+	rule, err := ParseRetentionRule("sensors/* keep 30d")
+	assert.NoError(t, err)
+	assert.Equal(t, &RetentionRule{"sensors/*", 30 * 24 * time.Hour}, rule)
+	assert.Equal(t, "sensors/* keep 30d", rule.String())
+	assert.True(t, rule.Matches("sensors/a/b"))
+	assert.False(t, rule.Matches("sensor"))
+
+	rule, err = ParseRetentionRule("foo keep 90m")
+	assert.NoError(t, err)
+	assert.Equal(t, &RetentionRule{"foo", 90 * time.Minute}, rule)
+	assert.True(t, rule.Matches("foo"))
+	assert.False(t, rule.Matches("foo/bar"))
+
+	for _, str := range []string{"", "foo 30d", "foo keep", "foo keep -1d", "foo keep 1x", "foo hold 1d"} {
+		_, err = ParseRetentionRule(str)
+		assert.Error(t, err, str)
+	}
+}
+
+func TestStopWaitsForRun(t *testing.T) {
+	meta, err := NewMetaStorage("memory://")
+	assert.NoError(t, err)
+	defer meta.Close()
+	assert.NoError(t, meta.AddValue("foo", 1))
+	var running, calls int32
+	store := NewInstrumentedStorage(meta, func(string, time.Duration, error) {
+		atomic.StoreInt32(&running, 1)
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&running, 0)
+	})
+	waitForRun := func() {
+		for atomic.LoadInt32(&running) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	janitor := NewJanitor(store, time.Millisecond)
+	janitor.SetRules([]*RetentionRule{{"*", time.Hour}})
+	assert.NoError(t, janitor.Start())
+	waitForRun()
+	janitor.Stop()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&running), "the janitor is still running")
+
+	roller := NewRoller(store, []time.Duration{time.Minute}, time.Millisecond)
+	assert.NoError(t, roller.Start())
+	waitForRun()
+	roller.Stop()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&running), "the roller is still running")
+	stopped := atomic.LoadInt32(&calls)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, stopped, atomic.LoadInt32(&calls))
+}
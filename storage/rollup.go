@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReservedPrefix is the kv namespace used by storaged to store its own state
+const ReservedPrefix = "_storaged/"
+
+// RollupSeparator separates the key of a timeseries from the resolution of its rollups, it can't be used in other keys of timeseries
+const RollupSeparator = "@"
+
+// rollupPrefix is the reserved namespace of the rollups and of their watermarks, so that rollups neither collide
+// with other timeseries nor are listed, retained or rolled up like them
+const rollupPrefix = ReservedPrefix + "rollup/"
+
+// rollupStats are the aggregations which are maintained for every rollup
+var rollupStats = []Aggregation{AggMin, AggMax, AggAvg, AggCount}
+
+// IsReserved checks if key is in the reserved kv namespace
+func IsReserved(key string) bool {
+	return strings.HasPrefix(key, ReservedPrefix)
+}
+
+// FormatResolution formats a rollup resolution in its shortest form like 30s, 1m, 1h or 1d
+func FormatResolution(res time.Duration) string {
+	for _, unit := range []struct {
+		suffix string
+		size   time.Duration
+	}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}} {
+		if res%unit.size == 0 {
+			return fmt.Sprintf("%v%v", int64(res/unit.size), unit.suffix)
+		}
+	}
+	return res.String()
+}
+
+// RollupKey returns the key of the timeseries holding the given aggregation of key at resolution res,
+// for example _storaged/rollup/sensors/temp@1m/avg.
+func RollupKey(key string, res time.Duration, agg Aggregation) string {
+	return rollupPrefix + key + RollupSeparator + FormatResolution(res) + "/" + string(agg)
+}
+
+// isRollupStat checks if agg is maintained for every rollup
+func isRollupStat(agg Aggregation) bool {
+	for _, stat := range rollupStats {
+		if agg == stat {
+			return true
+		}
+	}
+	return false
+}
+
+// Roller maintains rolled up versions of all timeseries in a store.
+// Every resolution is aligned to the unix epoch and only completed buckets are rolled up.
+// If the store is a ChangeTracker, buckets in which values are added or deleted after they were rolled up
+// are rolled up again by the next run, otherwise such changes are not reflected in the rollups.
+type Roller struct {
+	store       Storage
+	resolutions []time.Duration
+	interval    time.Duration
+	runMutex    sync.Mutex
+	mutex       sync.Mutex
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// NewRoller creates a new roller maintaining the given resolutions every interval once started
+func NewRoller(store Storage, resolutions []time.Duration, interval time.Duration) *Roller {
+	sorted := append([]time.Duration{}, resolutions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return &Roller{store: store, resolutions: sorted, interval: interval}
+}
+
+// ParseResolutions parses a comma separated list of resolutions like "1m,1h,1d"
+func ParseResolutions(str string) ([]time.Duration, error) {
+	resolutions := make([]time.Duration, 0)
+	for _, part := range strings.Split(str, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		res, err := ParseRetentionDuration(part)
+		if err != nil {
+			return nil, err
+		}
+		resolutions = append(resolutions, res)
+	}
+	return resolutions, nil
+}
+
+// watermarkKey returns the kv key holding the end of the last rolled up bucket of key at resolution res
+func (roller *Roller) watermarkKey(key string, res time.Duration) string {
+	return rollupPrefix + key + RollupSeparator + FormatResolution(res)
+}
+
+// watermark returns the end of the last rolled up bucket, ok is false if key was never rolled up
+func (roller *Roller) watermark(key string, res time.Duration) (stamp time.Time, ok bool) {
+	bs, err := roller.store.Get(roller.watermarkKey(key, res))
+	if err != nil {
+		return time.Unix(0, 0), false
+	}
+	nanos, err := strconv.ParseInt(string(bs), 10, 64)
+	if err != nil {
+		return time.Unix(0, 0), false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// Run rolls up all completed buckets of all timeseries which were not rolled up yet
+// and the rolled up buckets in which values were added or deleted since the last run.
+func (roller *Roller) Run() error {
+	roller.runMutex.Lock()
+	defer roller.runMutex.Unlock()
+	if len(roller.resolutions) == 0 {
+		return nil
+	}
+	keys, err := roller.seriesKeys()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, key := range keys {
+		if err := roller.rollupSeries(key, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seriesKeys returns the keys of all timeseries outside of the reserved namespace
+// and of the ones which were rolled up before, even if all of their values are deleted by now
+func (roller *Roller) seriesKeys() ([]string, error) {
+	series, err := roller.store.ListSeries("")
+	if err != nil {
+		return nil, err
+	}
+	marks, err := roller.store.List(rollupPrefix)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	keys := []string{}
+	add := func(key string) {
+		if !seen[key] && !IsReserved(key) {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range series {
+		add(key)
+	}
+	for _, mark := range marks {
+		mark = mark[len(rollupPrefix):]
+		if idx := strings.LastIndex(mark, RollupSeparator); idx > 0 {
+			add(mark[:idx])
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// rollupSeries rolls up the changed and the new buckets of key in all resolutions
+func (roller *Roller) rollupSeries(key string, now time.Time) error {
+	ctx := context.Background()
+	tracker, tracking := roller.store.(ChangeTracker)
+	tracking = tracking && Supports[ChangeTracker](roller.store)
+	var changes SeriesChanges
+	if tracking {
+		// changes behind the latest watermark are rolled up by advancing the watermarks, all others need to be recorded
+		epoch, until := time.Unix(0, 0), time.Time{}
+		for _, res := range roller.resolutions {
+			if end := bucketStart(now, epoch, res); end.After(until) {
+				until = end
+			}
+		}
+		var err error
+		if changes, err = tracker.TrackChanges(ctx, key, until); err != nil {
+			return err
+		}
+	}
+	for _, res := range roller.resolutions {
+		if changes.Generation > 0 {
+			if err := roller.reroll(key, res, changes); err != nil {
+				return err
+			}
+		}
+		if err := roller.rollup(key, res, now); err != nil {
+			return err
+		}
+	}
+	if tracking {
+		return tracker.ResetChanges(ctx, key, changes)
+	}
+	return nil
+}
+
+func (roller *Roller) rollup(key string, res time.Duration, now time.Time) error {
+	from, _ := roller.watermark(key, res)
+	to := bucketStart(now, time.Unix(0, 0), res)
+	if !to.After(from) {
+		return nil
+	}
+	if err := roller.write(key, res, from, to); err != nil {
+		return err
+	}
+	return roller.store.Put(roller.watermarkKey(key, res), []byte(strconv.FormatInt(to.UnixNano(), 10)))
+}
+
+// reroll replaces the rolled up buckets of key at resolution res which overlap with changes
+func (roller *Roller) reroll(key string, res time.Duration, changes SeriesChanges) error {
+	watermark, ok := roller.watermark(key, res)
+	if !ok {
+		return nil
+	}
+	epoch := time.Unix(0, 0)
+	from := bucketStart(changes.From, epoch, res)
+	to := bucketStart(changes.To, epoch, res).Add(res)
+	if to.After(watermark) {
+		to = watermark
+	}
+	if !to.After(from) {
+		return nil
+	}
+	for _, agg := range rollupStats {
+		err := roller.store.DeleteRange(RollupKey(key, res, agg), from, to.Add(-1))
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return roller.write(key, res, from, to)
+}
+
+// write rolls up the values of key in [from, to) into the rollups of resolution res
+func (roller *Roller) write(key string, res time.Duration, from, to time.Time) error {
+	rollups, err := roller.accumulate(key, from, to, time.Unix(0, 0), res)
+	if err != nil {
+		return err
+	}
+	for agg, entries := range rollups {
+		if err := roller.store.AddValues(RollupKey(key, res, agg), entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// accumulate computes the rollup values of key in [from, to).
+// The range is fully read before returning, some backends can't write while a read is in progress.
+func (roller *Roller) accumulate(key string, from, to, epoch time.Time, res time.Duration) (map[Aggregation][]*TimeSeriesEntry, error) {
+	it, err := roller.store.GetRangeContext(context.Background(), key, from, to.Add(-1))
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	rollups := make(map[Aggregation][]*TimeSeriesEntry)
+	next := accumulate(it, epoch, res)
+	for {
+		acc, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if acc == nil {
+			return rollups, nil
+		}
+		for _, agg := range rollupStats {
+			rollups[agg] = append(rollups[agg], &TimeSeriesEntry{Value: acc.result(agg), Timestamp: acc.start})
+		}
+	}
+}
+
+// GetRange returns the values of key between from and to using the rollup of agg with the coarsest resolution
+// which still yields at least desiredPoints values. Values newer than the rollup are aggregated from the raw timeseries.
+// The raw values are returned if agg is not maintained by the rollups.
+func (roller *Roller) GetRange(key string, from time.Time, to time.Time, desiredPoints int64, agg Aggregation) (chan *TimeSeriesEntry, error) {
+	it, err := roller.GetRangeContext(context.Background(), key, from, to, desiredPoints, agg)
+	if err != nil {
+		return nil, err
+	}
+	return iteratorToChan(it), nil
+}
+
+// GetRangeContext is the context aware variant of GetRange
+func (roller *Roller) GetRangeContext(ctx context.Context, key string, from time.Time, to time.Time, desiredPoints int64, agg Aggregation) (Iterator, error) {
+	if desiredPoints <= 0 {
+		return nil, invalidArgument("desiredPoints needs to be positive")
+	}
+	if !isRollupStat(agg) {
+		return roller.store.GetRangeContext(ctx, key, from, to)
+	}
+	interval := to.Sub(from) / time.Duration(desiredPoints)
+	var (
+		res       time.Duration
+		watermark time.Time
+	)
+	for _, r := range roller.resolutions {
+		if r > interval {
+			break
+		}
+		if stamp, ok := roller.watermark(key, r); ok {
+			res, watermark = r, stamp
+		}
+	}
+	if res == 0 || !watermark.After(from) {
+		return roller.store.GetRangeContext(ctx, key, from, to)
+	}
+	rollupTo := to
+	if !watermark.After(to) {
+		rollupTo = watermark.Add(-1)
+	}
+	rolledUp, err := roller.store.GetRangeContext(ctx, RollupKey(key, res, agg), from, rollupTo)
+	if err != nil {
+		return nil, err
+	}
+	if rollupTo.Equal(to) {
+		return rolledUp, nil
+	}
+	recent, err := roller.store.AggregateContext(ctx, key, watermark, to, res, agg)
+	if err != nil {
+		rolledUp.Close()
+		return nil, err
+	}
+	return concatIterators(ctx, rolledUp, recent), nil
+}
+
+// Start runs the roller every interval in the background until Stop is called
+func (roller *Roller) Start() error {
+	roller.mutex.Lock()
+	defer roller.mutex.Unlock()
+	if roller.stop != nil {
+		return errors.New("roller is already running")
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	roller.stop, roller.done = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(roller.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := roller.Run(); err != nil {
+					log.Print("rollup failed: ", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops the background roller and waits until a run which is in progress is finished
+func (roller *Roller) Stop() {
+	roller.mutex.Lock()
+	stop, done := roller.stop, roller.done
+	roller.stop, roller.done = nil, nil
+	roller.mutex.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Sizer is implemented by storages which keep their data in files
+type Sizer interface {
+	// Size returns the size of the database files in bytes, ok is false if the storage has no files
+	Size() (size int64, ok bool, err error)
+}
+
+// Size returns the size of the bolt database file
+func (store *BoltStorage) Size() (int64, bool, error) {
+	info, err := os.Stat(store.db.Path())
+	if err != nil {
+		return 0, false, err
+	}
+	return info.Size(), true, nil
+}
+
+// Size returns the size of all files in the leveldb directory
+func (store *LevelDBStorage) Size() (int64, bool, error) {
+	size := int64(0)
+	err := filepath.Walk(store.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// files are removed by compactions in the meantime
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return size, true, nil
+}
+
+// Size returns the size of the files of the backend
+func (store *MetaStorage) Size() (int64, bool, error) {
+	if sizer, ok := store.base.(Sizer); ok {
+		return sizer.Size()
+	}
+	return 0, false, nil
+}
@@ -0,0 +1,1109 @@
+// Package storagetest provides a conformance suite for storage.Storage implementations.
+package storagetest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storaged/storage"
+)
+
+// Suite contains the conformance tests, use RunConformance to run it
+type Suite struct {
+	suite.Suite
+	factory func() storage.Storage
+	store   storage.Storage
+}
+
+// RunConformance runs the conformance suite against the stores returned by factory.
+// factory is called before every test and must return an empty store, which is closed after the test.
+func RunConformance(t *testing.T, factory func() storage.Storage) {
+	suite.Run(t, &Suite{factory: factory})
+}
+
+func (suite *Suite) SetupTest() {
+	suite.store = suite.factory()
+	suite.Require().NotNil(suite.store)
+}
+
+func (suite *Suite) TearDownTest() {
+	suite.NoError(suite.store.Close())
+}
+
+func (suite *Suite) toBytes(val interface{}) []byte {
+	bs, err := json.Marshal(val)
+	suite.NoError(err)
+	return bs
+}
+
+// collect reads all remaining entries from ch
+func (suite *Suite) collect(ch chan *storage.TimeSeriesEntry) []*storage.TimeSeriesEntry {
+	entries := []*storage.TimeSeriesEntry{}
+	for entry := range ch {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (suite *Suite) TestPut() {
+	obj := suite.toBytes(map[string]interface{}{
+		"int":    123,
+		"float":  321.123,
+		"string": "string",
+		"object": map[string]interface{}{"foo": "bar"},
+	})
+	err := suite.store.Put("test", obj)
+	suite.NoError(err)
+}
+
+func (suite *Suite) TestComplexPut() {
+	obj := suite.toBytes(map[string]interface{}{
+		"object": []map[string]interface{}{map[string]interface{}{"foo": "bar"}},
+	})
+	err := suite.store.Put("test", obj)
+	suite.NoError(err)
+	restored, err := suite.store.Get("test")
+	suite.NoError(err)
+	suite.Equal(obj, restored)
+}
+
+func (suite *Suite) TestOverwrite() {
+	suite.NoError(suite.store.Put("test", []byte("foo")))
+	suite.NoError(suite.store.PutWithTTL("test", []byte("bar"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	suite.NoError(suite.store.Put("test", []byte("baz")))
+	value, err := suite.store.Get("test")
+	suite.NoError(err)
+	suite.Equal([]byte("baz"), value)
+}
+
+func (suite *Suite) TestGet() {
+	obj := suite.toBytes(map[string]interface{}{
+		"int":    123,
+		"float":  321.123,
+		"string": "string",
+		"object": map[string]interface{}{"foo": "bar"},
+	})
+	err := suite.store.Put("test", obj)
+	suite.NoError(err)
+	restored, err := suite.store.Get("test")
+	suite.NoError(err)
+	suite.Equal(obj, restored)
+}
+
+func (suite *Suite) TestGetNonExisting() {
+	_, err := suite.store.Get("test")
+	suite.ErrorIs(err, storage.ErrNotFound)
+	_, _, err = suite.store.GetVersioned("test/nested")
+	suite.ErrorIs(err, storage.ErrNotFound)
+}
+
+func (suite *Suite) TestDeleteNonExisting() {
+	suite.ErrorIs(suite.store.Delete("test"), storage.ErrNotFound)
+	suite.ErrorIs(suite.store.Delete("test/nested"), storage.ErrNotFound)
+}
+
+func (suite *Suite) TestDelete() {
+	obj := suite.toBytes(map[string]interface{}{
+		"int":    123,
+		"float":  321.123,
+		"string": "string",
+		"object": map[string]interface{}{"foo": "bar"},
+	})
+	err := suite.store.Put("test", obj)
+	suite.NoError(err)
+	err = suite.store.Delete("test")
+	suite.NoError(err)
+	restored, err := suite.store.Get("test")
+	suite.Error(err)
+	suite.Nil(restored)
+}
+
+func (suite *Suite) TestList() {
+	for _, key := range []string{"a", "b/c", "b/d/e", "b/f", "b!", "c"} {
+		suite.NoError(suite.store.Put(key, []byte(key)))
+	}
+	keys, err := suite.store.List("b")
+	suite.NoError(err)
+	suite.Equal([]string{"b!", "b/c", "b/d/e", "b/f"}, keys)
+	keys, err = suite.store.List("b/d")
+	suite.NoError(err)
+	suite.Equal([]string{"b/d/e"}, keys)
+	keys, err = suite.store.List("")
+	suite.NoError(err)
+	suite.Equal([]string{"a", "b!", "b/c", "b/d/e", "b/f", "c"}, keys)
+	keys, err = suite.store.List("x")
+	suite.NoError(err)
+	suite.Empty(keys)
+}
+
+func (suite *Suite) TestScan() {
+	for _, key := range []string{"a", "b/c", "b/d/e", "b/f", "c"} {
+		suite.NoError(suite.store.Put(key, []byte(key)))
+	}
+	keys, err := suite.store.Scan("b/c", "c", 0)
+	suite.NoError(err)
+	suite.Equal([]string{"b/c", "b/d/e", "b/f"}, keys)
+	keys, err = suite.store.Scan("b/c", "", 2)
+	suite.NoError(err)
+	suite.Equal([]string{"b/c", "b/d/e"}, keys)
+	keys, err = suite.store.Scan("b/d/e\x00", "", 0)
+	suite.NoError(err)
+	suite.Equal([]string{"b/f", "c"}, keys)
+}
+
+func (suite *Suite) TestScanLimitOrder() {
+	// "b-x" sorts between "b" and the keys below "b/"
+	for _, key := range []string{"a", "b/c", "b/d/e", "b-x", "b/f", "c"} {
+		suite.NoError(suite.store.Put(key, []byte(key)))
+	}
+	keys, err := suite.store.Scan("", "", 2)
+	suite.NoError(err)
+	suite.Equal([]string{"a", "b-x"}, keys)
+	keys, err = suite.store.Scan("b-", "", 3)
+	suite.NoError(err)
+	suite.Equal([]string{"b-x", "b/c", "b/d/e"}, keys)
+	keys, err = suite.store.Scan("b/c\x00", "c", 1)
+	suite.NoError(err)
+	suite.Equal([]string{"b/d/e"}, keys)
+}
+
+func (suite *Suite) TestPutWithTTL() {
+	suite.NoError(suite.store.PutWithTTL("foo/a", []byte("a"), 100*time.Millisecond))
+	suite.NoError(suite.store.PutWithTTL("foo/b", []byte("b"), time.Hour))
+	suite.NoError(suite.store.Put("foo/c", []byte("c")))
+	value, err := suite.store.Get("foo/a")
+	suite.NoError(err)
+	suite.Equal([]byte("a"), value)
+	time.Sleep(150 * time.Millisecond)
+	_, err = suite.store.Get("foo/a")
+	suite.Error(err)
+	// expired entries can't be deleted anymore
+	suite.ErrorIs(suite.store.Delete("foo/a"), storage.ErrNotFound)
+	keys, err := suite.store.List("foo/")
+	suite.NoError(err)
+	suite.Equal([]string{"foo/b", "foo/c"}, keys)
+	// a plain put removes the ttl
+	suite.NoError(suite.store.PutWithTTL("foo/c", []byte("c"), 100*time.Millisecond))
+	suite.NoError(suite.store.Put("foo/c", []byte("c")))
+	time.Sleep(150 * time.Millisecond)
+	value, err = suite.store.Get("foo/c")
+	suite.NoError(err)
+	suite.Equal([]byte("c"), value)
+}
+
+func (suite *Suite) TestVersions() {
+	suite.NoError(suite.store.Put("foo", []byte("a")))
+	value, v1, err := suite.store.GetVersioned("foo")
+	suite.NoError(err)
+	suite.Equal([]byte("a"), value)
+	suite.NotZero(v1)
+	suite.NoError(suite.store.Put("foo", []byte("b")))
+	_, v2, err := suite.store.GetVersioned("foo")
+	suite.NoError(err)
+	suite.True(v2 > v1)
+	// versions are increasing across keys and deletes
+	suite.NoError(suite.store.Delete("foo"))
+	suite.NoError(suite.store.Put("foo", []byte("c")))
+	_, v3, err := suite.store.GetVersioned("foo")
+	suite.NoError(err)
+	suite.True(v3 > v2)
+}
+
+func (suite *Suite) TestCompareAndSwap() {
+	v1, err := suite.store.CompareAndSwap("foo", 0, []byte("a"))
+	suite.NoError(err)
+	_, err = suite.store.CompareAndSwap("foo", 0, []byte("b"))
+	suite.Equal(storage.ErrVersionMismatch, err)
+	suite.ErrorIs(err, storage.ErrConflict)
+	v2, err := suite.store.CompareAndSwap("foo", v1, []byte("b"))
+	suite.NoError(err)
+	suite.True(v2 > v1)
+	_, err = suite.store.CompareAndSwap("foo", v1, []byte("c"))
+	suite.Equal(storage.ErrVersionMismatch, err)
+	value, version, err := suite.store.GetVersioned("foo")
+	suite.NoError(err)
+	suite.Equal([]byte("b"), value)
+	suite.Equal(v2, version)
+	_, err = suite.store.CompareAndSwap("bar", v2, []byte("c"))
+	suite.Equal(storage.ErrVersionMismatch, err)
+}
+
+func (suite *Suite) TestCompareAndDelete() {
+	version, err := suite.store.CompareAndSwap("foo", 0, []byte("a"))
+	suite.NoError(err)
+	suite.Equal(storage.ErrVersionMismatch, suite.store.CompareAndDelete("foo", version+1))
+	suite.Equal(storage.ErrVersionMismatch, suite.store.CompareAndDelete("bar", version))
+	suite.NoError(suite.store.CompareAndDelete("foo", version))
+	_, err = suite.store.Get("foo")
+	suite.Error(err)
+}
+
+func (suite *Suite) TestConcurrentCompareAndSwap() {
+	_, err := suite.store.CompareAndSwap("counter", 0, []byte("0"))
+	suite.NoError(err)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				for {
+					value, version, err := suite.store.GetVersioned("counter")
+					suite.NoError(err)
+					n, _ := strconv.Atoi(string(value))
+					_, err = suite.store.CompareAndSwap("counter", version, []byte(strconv.Itoa(n+1)))
+					if err == nil {
+						break
+					}
+					suite.Equal(storage.ErrVersionMismatch, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	value, err := suite.store.Get("counter")
+	suite.NoError(err)
+	suite.Equal("40", string(value))
+}
+
+func (suite *Suite) TestCommit() {
+	stamp := time.Unix(1500000000, 0)
+	suite.NoError(suite.store.Put("old", []byte("old")))
+	txn := storage.NewTxn().
+		MustNotExist("config").
+		MustExist("old").
+		Put("config", []byte("config")).
+		Put("index/config", []byte("1")).
+		Delete("old").
+		Delete("missing").
+		AddValue("test", 1, stamp)
+	suite.NoError(suite.store.Commit(txn))
+	value, version, err := suite.store.GetVersioned("config")
+	suite.NoError(err)
+	suite.Equal([]byte("config"), value)
+	_, err = suite.store.Get("old")
+	suite.Error(err)
+	ch, err := suite.store.GetRange("test", stamp, stamp.Add(time.Second))
+	suite.NoError(err)
+	entry := <-ch
+	suite.Equal(1., entry.Value)
+
+	// a failing guard discards all writes
+	txn = storage.NewTxn().
+		Put("index/config", []byte("2")).
+		VersionIs("config", version+1)
+	err = suite.store.Commit(txn)
+	suite.Equal(storage.ErrGuardFailed, err)
+	suite.ErrorIs(err, storage.ErrConflict)
+	value, err = suite.store.Get("index/config")
+	suite.NoError(err)
+	suite.Equal([]byte("1"), value)
+	txn = storage.NewTxn().
+		Put("index/config", []byte("2")).
+		VersionIs("config", version)
+	suite.NoError(suite.store.Commit(txn))
+	value, err = suite.store.Get("index/config")
+	suite.NoError(err)
+	suite.Equal([]byte("2"), value)
+
+	suite.Error(suite.store.Commit(&storage.Txn{Ops: []*storage.TxnOp{{Type: "foo", Key: "bar"}}}))
+}
+
+func (suite *Suite) TestWatch() {
+	watcher, ok := suite.store.(storage.Watcher)
+	if !ok {
+		suite.T().Skip("storage does not implement storage.Watcher")
+	}
+	events, cancel := watcher.Watch("foo/")
+	suite.NoError(suite.store.Put("foo/a", []byte("a")))
+	suite.NoError(suite.store.Put("bar", []byte("b")))
+	version, err := suite.store.CompareAndSwap("foo/a", 0, []byte("c"))
+	suite.Equal(storage.ErrVersionMismatch, err)
+	_, version, err = suite.store.GetVersioned("foo/a")
+	suite.NoError(err)
+	suite.NoError(suite.store.Commit(storage.NewTxn().Delete("foo/a").Put("foo/b", []byte("b"))))
+	event := <-events
+	suite.Equal(&storage.Event{Type: storage.EventPut, Key: "foo/a", Value: []byte("a"), Version: version}, event)
+	event = <-events
+	suite.Equal(&storage.Event{Type: storage.EventDelete, Key: "foo/a"}, event)
+	event = <-events
+	suite.Equal(storage.EventPut, event.Type)
+	suite.Equal("foo/b", event.Key)
+	cancel()
+	_, ok = <-events
+	suite.False(ok)
+	cancel()
+}
+
+func (suite *Suite) TestWatchConcurrentPuts() {
+	watcher, ok := suite.store.(storage.Watcher)
+	if !ok {
+		suite.T().Skip("storage does not implement storage.Watcher")
+	}
+	events, cancel := watcher.Watch("foo")
+	defer cancel()
+	// every write is reported once with the value and version it wrote, in the order of the writes
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				value := []byte(fmt.Sprintf("%v-%v", i, j))
+				if j%2 == 0 {
+					suite.NoError(suite.store.Put("foo", value))
+				} else {
+					suite.NoError(suite.store.Commit(storage.NewTxn().Put("foo", value)))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	versions := make(map[uint64][]byte)
+	last := uint64(0)
+	for i := 0; i < 40; i++ {
+		event := <-events
+		suite.Greater(event.Version, last)
+		last = event.Version
+		versions[event.Version] = event.Value
+	}
+	value, version, err := suite.store.GetVersioned("foo")
+	suite.NoError(err)
+	suite.Equal(value, versions[version])
+}
+
+func (suite *Suite) TestFollow() {
+	watcher, ok := suite.store.(storage.SeriesWatcher)
+	if !ok {
+		suite.T().Skip("storage does not implement storage.SeriesWatcher")
+	}
+	stamp := time.Unix(1500000000, 0)
+	exact, cancelExact := watcher.Follow("test")
+	defer cancelExact()
+	prefix, cancelPrefix := watcher.Follow("test*")
+	defer cancelPrefix()
+	suite.NoError(suite.store.AddValues("test", []*storage.TimeSeriesEntry{{Value: 1, Timestamp: stamp}}))
+	suite.NoError(suite.store.AddValue("test/value", 2))
+	suite.NoError(suite.store.Commit(storage.NewTxn().AddValue("test", 3, time.Time{})))
+	event := <-exact
+	suite.Equal(&storage.Event{Type: storage.EventAddValue, Key: "test", Entry: &storage.TimeSeriesEntry{Value: 1, Timestamp: stamp}}, event)
+	event = <-exact
+	suite.Equal(3., event.Entry.Value)
+	suite.False(event.Entry.Timestamp.IsZero())
+	for _, key := range []string{"test", "test/value", "test"} {
+		event = <-prefix
+		suite.Equal(key, event.Key)
+	}
+}
+
+func (suite *Suite) TestAddValue() {
+	err := suite.store.AddValue("test", 123.123)
+	suite.NoError(err)
+}
+
+func (suite *Suite) TestAddValueNestedBucket() {
+	err := suite.store.AddValue("test/value", 123.123)
+	suite.NoError(err)
+}
+
+func (suite *Suite) TestAddValues() {
+	base := time.Unix(1500000000, 0)
+	entries := []*storage.TimeSeriesEntry{
+		{Value: 2, Timestamp: base.Add(2 * time.Second)},
+		{Value: 0, Timestamp: base},
+		{Value: 1, Timestamp: base.Add(time.Second)},
+	}
+	err := suite.store.AddValues("test", entries)
+	suite.NoError(err)
+	ch, err := suite.store.GetRange("test", base, base.Add(time.Minute))
+	suite.NoError(err)
+	for i := 0; i < 3; i++ {
+		kv, ok := <-ch
+		suite.True(ok)
+		suite.Equal(float64(i), kv.Value)
+		suite.Equal(base.Add(time.Duration(i)*time.Second).UnixNano(), kv.Timestamp.UnixNano())
+	}
+	_, ok := <-ch
+	suite.False(ok)
+}
+
+func (suite *Suite) TestGetRange() {
+	for i := 0; i < 100; i++ {
+		err := suite.store.AddValue("test", float64(i))
+		suite.NoError(err)
+	}
+	ch, err := suite.store.GetRange("test", time.Time{}, time.Now())
+	suite.NoError(err)
+	for i := 0; i < 100; i++ {
+		kv, ok := <-ch
+		suite.True(ok)
+		suite.Equal(float64(i), kv.Value)
+	}
+	_, ok := <-ch
+	suite.False(ok)
+}
+
+func (suite *Suite) TestGetRangeContext() {
+	for i := 0; i < 10; i++ {
+		suite.NoError(suite.store.AddValue("test", float64(i)))
+	}
+	it, err := suite.store.GetRangeContext(context.Background(), "test", time.Time{}, time.Now())
+	suite.NoError(err)
+	i := 0
+	for it.Next() {
+		suite.Equal(float64(i), it.Entry().Value)
+		i++
+	}
+	suite.NoError(it.Err())
+	suite.Equal(10, i)
+	suite.NoError(it.Close())
+	suite.NoError(it.Close())
+	suite.False(it.Next())
+}
+
+func (suite *Suite) TestGetRangeCancel() {
+	for i := 0; i < 10; i++ {
+		suite.NoError(suite.store.AddValue("test", float64(i)))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	it, err := suite.store.GetRangeContext(ctx, "test", time.Time{}, time.Now())
+	suite.NoError(err)
+	defer it.Close()
+	suite.True(it.Next())
+	cancel()
+	suite.False(it.Next())
+	suite.ErrorIs(it.Err(), context.Canceled)
+
+	// a channel of an abandoned range must still be released by draining it
+	ch, err := suite.store.GetRange("test", time.Time{}, time.Now())
+	suite.NoError(err)
+	<-ch
+	suite.Len(suite.collect(ch), 9)
+}
+
+func (suite *Suite) TestAggregateContext() {
+	base := time.Unix(1500000000, 0)
+	entries := []*storage.TimeSeriesEntry{}
+	for i := 0; i < 10; i++ {
+		entries = append(entries, &storage.TimeSeriesEntry{Value: float64(i), Timestamp: base.Add(time.Duration(i) * time.Second)})
+	}
+	suite.NoError(suite.store.AddValues("test", entries))
+	it, err := suite.store.AggregateContext(context.Background(), "test", base, base.Add(time.Minute), 5*time.Second, storage.AggSum)
+	suite.NoError(err)
+	defer it.Close()
+	values := []float64{}
+	for it.Next() {
+		values = append(values, it.Entry().Value)
+	}
+	suite.NoError(it.Err())
+	suite.Equal([]float64{10, 35}, values)
+}
+
+func (suite *Suite) TestAggregate() {
+	base := time.Unix(1500000000, 0)
+	entries := []*storage.TimeSeriesEntry{}
+	for i := 0; i < 10; i++ {
+		entries = append(entries, &storage.TimeSeriesEntry{Value: float64(i), Timestamp: base.Add(time.Duration(i) * time.Second)})
+	}
+	suite.NoError(suite.store.AddValues("test", entries))
+	expected := map[storage.Aggregation][]float64{
+		storage.AggAvg:    {1, 4, 7, 9},
+		storage.AggMin:    {0, 3, 6, 9},
+		storage.AggMax:    {2, 5, 8, 9},
+		storage.AggSum:    {3, 12, 21, 9},
+		storage.AggCount:  {3, 3, 3, 1},
+		storage.AggFirst:  {0, 3, 6, 9},
+		storage.AggLast:   {2, 5, 8, 9},
+		storage.AggStddev: {math.Sqrt(2. / 3.), math.Sqrt(2. / 3.), math.Sqrt(2. / 3.), 0},
+	}
+	for agg, values := range expected {
+		ch, err := suite.store.Aggregate("test", base, base.Add(time.Minute), 3*time.Second, agg)
+		suite.NoError(err)
+		i := 0
+		for entry := range ch {
+			suite.InDelta(values[i], entry.Value, 1e-9, string(agg))
+			suite.Equal(base.Add(time.Duration(i)*3*time.Second).UnixNano(), entry.Timestamp.UnixNano())
+			i++
+		}
+		suite.Equal(len(values), i)
+	}
+}
+
+func (suite *Suite) TestDeleteRange() {
+	var stopTime time.Time
+	for i := 0; i < 100; i++ {
+		err := suite.store.AddValue("test", float64(i))
+		if i == 49 {
+			stopTime = time.Now()
+		}
+		suite.NoError(err)
+	}
+	err := suite.store.DeleteRange("test", stopTime, time.Now())
+	suite.NoError(err)
+	ch, err := suite.store.GetRange("test", time.Time{}, time.Now())
+	suite.NoError(err)
+	for i := 0; i < 50; i++ {
+		kv, ok := <-ch
+		suite.True(ok)
+		suite.Equal(float64(i), kv.Value)
+	}
+	_, ok := <-ch
+	suite.False(ok)
+}
+
+func (suite *Suite) TestListSeries() {
+	for _, key := range []string{"test", "test/value", "sensors/a", "sensors/b"} {
+		suite.NoError(suite.store.AddValue(key, 1))
+	}
+	keys, err := suite.store.ListSeries("")
+	suite.NoError(err)
+	suite.Equal([]string{"sensors/a", "sensors/b", "test", "test/value"}, keys)
+	keys, err = suite.store.ListSeries("sensors/")
+	suite.NoError(err)
+	suite.Equal([]string{"sensors/a", "sensors/b"}, keys)
+	// reading or deleting a missing timeseries doesn't create it
+	ch, err := suite.store.GetRange("sensors/c", time.Time{}, time.Now())
+	if err == nil {
+		for range ch {
+		}
+	}
+	ch, err = suite.store.Aggregate("sensors/c", time.Time{}, time.Now(), time.Hour, storage.AggAvg)
+	if err == nil {
+		for range ch {
+		}
+	}
+	suite.store.DeleteRange("sensors/c", time.Time{}, time.Now())
+	_, err = suite.store.Get("sensors/c")
+	suite.Error(err)
+	keys, err = suite.store.ListSeries("sensors/")
+	suite.NoError(err)
+	suite.Equal([]string{"sensors/a", "sensors/b"}, keys)
+}
+
+func (suite *Suite) TestRetention() {
+	now := time.Now()
+	for _, key := range []string{"sensors/a", "test"} {
+		suite.NoError(suite.store.AddValues(key, []*storage.TimeSeriesEntry{
+			{Value: 1, Timestamp: now.Add(-48 * time.Hour)},
+			{Value: 2, Timestamp: now.Add(-47 * time.Hour)},
+			{Value: 3, Timestamp: now.Add(-time.Hour)},
+		}))
+	}
+	janitor := storage.NewJanitor(suite.store, time.Hour)
+	rule, err := storage.ParseRetentionRule("sensors/* keep 1d")
+	suite.NoError(err)
+	janitor.SetRules([]*storage.RetentionRule{rule})
+	removed, err := janitor.Run(true)
+	suite.NoError(err)
+	suite.Equal(map[string]int{"sensors/a": 2}, removed)
+	removed, err = janitor.Run(false)
+	suite.NoError(err)
+	suite.Equal(map[string]int{"sensors/a": 2}, removed)
+	removed, err = janitor.Run(true)
+	suite.NoError(err)
+	suite.Empty(removed)
+	for key, count := range map[string]int{"sensors/a": 1, "test": 3} {
+		ch, err := suite.store.GetRange(key, time.Time{}, now)
+		suite.NoError(err)
+		n := 0
+		for range ch {
+			n++
+		}
+		suite.Equal(count, n, key)
+	}
+}
+
+func (suite *Suite) TestRollup() {
+	base := time.Now().Truncate(time.Hour).Add(-2 * time.Hour)
+	entries := []*storage.TimeSeriesEntry{}
+	for i := 0; i < 120; i++ {
+		entries = append(entries, &storage.TimeSeriesEntry{Value: float64(i % 60), Timestamp: base.Add(time.Duration(i) * 30 * time.Second)})
+	}
+	suite.NoError(suite.store.AddValues("test", entries))
+	roller := storage.NewRoller(suite.store, []time.Duration{time.Hour, time.Minute}, time.Minute)
+	suite.NoError(roller.Run())
+
+	expected := map[string][]float64{
+		storage.RollupKey("test", time.Hour, storage.AggMin):   {0},
+		storage.RollupKey("test", time.Hour, storage.AggMax):   {59},
+		storage.RollupKey("test", time.Hour, storage.AggAvg):   {29.5},
+		storage.RollupKey("test", time.Hour, storage.AggCount): {120},
+	}
+	for key, values := range expected {
+		ch, err := suite.store.GetRange(key, base, time.Now())
+		suite.NoError(err)
+		i := 0
+		for entry := range ch {
+			suite.Equal(values[i], entry.Value, key)
+			suite.Equal(base.UnixNano(), entry.Timestamp.UnixNano(), key)
+			i++
+		}
+		suite.Equal(len(values), i, key)
+	}
+	// rollups are only listed in the reserved namespace
+	keys, err := suite.store.ListSeries("")
+	suite.NoError(err)
+	suite.Equal([]string{"test"}, keys)
+	keys, err = suite.store.ListSeries(storage.ReservedPrefix + "rollup/test@1m/")
+	suite.NoError(err)
+	suite.Equal([]string{
+		storage.RollupKey("test", time.Minute, storage.AggAvg),
+		storage.RollupKey("test", time.Minute, storage.AggCount),
+		storage.RollupKey("test", time.Minute, storage.AggMax),
+		storage.RollupKey("test", time.Minute, storage.AggMin),
+	}, keys)
+
+	// a second run doesn't duplicate anything
+	suite.NoError(roller.Run())
+	ch, err := suite.store.GetRange(storage.RollupKey("test", time.Minute, storage.AggCount), base, time.Now())
+	suite.NoError(err)
+	n := 0
+	for entry := range ch {
+		suite.Equal(2., entry.Value)
+		n++
+	}
+	suite.Equal(60, n)
+
+	// new values after the last rollup are read from the raw timeseries
+	suite.NoError(suite.store.AddValue("test", 100))
+	ch, err = roller.GetRange("test", base, time.Now(), 2, storage.AggAvg)
+	suite.NoError(err)
+	values := []float64{}
+	for entry := range ch {
+		values = append(values, entry.Value)
+	}
+	suite.Equal([]float64{29.5, 100}, values)
+	ch, err = roller.GetRange("test", base, time.Now(), 2, storage.AggMax)
+	suite.NoError(err)
+	values = []float64{}
+	for entry := range ch {
+		values = append(values, entry.Value)
+	}
+	suite.Equal([]float64{59, 100}, values)
+}
+
+// rollupValues returns the values of a rollup of the test series since base
+func (suite *Suite) rollupValues(key string, res time.Duration, agg storage.Aggregation, base time.Time) []float64 {
+	ch, err := suite.store.GetRange(storage.RollupKey(key, res, agg), base, time.Now())
+	suite.NoError(err)
+	values := []float64{}
+	for entry := range ch {
+		values = append(values, entry.Value)
+	}
+	return values
+}
+
+func (suite *Suite) TestRollupChanges() {
+	base := time.Now().Truncate(time.Hour).Add(-3 * time.Hour)
+	suite.NoError(suite.store.AddValues("test", []*storage.TimeSeriesEntry{
+		{Value: 1, Timestamp: base},
+		{Value: 3, Timestamp: base.Add(time.Hour)},
+	}))
+	roller := storage.NewRoller(suite.store, []time.Duration{time.Hour}, time.Minute)
+	suite.NoError(roller.Run())
+	suite.Equal([]float64{1, 3}, suite.rollupValues("test", time.Hour, storage.AggAvg, base))
+
+	// values added to rolled up buckets are rolled up again
+	suite.NoError(suite.store.AddValues("test", []*storage.TimeSeriesEntry{
+		{Value: 5, Timestamp: base.Add(time.Minute)},
+		{Value: 7, Timestamp: base.Add(2 * time.Hour)},
+	}))
+	suite.NoError(roller.Run())
+	suite.Equal([]float64{3, 3, 7}, suite.rollupValues("test", time.Hour, storage.AggAvg, base))
+	suite.Equal([]float64{2, 1, 1}, suite.rollupValues("test", time.Hour, storage.AggCount, base))
+
+	// deleted values are removed from the rollups
+	suite.NoError(suite.store.DeleteRange("test", base, base.Add(time.Hour-1)))
+	suite.NoError(roller.Run())
+	suite.Equal([]float64{3, 7}, suite.rollupValues("test", time.Hour, storage.AggAvg, base))
+	suite.NoError(suite.store.DeleteRange("test", time.Time{}, time.Now()))
+	suite.NoError(roller.Run())
+	suite.Empty(suite.rollupValues("test", time.Hour, storage.AggAvg, base))
+	suite.Empty(suite.rollupValues("test", time.Hour, storage.AggMax, base))
+}
+
+func (suite *Suite) TestRollupRetention() {
+	base := time.Now().Truncate(time.Hour).Add(-4 * time.Hour)
+	suite.NoError(suite.store.AddValues("test", []*storage.TimeSeriesEntry{
+		{Value: 1, Timestamp: base},
+		{Value: 3, Timestamp: base.Add(2 * time.Hour)},
+	}))
+	roller := storage.NewRoller(suite.store, []time.Duration{time.Hour}, time.Minute)
+	suite.NoError(roller.Run())
+	janitor := storage.NewJanitor(suite.store, time.Hour)
+	rule, err := storage.ParseRetentionRule("* keep 3h")
+	suite.NoError(err)
+	janitor.SetRules([]*storage.RetentionRule{rule})
+	removed, err := janitor.Run(false)
+	suite.NoError(err)
+	suite.Equal(map[string]int{"test": 1}, removed)
+
+	// the rollups are neither removed by the retention rule nor by rolling up the expired values again
+	suite.NoError(roller.Run())
+	suite.Equal([]float64{1, 3}, suite.rollupValues("test", time.Hour, storage.AggAvg, base))
+}
+
+func (suite *Suite) TestNestedKeys() {
+	for _, key := range []string{"a/b/c", "a/b/d", "a/e", "f"} {
+		suite.NoError(suite.store.Put(key, []byte(key)))
+	}
+	for _, key := range []string{"a/b/c", "a/b/d", "a/e", "f"} {
+		value, err := suite.store.Get(key)
+		suite.NoError(err)
+		suite.Equal([]byte(key), value)
+	}
+	_, err := suite.store.Get("a/b")
+	suite.Error(err)
+	_, err = suite.store.Get("a/b/c/d")
+	suite.Error(err)
+	suite.NoError(suite.store.Delete("a/b/c"))
+	keys, err := suite.store.List("a/")
+	suite.NoError(err)
+	suite.Equal([]string{"a/b/d", "a/e"}, keys)
+}
+
+func (suite *Suite) TestTimeSeriesOrdering() {
+	base := time.Unix(1500000000, 0)
+	for i := 9; i >= 0; i-- {
+		stamp := base.Add(time.Duration(i) * time.Second)
+		suite.NoError(suite.store.AddValues("test", []*storage.TimeSeriesEntry{{Value: float64(i), Timestamp: stamp}}))
+		suite.NoError(suite.store.AddValues("test/nested", []*storage.TimeSeriesEntry{{Value: -1, Timestamp: stamp}}))
+	}
+	ch, err := suite.store.GetRange("test", time.Time{}, base.Add(time.Hour))
+	suite.NoError(err)
+	entries := suite.collect(ch)
+	suite.Len(entries, 10)
+	for i, entry := range entries {
+		suite.Equal(float64(i), entry.Value)
+		suite.Equal(base.Add(time.Duration(i)*time.Second).UnixNano(), entry.Timestamp.UnixNano())
+	}
+}
+
+func (suite *Suite) TestSeriesKeyCollisions() {
+	base := time.Unix(1500000000, 0)
+	for i, key := range []string{"foo", "foo1", "foo15", "fo"} {
+		suite.NoError(suite.store.AddValues(key, []*storage.TimeSeriesEntry{{Value: float64(i), Timestamp: base}}))
+	}
+	for i, key := range []string{"foo", "foo1", "foo15", "fo"} {
+		ch, err := suite.store.GetRange(key, time.Time{}, base.Add(time.Hour))
+		suite.NoError(err)
+		entries := suite.collect(ch)
+		suite.Len(entries, 1, key)
+		suite.Equal(float64(i), entries[0].Value, key)
+	}
+	keys, err := suite.store.ListSeries("foo")
+	suite.NoError(err)
+	suite.Equal([]string{"foo", "foo1", "foo15"}, keys)
+}
+
+func (suite *Suite) TestOldTimestamps() {
+	stamps := []time.Time{
+		time.Unix(-1500000000, 0),
+		time.Unix(-1, 0),
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(999999999, 0),
+		time.Unix(1500000000, 0),
+	}
+	for i := len(stamps) - 1; i >= 0; i-- {
+		suite.NoError(suite.store.AddValues("test", []*storage.TimeSeriesEntry{{Value: float64(i), Timestamp: stamps[i]}}))
+	}
+	ch, err := suite.store.GetRange("test", time.Time{}, time.Now())
+	suite.NoError(err)
+	entries := suite.collect(ch)
+	suite.Len(entries, len(stamps))
+	for i, entry := range entries {
+		suite.Equal(float64(i), entry.Value)
+		suite.Equal(stamps[i].UnixNano(), entry.Timestamp.UnixNano())
+	}
+	ch, err = suite.store.GetRange("test", time.Unix(-1, 0), time.Unix(1, 0))
+	suite.NoError(err)
+	suite.Len(suite.collect(ch), 3)
+}
+
+func (suite *Suite) TestDuplicatePolicies() {
+	suite.store.SetDuplicateRules([]*storage.DuplicateRule{
+		{Pattern: "reject/*", Policy: storage.DuplicateReject},
+		{Pattern: "keep/*", Policy: storage.DuplicateKeep},
+		{Pattern: "keep/overwrite", Policy: storage.DuplicateOverwrite},
+	})
+	defer suite.store.SetDuplicateRules(nil)
+	base := time.Unix(1500000000, 0)
+	values := func(key string) []float64 {
+		ch, err := suite.store.GetRange(key, base, base)
+		suite.NoError(err)
+		res := []float64{}
+		for entry := range ch {
+			suite.Equal(base.UnixNano(), entry.Timestamp.UnixNano())
+			res = append(res, entry.Value)
+		}
+		return res
+	}
+	for _, key := range []string{"overwrite", "reject/a", "keep/a", "keep/overwrite"} {
+		suite.NoError(suite.store.AddValues(key, []*storage.TimeSeriesEntry{{Value: 1, Timestamp: base}}))
+	}
+	for _, key := range []string{"overwrite", "keep/a", "keep/overwrite"} {
+		suite.NoError(suite.store.AddValues(key, []*storage.TimeSeriesEntry{{Value: 2, Timestamp: base}, {Value: 3, Timestamp: base}}))
+	}
+	err := suite.store.AddValues("reject/a", []*storage.TimeSeriesEntry{{Value: 2, Timestamp: base}})
+	suite.ErrorIs(err, storage.ErrDuplicateTimestamp)
+	suite.ErrorIs(err, storage.ErrConflict)
+	suite.ErrorIs(suite.store.Commit(storage.NewTxn().AddValue("reject/a", 4, base)), storage.ErrDuplicateTimestamp)
+	suite.NoError(suite.store.Commit(storage.NewTxn().AddValue("keep/a", 4, base)))
+
+	suite.Equal([]float64{3}, values("overwrite"))
+	suite.Equal([]float64{1}, values("reject/a"))
+	suite.Equal([]float64{1, 2, 3, 4}, values("keep/a"))
+	suite.Equal([]float64{3}, values("keep/overwrite"))
+	suite.Equal(storage.DuplicateKeep, storage.DuplicatePolicyFor(suite.store.DuplicateRules(), "keep/b"))
+
+	suite.NoError(suite.store.DeleteRange("keep/a", base, base))
+	suite.Empty(values("keep/a"))
+}
+
+func (suite *Suite) TestFields() {
+	base := time.Unix(1500000000, 0)
+	suite.NoError(suite.store.AddValues("test", []*storage.TimeSeriesEntry{
+		{Value: 21.5, Timestamp: base, Fields: map[string]float64{"humidity": 40, "pressure": 1013.25}},
+		{Value: 22, Timestamp: base.Add(time.Second)},
+	}))
+	suite.NoError(suite.store.Commit(storage.NewTxn().Put("foo", []byte("bar")).AddValue("test", 23, base.Add(2*time.Second))))
+	ch, err := suite.store.GetRange("test", base, base.Add(time.Minute))
+	suite.NoError(err)
+	entries := suite.collect(ch)
+	suite.Len(entries, 3)
+	suite.Equal(21.5, entries[0].Value)
+	suite.Equal(map[string]float64{"humidity": 40, "pressure": 1013.25}, entries[0].Fields)
+	humidity, ok := entries[0].Field("humidity")
+	suite.True(ok)
+	suite.Equal(40., humidity)
+	value, ok := entries[0].Field(storage.DefaultField)
+	suite.True(ok)
+	suite.Equal(21.5, value)
+	suite.Empty(entries[1].Fields)
+	_, ok = entries[1].Field("humidity")
+	suite.False(ok)
+	suite.Equal(23., entries[2].Value)
+
+	// aggregations only use the default field
+	ch, err = suite.store.Aggregate("test", base, base.Add(time.Minute), time.Minute, storage.AggSum)
+	suite.NoError(err)
+	entries = suite.collect(ch)
+	suite.Len(entries, 1)
+	suite.Equal(66.5, entries[0].Value)
+}
+
+func (suite *Suite) TestLabels() {
+	labeler, ok := suite.store.(storage.Labeler)
+	if !ok {
+		suite.T().Skip("storage does not implement storage.Labeler")
+	}
+	ctx := context.Background()
+	suite.NoError(labeler.SetLabels(ctx, "temp/a", storage.Labels{"host": "a", "region": "eu"}))
+	suite.NoError(labeler.SetLabels(ctx, "temp/b", storage.Labels{"host": "b", "region": "eu"}))
+	suite.NoError(labeler.SetLabels(ctx, "temp/c", storage.Labels{"host": "c", "region": "us"}))
+	suite.NoError(labeler.SetLabels(ctx, "temp", storage.Labels{"region": "asia"}))
+	labels, err := labeler.Labels(ctx, "temp/a")
+	suite.NoError(err)
+	suite.Equal(storage.Labels{"host": "a", "region": "eu"}, labels)
+	labels, err = labeler.Labels(ctx, "temp/none")
+	suite.NoError(err)
+	suite.Empty(labels)
+
+	match := func(str string) []string {
+		matchers, err := storage.ParseLabelMatchers(str)
+		suite.NoError(err)
+		series, err := labeler.MatchSeries(ctx, matchers)
+		suite.NoError(err)
+		keys := []string{}
+		for _, s := range series {
+			keys = append(keys, s.Key)
+		}
+		return keys
+	}
+	suite.Equal([]string{"temp/a", "temp/b"}, match("region=eu"))
+	suite.Equal([]string{"temp/b"}, match("region=eu,host=b"))
+	suite.Equal([]string{"temp/a", "temp/c"}, match("host!=b"))
+	suite.Equal([]string{"temp"}, match("region=asia"))
+	suite.Equal([]string{}, match("region=africa"))
+
+	// replacing the labels removes the old index entries
+	suite.NoError(labeler.SetLabels(ctx, "temp/a", storage.Labels{"region": "us"}))
+	suite.Equal([]string{"temp/b"}, match("region=eu"))
+	suite.Equal([]string{"temp/a", "temp/c"}, match("region=us"))
+	suite.NoError(labeler.SetLabels(ctx, "temp/c", nil))
+	suite.Equal([]string{"temp/a"}, match("region=us"))
+
+	suite.ErrorIs(labeler.SetLabels(ctx, "temp/a", storage.Labels{"host": "a/b"}), storage.ErrInvalidArgument)
+	suite.ErrorIs(labeler.SetLabels(ctx, "temp/a", storage.Labels{"1host": "a"}), storage.ErrInvalidArgument)
+	keys, err := suite.store.ListSeries("")
+	suite.NoError(err)
+	suite.Empty(keys)
+
+	// deleting the last entry of a timeseries removes its labels
+	suite.NoError(suite.store.AddValue("temp/b", 1))
+	suite.NoError(suite.store.DeleteRange("temp/b", time.Time{}, time.Now()))
+	suite.Equal([]string{}, match("region=eu"))
+	labels, err = labeler.Labels(ctx, "temp/b")
+	suite.NoError(err)
+	suite.Empty(labels)
+}
+
+func (suite *Suite) TestAggregateSeries() {
+	base := time.Unix(1500000000, 0)
+	suite.NoError(suite.store.AddValues("a", []*storage.TimeSeriesEntry{{Value: 1, Timestamp: base}, {Value: 3, Timestamp: base.Add(time.Minute)}}))
+	suite.NoError(suite.store.AddValues("b", []*storage.TimeSeriesEntry{{Value: 2, Timestamp: base.Add(time.Second)}, {Value: 5, Timestamp: base.Add(time.Minute)}}))
+	it, err := storage.AggregateSeries(context.Background(), suite.store, []string{"a", "b", "none"}, base, base.Add(time.Hour), time.Minute, storage.AggSum)
+	suite.NoError(err)
+	defer it.Close()
+	entries := []*storage.TimeSeriesEntry{}
+	for it.Next() {
+		entries = append(entries, it.Entry())
+	}
+	suite.NoError(it.Err())
+	suite.Equal([]*storage.TimeSeriesEntry{{Value: 3, Timestamp: base}, {Value: 8, Timestamp: base.Add(time.Minute)}}, entries)
+}
+
+func (suite *Suite) TestSeriesCatalog() {
+	catalog, ok := suite.store.(storage.SeriesCatalog)
+	if !ok {
+		suite.T().Skip("storage does not implement storage.SeriesCatalog")
+	}
+	ctx := context.Background()
+	base := time.Unix(1500000000, 0)
+	at := func(i int) time.Time { return base.Add(time.Duration(i) * time.Second) }
+	check := func(key string, first, last time.Time, count int64, value float64) {
+		info, err := catalog.SeriesInfo(ctx, key)
+		if suite.NoError(err) {
+			suite.Equal(key, info.Key)
+			suite.True(first.Equal(info.First), "first of %v: %v", key, info.First)
+			suite.True(last.Equal(info.Last), "last of %v: %v", key, info.Last)
+			suite.Equal(count, info.Count, "count of %v", key)
+			suite.Equal(value, info.LastEntry.Value, "last value of %v", key)
+			suite.True(last.Equal(info.LastEntry.Timestamp))
+		}
+	}
+	_, err := catalog.SeriesInfo(ctx, "cat")
+	suite.ErrorIs(err, storage.ErrNotFound)
+
+	suite.NoError(suite.store.AddValues("cat", []*storage.TimeSeriesEntry{
+		{Value: 1, Timestamp: at(1)},
+		{Value: 2, Timestamp: at(2)},
+		{Value: 3, Timestamp: at(3), Fields: map[string]float64{"humidity": 40}},
+	}))
+	check("cat", at(1), at(3), 3, 3)
+	info, err := catalog.SeriesInfo(ctx, "cat")
+	suite.NoError(err)
+	suite.Equal(map[string]float64{"humidity": 40}, info.LastEntry.Fields)
+	// overwriting doesn't change the count, also not within a batch
+	suite.NoError(suite.store.AddValues("cat", []*storage.TimeSeriesEntry{{Value: 20, Timestamp: at(2)}, {Value: 21, Timestamp: at(2)}}))
+	check("cat", at(1), at(3), 3, 3)
+	suite.NoError(suite.store.AddValues("cat", []*storage.TimeSeriesEntry{{Value: 0, Timestamp: at(0)}, {Value: 5, Timestamp: at(5)}}))
+	check("cat", at(0), at(5), 5, 5)
+	suite.NoError(suite.store.Commit(storage.NewTxn().AddValue("cat", 4, at(4)).AddValue("cat/nested", 1, at(1))))
+	check("cat", at(0), at(5), 6, 5)
+	check("cat/nested", at(1), at(1), 1, 1)
+
+	infos, err := catalog.ListSeriesInfo(ctx, "cat")
+	suite.NoError(err)
+	if suite.Len(infos, 2) {
+		suite.Equal("cat", infos[0].Key)
+		suite.Equal("cat/nested", infos[1].Key)
+	}
+
+	suite.NoError(suite.store.DeleteRange("cat", at(0), at(1)))
+	check("cat", at(2), at(5), 4, 5)
+	suite.NoError(suite.store.DeleteRange("cat", at(4), at(10)))
+	check("cat", at(2), at(3), 2, 3)
+	suite.NoError(suite.store.DeleteRange("cat", at(0), at(10)))
+	_, err = catalog.SeriesInfo(ctx, "cat")
+	suite.ErrorIs(err, storage.ErrNotFound)
+
+	// kept duplicates are counted
+	suite.store.SetDuplicateRules([]*storage.DuplicateRule{{Pattern: "keep", Policy: storage.DuplicateKeep}})
+	defer suite.store.SetDuplicateRules(nil)
+	suite.NoError(suite.store.AddValues("keep", []*storage.TimeSeriesEntry{{Value: 1, Timestamp: at(1)}, {Value: 2, Timestamp: at(1)}}))
+	check("keep", at(1), at(1), 2, 2)
+}
+
+func (suite *Suite) TestGetRangeBoundaries() {
+	base := time.Unix(1500000000, 0)
+	suite.NoError(suite.store.AddValues("test", []*storage.TimeSeriesEntry{
+		{Value: 0, Timestamp: base},
+		{Value: 1, Timestamp: base.Add(time.Second)},
+		{Value: 2, Timestamp: base.Add(2 * time.Second)},
+	}))
+	for _, tc := range []struct {
+		from, to time.Time
+		expected []float64
+	}{
+		{base, base.Add(2 * time.Second), []float64{0, 1, 2}},
+		{base.Add(time.Second), base.Add(time.Second), []float64{1}},
+		{base.Add(time.Nanosecond), base.Add(2*time.Second - time.Nanosecond), []float64{1}},
+		{base.Add(3 * time.Second), base.Add(time.Hour), []float64{}},
+	} {
+		ch, err := suite.store.GetRange("test", tc.from, tc.to)
+		suite.NoError(err)
+		values := []float64{}
+		for _, entry := range suite.collect(ch) {
+			values = append(values, entry.Value)
+		}
+		suite.Equal(tc.expected, values, fmt.Sprintf("%v - %v", tc.from, tc.to))
+	}
+}
+
+func (suite *Suite) TestDeleteRangeBoundaries() {
+	base := time.Unix(1500000000, 0)
+	entries := []*storage.TimeSeriesEntry{}
+	for i := 0; i < 4; i++ {
+		entries = append(entries, &storage.TimeSeriesEntry{Value: float64(i), Timestamp: base.Add(time.Duration(i) * time.Second)})
+	}
+	suite.NoError(suite.store.AddValues("test", entries))
+	suite.NoError(suite.store.DeleteRange("test", base.Add(time.Second), base.Add(2*time.Second)))
+	ch, err := suite.store.GetRange("test", base, base.Add(time.Hour))
+	suite.NoError(err)
+	values := []float64{}
+	for _, entry := range suite.collect(ch) {
+		values = append(values, entry.Value)
+	}
+	suite.Equal([]float64{0, 3}, values)
+}
+
+func (suite *Suite) TestConcurrentWrites() {
+	base := time.Unix(1500000000, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				key := fmt.Sprintf("test/%v/%02d", i, j)
+				suite.NoError(suite.store.Put(key, []byte(key)))
+				entry := &storage.TimeSeriesEntry{Value: float64(j), Timestamp: base.Add(time.Duration(j) * time.Second)}
+				suite.NoError(suite.store.AddValues(fmt.Sprintf("series/%v", i), []*storage.TimeSeriesEntry{entry}))
+			}
+		}(i)
+	}
+	wg.Wait()
+	keys, err := suite.store.List("test/")
+	suite.NoError(err)
+	suite.Len(keys, 100)
+	for i := 0; i < 4; i++ {
+		ch, err := suite.store.GetRange(fmt.Sprintf("series/%v", i), base, base.Add(time.Hour))
+		suite.NoError(err)
+		suite.Len(suite.collect(ch), 25)
+	}
+}
+
+func (suite *Suite) TestCloseTwice() {
+	// the store is closed again by TearDownTest
+	suite.NoError(suite.store.Close())
+}
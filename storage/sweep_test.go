@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSweepExpired(t *testing.T) {
+	defer os.RemoveAll("./test-sweep.db")
+	boltStore, err := NewBoltStorage("./test-sweep.db")
+	assert.NoError(t, err)
+	os.RemoveAll("./test-sweep-leveldb.db")
+	defer os.RemoveAll("./test-sweep-leveldb.db")
+	levelStore, err := NewLevelDBStorage("./test-sweep-leveldb.db")
+	assert.NoError(t, err)
+	for _, store := range []interface {
+		Storage
+		sweepExpired() error
+	}{boltStore.(*BoltStorage), levelStore} {
+		assert.NoError(t, store.PutWithTTL("foo/a", []byte("a"), time.Millisecond))
+		assert.NoError(t, store.PutWithTTL("foo/b", []byte("b"), time.Hour))
+		time.Sleep(5 * time.Millisecond)
+		assert.NoError(t, store.sweepExpired())
+		switch s := store.(type) {
+		case *BoltStorage:
+			s.db.View(func(tx *bolt.Tx) error {
+				assert.Nil(t, tx.Bucket([]byte("kv")).Bucket([]byte("foo")).Get([]byte("a")))
+				assert.Nil(t, tx.Bucket([]byte("ttl")).Get([]byte("foo/a")))
+				assert.NotNil(t, tx.Bucket([]byte("ttl")).Get([]byte("foo/b")))
+				return nil
+			})
+		case *LevelDBStorage:
+			has, _ := s.db.Has([]byte("kv/foo/a"), nil)
+			assert.False(t, has)
+			has, _ = s.db.Has([]byte("ttl/foo/a"), nil)
+			assert.False(t, has)
+			has, _ = s.db.Has([]byte("ttl/foo/b"), nil)
+			assert.True(t, has)
+		}
+		assert.NoError(t, store.Close())
+	}
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// TxnOpType is the type of a single transaction operation
+type TxnOpType string
+
+// Supported transaction operations
+const (
+	TxnPut          TxnOpType = "put"
+	TxnDelete       TxnOpType = "delete"
+	TxnAddValue     TxnOpType = "add"
+	TxnMustExist    TxnOpType = "exists"
+	TxnMustNotExist TxnOpType = "not-exists"
+	TxnVersionIs    TxnOpType = "version"
+)
+
+// ErrGuardFailed is returned by Commit if one of the guards of a transaction doesn't hold
+var ErrGuardFailed = fmt.Errorf("%w: transaction guard failed", ErrConflict)
+
+// TxnOp is a single operation of a transaction
+type TxnOp struct {
+	Type    TxnOpType
+	Key     string
+	Value   []byte
+	Entry   *TimeSeriesEntry
+	Version uint64
+}
+
+// IsGuard checks if the operation is a precondition instead of a write
+func (op *TxnOp) IsGuard() bool {
+	return op.Type == TxnMustExist || op.Type == TxnMustNotExist || op.Type == TxnVersionIs
+}
+
+// Txn is a list of operations which are committed atomically.
+// All guards are checked against the state before the transaction, if one fails none of the writes is applied.
+type Txn struct {
+	Ops []*TxnOp
+}
+
+// NewTxn creates a new empty transaction
+func NewTxn() *Txn {
+	return &Txn{}
+}
+
+// Put adds a kv write to the transaction
+func (txn *Txn) Put(key string, value []byte) *Txn {
+	txn.Ops = append(txn.Ops, &TxnOp{Type: TxnPut, Key: key, Value: value})
+	return txn
+}
+
+// Delete adds a kv delete to the transaction
+func (txn *Txn) Delete(key string) *Txn {
+	txn.Ops = append(txn.Ops, &TxnOp{Type: TxnDelete, Key: key})
+	return txn
+}
+
+// AddValue adds a timeseries write to the transaction, a zero timestamp means the commit time
+func (txn *Txn) AddValue(key string, value float64, timestamp time.Time) *Txn {
+	txn.Ops = append(txn.Ops, &TxnOp{Type: TxnAddValue, Key: key, Entry: &TimeSeriesEntry{Value: value, Timestamp: timestamp}})
+	return txn
+}
+
+// MustExist adds a guard which requires that key exists
+func (txn *Txn) MustExist(key string) *Txn {
+	txn.Ops = append(txn.Ops, &TxnOp{Type: TxnMustExist, Key: key})
+	return txn
+}
+
+// MustNotExist adds a guard which requires that key doesn't exist
+func (txn *Txn) MustNotExist(key string) *Txn {
+	txn.Ops = append(txn.Ops, &TxnOp{Type: TxnMustNotExist, Key: key})
+	return txn
+}
+
+// VersionIs adds a guard which requires that key has the given version
+func (txn *Txn) VersionIs(key string, version uint64) *Txn {
+	txn.Ops = append(txn.Ops, &TxnOp{Type: TxnVersionIs, Key: key, Version: version})
+	return txn
+}
+
+// Validate checks that all operations are well formed
+func (txn *Txn) Validate() error {
+	for _, op := range txn.Ops {
+		switch op.Type {
+		case TxnPut, TxnDelete, TxnMustExist, TxnMustNotExist, TxnVersionIs:
+		case TxnAddValue:
+			if op.Entry == nil {
+				return invalidArgument("add operations need an entry")
+			}
+			if err := validateFields(op.Entry); err != nil {
+				return err
+			}
+			if err := validateSeriesKey(op.Key); err != nil {
+				return err
+			}
+		default:
+			return invalidArgument("unknown transaction operation '" + string(op.Type) + "'")
+		}
+		if err := validateKey(op.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkGuard evaluates a guard given the existence and version of its key
+func checkGuard(op *TxnOp, exists bool, version uint64) bool {
+	switch op.Type {
+	case TxnMustExist:
+		return exists
+	case TxnMustNotExist:
+		return !exists
+	case TxnVersionIs:
+		return exists && version == op.Version
+	}
+	return true
+}
+
+// entryWithStamp returns the entry of an add operation, stamped with now if it has no timestamp
+func entryWithStamp(op *TxnOp, now time.Time) *TimeSeriesEntry {
+	if op.Entry.Timestamp.IsZero() {
+		return &TimeSeriesEntry{Value: op.Entry.Value, Timestamp: now, Fields: op.Entry.Fields}
+	}
+	return op.Entry
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"strings"
+	"sync"
+)
+
+// EventType is the type of a change event
+type EventType string
+
+// Supported event types
+const (
+	EventPut      EventType = "put"
+	EventDelete   EventType = "delete"
+	EventAddValue EventType = "add"
+)
+
+// Event describes a change of a kv entry or a new timeseries entry
+type Event struct {
+	Type    EventType
+	Key     string
+	Value   []byte
+	Version uint64
+	Entry   *TimeSeriesEntry
+}
+
+// Watcher is implemented by storages which can notify about changes
+type Watcher interface {
+	// Watch returns a channel which receives an event for every change of a key starting with prefix.
+	// The channel is closed when cancel is called or if the receiver doesn't keep up with the changes.
+	Watch(prefix string) (events <-chan *Event, cancel func())
+}
+
+// SeriesWatcher is implemented by storages which can notify about new timeseries entries
+type SeriesWatcher interface {
+	// Follow returns a channel which receives an EventAddValue for every entry added to the timeseries key.
+	// A key ending with '*' follows all timeseries with the given prefix.
+	Follow(key string) (events <-chan *Event, cancel func())
+}
+
+// watchBufferSize is the number of events buffered per watch before it is dropped
+const watchBufferSize = 256
+
+type watch struct {
+	prefix string
+	exact  bool
+	ch     chan *Event
+}
+
+func (w *watch) matches(key string) bool {
+	if w.exact {
+		return key == w.prefix
+	}
+	return strings.HasPrefix(key, w.prefix)
+}
+
+// watchHub distributes events to all matching watches
+type watchHub struct {
+	mutex   sync.Mutex
+	watches map[*watch]bool
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{watches: make(map[*watch]bool)}
+}
+
+func (hub *watchHub) watch(prefix string, exact bool) (<-chan *Event, func()) {
+	w := &watch{prefix, exact, make(chan *Event, watchBufferSize)}
+	hub.mutex.Lock()
+	hub.watches[w] = true
+	hub.mutex.Unlock()
+	return w.ch, func() {
+		hub.mutex.Lock()
+		defer hub.mutex.Unlock()
+		hub.remove(w)
+	}
+}
+
+// remove closes and forgets a watch, the caller must hold the mutex
+func (hub *watchHub) remove(w *watch) {
+	if hub.watches[w] {
+		delete(hub.watches, w)
+		close(w.ch)
+	}
+}
+
+func (hub *watchHub) publish(event *Event) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	for w := range hub.watches {
+		if !w.matches(event.Key) {
+			continue
+		}
+		select {
+		case w.ch <- event:
+		default:
+			// the watcher is too slow, dropping it is better than blocking all writers
+			hub.remove(w)
+		}
+	}
+}